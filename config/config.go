@@ -5,6 +5,7 @@ import (
 	"log"
 	"path"
 	"runtime"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -16,10 +17,114 @@ type Config struct {
 	Server struct {
 		ENV  string `envconfig:"APP_ENV"`
 		PORT string `envconfig:"APP_PORT"`
+		// BaseURL is the public URL of the application used to build links sent to users
+		BaseURL string `envconfig:"APP_BASE_URL"`
+		// TrustedProxies is the comma separated list of IP addresses or CIDR ranges of the proxies
+		// whose X-Forwarded-For and X-Real-IP headers are trusted
+		TrustedProxies string `envconfig:"APP_TRUSTED_PROXIES"`
 	}
 	JWT struct {
-		SigningKey      string `envconfig:"JWT_SIGNING_KEY"`
-		TokenExpiration int    `envconfig:"JWT_TOKEN_EXPIRATION"`
+		// SigningKey is the shared secret used to sign tokens with HS256 when KeysDir is empty
+		SigningKey string `envconfig:"JWT_SIGNING_KEY"`
+		// KeysDir is a directory of PEM encoded keys named <kid>.pem used to sign and verify tokens
+		KeysDir string `envconfig:"JWT_KEYS_DIR"`
+		// ActiveKeyID is the kid of the private key in KeysDir used to sign new tokens
+		ActiveKeyID string `envconfig:"JWT_ACTIVE_KEY_ID"`
+		// AccessTokenExpiration is the lifetime of access tokens in minutes
+		AccessTokenExpiration int `envconfig:"JWT_ACCESS_TOKEN_EXPIRATION_MINUTES"`
+		// TokenExpiration is the deprecated lifetime of access tokens in hours, used when AccessTokenExpiration is not set
+		TokenExpiration int `envconfig:"JWT_TOKEN_EXPIRATION"`
+		// RefreshTokenExpiration is the lifetime of refresh tokens in hours
+		RefreshTokenExpiration int `envconfig:"JWT_REFRESH_TOKEN_EXPIRATION"`
+	}
+	Auth struct {
+		// PasswordResetExpiration is the lifetime of password reset tokens in minutes
+		PasswordResetExpiration int `envconfig:"AUTH_PASSWORD_RESET_EXPIRATION"`
+		// PasswordResetURL is the frontend page where users choose a new password, the reset token is added as the token query parameter
+		PasswordResetURL string `envconfig:"AUTH_PASSWORD_RESET_URL"`
+		// RequireEmailVerification refuses logins of users who have not verified their email address
+		RequireEmailVerification bool `envconfig:"AUTH_REQUIRE_EMAIL_VERIFICATION"`
+		// EmailVerificationExpiration is the lifetime of email verification tokens in hours
+		EmailVerificationExpiration int `envconfig:"AUTH_EMAIL_VERIFICATION_EXPIRATION"`
+		// MFAIssuer is the issuer name shown by authenticator apps
+		MFAIssuer string `envconfig:"AUTH_MFA_ISSUER"`
+		// MFATokenExpiration is the lifetime in minutes of the token exchanged for an access token at /login/mfa
+		MFATokenExpiration int `envconfig:"AUTH_MFA_TOKEN_EXPIRATION"`
+		// LockoutThreshold is the number of failed logins per email address before it is locked, 0 disables the lockout
+		LockoutThreshold int `envconfig:"AUTH_LOCKOUT_THRESHOLD"`
+		// LockoutIPThreshold is the number of failed logins per IP address before it is locked, 0 disables the lockout
+		LockoutIPThreshold int `envconfig:"AUTH_LOCKOUT_IP_THRESHOLD"`
+		// LockoutWindow is the time in minutes after which failed logins are forgotten
+		LockoutWindow int `envconfig:"AUTH_LOCKOUT_WINDOW"`
+		// LockoutDuration is the duration in minutes of the first lockout, doubled by every further failure
+		LockoutDuration int `envconfig:"AUTH_LOCKOUT_DURATION"`
+		// LockoutMaxDuration is the maximum duration of a lockout in minutes
+		LockoutMaxDuration int `envconfig:"AUTH_LOCKOUT_MAX_DURATION"`
+		// ImpersonationExpiration is the lifetime in minutes of the tokens issued to administrators impersonating a user
+		ImpersonationExpiration int `envconfig:"AUTH_IMPERSONATION_EXPIRATION"`
+		// ImpersonationScopes is the space separated list of permissions granted to impersonation tokens
+		ImpersonationScopes string `envconfig:"AUTH_IMPERSONATION_SCOPES"`
+		// MagicLinkExpiration is the lifetime in minutes of the passwordless sign-in links
+		MagicLinkExpiration int `envconfig:"AUTH_MAGIC_LINK_EXPIRATION"`
+		// MagicLinkLimit is the number of sign-in links that can be requested per email address within MagicLinkWindow, 0 disables the limit
+		MagicLinkLimit int `envconfig:"AUTH_MAGIC_LINK_LIMIT"`
+		// MagicLinkWindow is the time in minutes after which sign-in link requests are forgotten
+		MagicLinkWindow int `envconfig:"AUTH_MAGIC_LINK_WINDOW"`
+	}
+	Password struct {
+		// Algorithm is the algorithm used to hash new passwords, either bcrypt, argon2id or scrypt
+		Algorithm  string `envconfig:"PASSWORD_ALGORITHM"`
+		BcryptCost int    `envconfig:"PASSWORD_BCRYPT_COST"`
+		// Argon2Time is the number of passes over the memory
+		Argon2Time uint32 `envconfig:"PASSWORD_ARGON2_TIME"`
+		// Argon2Memory is the amount of memory used by argon2id in KiB
+		Argon2Memory  uint32 `envconfig:"PASSWORD_ARGON2_MEMORY"`
+		Argon2Threads uint8  `envconfig:"PASSWORD_ARGON2_THREADS"`
+		// ScryptN is the CPU/memory cost parameter of scrypt, it must be a power of two
+		ScryptN int `envconfig:"PASSWORD_SCRYPT_N"`
+		ScryptR int `envconfig:"PASSWORD_SCRYPT_R"`
+		ScryptP int `envconfig:"PASSWORD_SCRYPT_P"`
+		// Pepper is a secret mixed into every password before hashing, an empty pepper disables it
+		Pepper string `envconfig:"PASSWORD_PEPPER"`
+		// MinLength is the minimum number of characters of a password
+		MinLength int `envconfig:"PASSWORD_MIN_LENGTH"`
+		// MinClasses is the number of character classes among lowercase letters, uppercase letters, digits and symbols a password must contain
+		MinClasses int `envconfig:"PASSWORD_MIN_CLASSES"`
+		// MinStrength is the minimum strength score of a password from 0 to 4, 0 disables the check
+		MinStrength int `envconfig:"PASSWORD_MIN_STRENGTH"`
+		// History is the number of most recent passwords that cannot be reused, 0 disables the check
+		History int `envconfig:"PASSWORD_HISTORY"`
+		// BreachedList is the path of a sorted file of SHA-1 hashes of breached passwords, an empty path disables the check
+		BreachedList string `envconfig:"PASSWORD_BREACHED_LIST"`
+	}
+	OIDC struct {
+		// Issuer is the URL of the OpenID Connect provider, an empty issuer disables single sign-on
+		Issuer       string `envconfig:"OIDC_ISSUER"`
+		ClientID     string `envconfig:"OIDC_CLIENT_ID"`
+		ClientSecret string `envconfig:"OIDC_CLIENT_SECRET"`
+		// RedirectURL is the callback URL registered at the provider, defaults to <BaseURL>/login/oidc/callback
+		RedirectURL string `envconfig:"OIDC_REDIRECT_URL"`
+		// Scopes is the space separated list of scopes requested in addition to openid
+		Scopes string `envconfig:"OIDC_SCOPES"`
+		// AllowSignup creates an account on the first login of unknown users
+		AllowSignup bool `envconfig:"OIDC_ALLOW_SIGNUP"`
+	}
+	Mail struct {
+		// Driver is either log or file
+		Driver string `envconfig:"MAIL_DRIVER"`
+		// Dir is the directory the file driver writes messages to
+		Dir  string `envconfig:"MAIL_DIR"`
+		From string `envconfig:"MAIL_FROM"`
+	}
+	Users struct {
+		// PurgeRetention is the number of days soft-deleted users are kept before the purge command removes them
+		PurgeRetention int `envconfig:"USERS_PURGE_RETENTION"`
+	}
+	Pagination struct {
+		// CursorKey is the secret used to sign pagination cursors, an empty key uses a random one per process.
+		// Deployments running more than one instance must set the same key on every instance through
+		// PAGINATION_CURSOR_KEY, otherwise a cursor issued by one instance is refused by the others.
+		CursorKey string `envconfig:"PAGINATION_CURSOR_KEY"`
 	}
 	Database struct {
 		Host     string `envconfig:"DB_HOST"`
@@ -30,6 +135,21 @@ type Config struct {
 	}
 }
 
+// DefaultAccessTokenExpiration is the lifetime of access tokens in minutes when none is configured
+const DefaultAccessTokenExpiration = 15
+
+// AccessTokenLifetime returns the lifetime of access tokens, taken from JWT.AccessTokenExpiration in minutes,
+// or from the deprecated JWT.TokenExpiration in hours when only the latter is set.
+func (c Config) AccessTokenLifetime() time.Duration {
+	if c.JWT.AccessTokenExpiration > 0 {
+		return time.Duration(c.JWT.AccessTokenExpiration) * time.Minute
+	}
+	if c.JWT.TokenExpiration > 0 {
+		return time.Duration(c.JWT.TokenExpiration) * time.Hour
+	}
+	return DefaultAccessTokenExpiration * time.Minute
+}
+
 // LoadTest loads test config
 func LoadTest() Config {
 	return load("test", ".env.test")
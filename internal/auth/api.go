@@ -2,17 +2,73 @@ package auth
 
 import (
 	"net/http"
+	"net/url"
 
 	"github.com/labstack/echo"
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
 	"github.com/redhajuanda/gorengan/internal/httpsuccess"
 	"github.com/redhajuanda/gorengan/pkg/log"
+	"github.com/redhajuanda/gorengan/pkg/realip"
 )
 
 // RegisterService registers a new user service
-func RegisterService(r echo.Group, service Service, logger log.Logger) {
+func RegisterService(r echo.Group, service Service, keys *KeySet, verifier TokenVerifier, checker PermissionChecker, logger log.Logger) {
 	handler := handler{service, logger}
 
+	RegisterPermissions(
+		Permission{Name: PermissionRolesRead, Description: "List roles and their permissions"},
+		Permission{Name: PermissionRolesWrite, Description: "Change the permissions mapped to roles"},
+		Permission{Name: PermissionSessionsRevoke, Description: "Revoke every token issued to a user"},
+		Permission{Name: PermissionAccountsUnlock, Description: "Unlock accounts locked by failed login attempts"},
+		Permission{Name: PermissionClientsRead, Description: "List registered OAuth clients"},
+		Permission{Name: PermissionClientsWrite, Description: "Register and delete OAuth clients"},
+		Permission{Name: PermissionUsersImpersonate, Description: "Act as another user, administrators only"},
+		Permission{Name: PermissionCredentialsWrite, Description: "Change one's own profile, password, two-factor authentication and API keys, granted to every user"},
+	)
+
+	r.GET("/.well-known/jwks.json", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, keys.JWKS())
+	})
 	r.POST("/login", handler.login)
+	r.POST("/login/mfa", handler.loginMFA)
+	r.POST("/login/magic-link", handler.sendMagicLink)
+	r.GET("/login/magic-link/callback", handler.loginMagicLink)
+	r.GET("/login/oidc", handler.loginOIDC)
+	r.GET("/login/oidc/callback", handler.loginOIDCCallback)
+	r.POST("/token/refresh", handler.refresh)
+	r.POST("/oauth/token", handler.oauthToken)
+	r.POST("/oauth/introspect", handler.introspect)
+	r.POST("/oauth/revoke", handler.revokeToken)
+	r.POST("/password/forgot", handler.forgotPassword)
+	r.POST("/password/reset", handler.resetPassword)
+	r.GET("/verify-email", handler.verifyEmail)
+	r.POST("/verify-email/resend", handler.resendVerification)
+
+	// the following endpoints require a valid JWT
+	isLoggedIn := IsLoggedIn(verifier)
+	rejectImpersonation := RejectImpersonation()
+	// tokens restricted to other scopes cannot manage the credentials of the user
+	requireCredentials := RequireScopes(PermissionCredentialsWrite)
+	r.POST("/logout", handler.logout, isLoggedIn)
+	r.POST("/me/mfa/enroll", handler.enrollMFA, isLoggedIn, rejectImpersonation, requireCredentials)
+	r.POST("/me/mfa/confirm", handler.confirmMFA, isLoggedIn, rejectImpersonation, requireCredentials)
+	r.POST("/me/mfa/disable", handler.disableMFA, isLoggedIn, rejectImpersonation, requireCredentials)
+	r.GET("/me/sessions", handler.querySessions, isLoggedIn)
+	r.DELETE("/me/sessions/:id", handler.terminateSession, isLoggedIn, rejectImpersonation)
+	r.GET("/me/api-keys", handler.queryAPIKeys, isLoggedIn)
+	r.POST("/me/api-keys", handler.createAPIKey, isLoggedIn, rejectImpersonation, requireCredentials)
+	r.DELETE("/me/api-keys/:id", handler.revokeAPIKey, isLoggedIn, rejectImpersonation)
+	r.POST("/users/:id/impersonate", handler.impersonate, isLoggedIn, rejectImpersonation, RequireRole(domain.RoleAdmin), RequireScopes(PermissionUsersImpersonate))
+	r.POST("/users/:id/sessions/revoke", handler.revokeSessions, isLoggedIn, RequirePermission(checker, PermissionSessionsRevoke))
+	r.POST("/users/:id/unlock", handler.unlock, isLoggedIn, RequirePermission(checker, PermissionAccountsUnlock))
+	r.GET("/oauth/clients", handler.queryOAuthClients, isLoggedIn, RequirePermission(checker, PermissionClientsRead))
+	r.POST("/oauth/clients", handler.createOAuthClient, isLoggedIn, RequirePermission(checker, PermissionClientsWrite))
+	r.DELETE("/oauth/clients/:id", handler.deleteOAuthClient, isLoggedIn, RequirePermission(checker, PermissionClientsWrite))
+	r.GET("/permissions", handler.queryPermissions, isLoggedIn, RequirePermission(checker, PermissionRolesRead))
+	r.GET("/roles", handler.queryRoles, isLoggedIn, RequirePermission(checker, PermissionRolesRead))
+	r.GET("/roles/:id", handler.getRole, isLoggedIn, RequirePermission(checker, PermissionRolesRead))
+	r.PUT("/roles/:id/permissions", handler.setRolePermissions, isLoggedIn, RequirePermission(checker, PermissionRolesWrite))
 }
 
 type handler struct {
@@ -25,13 +81,455 @@ func (h handler) login(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return err
 	}
+	req.ClientInfo = clientInfo(c)
+
+	token, err := h.service.Login(c.Request().Context(), req)
+	if err != nil {
+		return err
+	}
+	if token.MFARequired {
+		return httpsuccess.ResponseWithJSON(c, "two-factor authentication required", http.StatusOK, token)
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "access granted", http.StatusOK, token)
+}
+
+func (h handler) loginOIDC(c echo.Context) error {
+	authorization, err := h.service.StartOIDCLogin(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	c.SetCookie(oidcSessionCookie(c, authorization.Session, int(oidcSessionExpiration.Seconds())))
+	return c.Redirect(http.StatusFound, authorization.URL)
+}
+
+func (h handler) loginOIDCCallback(c echo.Context) error {
+	req := OIDCCallbackRequest{
+		Code:       c.QueryParam("code"),
+		State:      c.QueryParam("state"),
+		Error:      c.QueryParam("error"),
+		ClientInfo: clientInfo(c),
+	}
+	if cookie, err := c.Cookie(oidcSessionCookieName); err == nil {
+		req.Session = cookie.Value
+	}
+	c.SetCookie(oidcSessionCookie(c, "", -1))
+
+	token, err := h.service.OIDCCallback(c.Request().Context(), req)
+	if err != nil {
+		return err
+	}
+	if token.MFARequired {
+		return httpsuccess.ResponseWithJSON(c, "two-factor authentication required", http.StatusOK, token)
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "access granted", http.StatusOK, token)
+}
+
+// clientInfo returns the IP address and the user agent of the client sending the request.
+func clientInfo(c echo.Context) ClientInfo {
+	return ClientInfo{IP: realip.FromRequest(c.Request()), UserAgent: c.Request().UserAgent()}
+}
+
+// oidcSessionCookieName is the name of the cookie holding the state of a pending OpenID Connect login.
+const oidcSessionCookieName = "oidc_session"
+
+// oidcSessionCookie returns the cookie holding the state of a pending OpenID Connect login.
+// A negative maxAge deletes the cookie.
+func oidcSessionCookie(c echo.Context, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcSessionCookieName,
+		Value:    value,
+		Path:     "/login/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (h handler) loginMFA(c echo.Context) error {
+	var req LoginMFARequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+	req.ClientInfo = clientInfo(c)
+
+	token, err := h.service.LoginMFA(c.Request().Context(), req)
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "access granted", http.StatusOK, token)
+}
+
+func (h handler) sendMagicLink(c echo.Context) error {
+	var req MagicLinkRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	if err := h.service.SendMagicLink(c.Request().Context(), req); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "if the email is registered, a sign-in link has been sent", http.StatusOK, nil)
+}
 
-	accessToken, err := h.service.Login(c.Request().Context(), req)
+func (h handler) loginMagicLink(c echo.Context) error {
+	req := MagicLinkCallbackRequest{Token: c.QueryParam("token"), ClientInfo: clientInfo(c)}
+
+	token, err := h.service.LoginMagicLink(c.Request().Context(), req)
 	if err != nil {
 		return err
 	}
+	if token.MFARequired {
+		return httpsuccess.ResponseWithJSON(c, "two-factor authentication required", http.StatusOK, token)
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "access granted", http.StatusOK, token)
+}
 
-	return httpsuccess.ResponseWithJSON(c, "access granted", http.StatusOK, map[string]string{
-		"token": accessToken,
+func (h handler) refresh(c echo.Context) error {
+	var req RefreshRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	token, err := h.service.Refresh(c.Request().Context(), req)
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "access granted", http.StatusOK, token)
+}
+
+func (h handler) oauthToken(c echo.Context) error {
+	token, err := h.service.OAuthToken(c.Request().Context(), OAuthTokenRequest{
+		ClientCredentials: clientCredentials(c),
+		GrantType:         c.FormValue("grant_type"),
+		Scope:             c.FormValue("scope"),
+		RefreshToken:      c.FormValue("refresh_token"),
+	})
+	if err != nil {
+		return oauthErrorResponse(c, err)
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Pragma", "no-cache")
+	return c.JSON(http.StatusOK, token)
+}
+
+func (h handler) introspect(c echo.Context) error {
+	introspection, err := h.service.Introspect(c.Request().Context(), TokenRequest{
+		ClientCredentials: clientCredentials(c),
+		Token:             c.FormValue("token"),
+		TokenTypeHint:     c.FormValue("token_type_hint"),
+	})
+	if err != nil {
+		return oauthErrorResponse(c, err)
+	}
+
+	return c.JSON(http.StatusOK, introspection)
+}
+
+func (h handler) revokeToken(c echo.Context) error {
+	err := h.service.RevokeToken(c.Request().Context(), TokenRequest{
+		ClientCredentials: clientCredentials(c),
+		Token:             c.FormValue("token"),
+		TokenTypeHint:     c.FormValue("token_type_hint"),
 	})
+	if err != nil {
+		return oauthErrorResponse(c, err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// clientCredentials returns the credentials of an OAuth client sent either with HTTP Basic authentication,
+// whose user and password are form encoded as required by RFC 6749 section 2.3.1, or as form parameters.
+func clientCredentials(c echo.Context) ClientCredentials {
+	if id, secret, ok := c.Request().BasicAuth(); ok {
+		if unescaped, err := url.QueryUnescape(id); err == nil {
+			id = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(secret); err == nil {
+			secret = unescaped
+		}
+		return ClientCredentials{ClientID: id, ClientSecret: secret}
+	}
+	return ClientCredentials{ClientID: c.FormValue("client_id"), ClientSecret: c.FormValue("client_secret")}
+}
+
+// oauthErrorResponse writes an OAuthError in the format required by the OAuth2 endpoints.
+// Other errors are left to the default error handler.
+func oauthErrorResponse(c echo.Context, err error) error {
+	oauthErr, ok := err.(OAuthError)
+	if !ok {
+		return err
+	}
+	if oauthErr.Status == http.StatusUnauthorized {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+	}
+	return c.JSON(oauthErr.Status, oauthErr)
+}
+
+func (h handler) forgotPassword(c echo.Context) error {
+	var req ForgotPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	if err := h.service.ForgotPassword(c.Request().Context(), req); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "if the email is registered, a password reset link has been sent", http.StatusOK, nil)
+}
+
+func (h handler) resetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	if err := h.service.ResetPassword(c.Request().Context(), req); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "password reset", http.StatusOK, nil)
+}
+
+func (h handler) verifyEmail(c echo.Context) error {
+	if err := h.service.VerifyEmail(c.Request().Context(), c.QueryParam("token")); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "email verified", http.StatusOK, nil)
+}
+
+func (h handler) resendVerification(c echo.Context) error {
+	var req ResendVerificationRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	if err := h.service.ResendVerification(c.Request().Context(), req); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "if the email is registered and not yet verified, a verification link has been sent", http.StatusOK, nil)
+}
+
+func (h handler) logout(c echo.Context) error {
+	var req LogoutRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			h.logger.With(c.Request().Context()).Info(err)
+			return httperror.BadRequest("")
+		}
+	}
+
+	principal, _ := PrincipalFromContext(c)
+	err := h.service.Logout(c.Request().Context(), principal.ID, principal.TokenID, principal.SessionID, principal.ExpiresAt, req)
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "logged out", http.StatusOK, nil)
+}
+
+func (h handler) enrollMFA(c echo.Context) error {
+	enrollment, err := h.service.EnrollMFA(c.Request().Context(), currentUserID(c))
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "scan the provisioning uri and confirm with a code", http.StatusOK, enrollment)
+}
+
+func (h handler) confirmMFA(c echo.Context) error {
+	var req MFACodeRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	if err := h.service.ConfirmMFA(c.Request().Context(), currentUserID(c), req); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "two-factor authentication enabled", http.StatusOK, nil)
+}
+
+func (h handler) disableMFA(c echo.Context) error {
+	var req MFACodeRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	if err := h.service.DisableMFA(c.Request().Context(), currentUserID(c), req); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "two-factor authentication disabled", http.StatusOK, nil)
+}
+
+func (h handler) querySessions(c echo.Context) error {
+	principal, _ := PrincipalFromContext(c)
+	sessions, err := h.service.QuerySessions(c.Request().Context(), principal.ID, principal.SessionID)
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "", http.StatusOK, sessions)
+}
+
+func (h handler) terminateSession(c echo.Context) error {
+	if err := h.service.TerminateSession(c.Request().Context(), currentUserID(c), c.Param("id")); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "session terminated", http.StatusOK, nil)
+}
+
+func (h handler) queryAPIKeys(c echo.Context) error {
+	keys, err := h.service.QueryAPIKeys(c.Request().Context(), currentUserID(c))
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "", http.StatusOK, keys)
+}
+
+func (h handler) createAPIKey(c echo.Context) error {
+	var req CreateAPIKeyRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	key, err := h.service.CreateAPIKey(c.Request().Context(), currentUserID(c), req)
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "api key created, store it now as it will not be shown again", http.StatusCreated, key)
+}
+
+func (h handler) revokeAPIKey(c echo.Context) error {
+	if err := h.service.RevokeAPIKey(c.Request().Context(), currentUserID(c), c.Param("id")); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "api key revoked", http.StatusOK, nil)
+}
+
+func (h handler) revokeSessions(c echo.Context) error {
+	if err := h.service.RevokeSessions(c.Request().Context(), c.Param("id")); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "sessions revoked", http.StatusOK, nil)
+}
+
+func (h handler) unlock(c echo.Context) error {
+	if err := h.service.Unlock(c.Request().Context(), c.Param("id")); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "account unlocked", http.StatusOK, nil)
+}
+
+func (h handler) impersonate(c echo.Context) error {
+	var req ImpersonateRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+	req.ClientInfo = clientInfo(c)
+
+	principal, _ := PrincipalFromContext(c)
+	token, err := h.service.Impersonate(c.Request().Context(), principal.RealID(), c.Param("id"), req)
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "impersonation granted", http.StatusOK, token)
+}
+
+func (h handler) queryOAuthClients(c echo.Context) error {
+	clients, err := h.service.QueryOAuthClients(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "", http.StatusOK, clients)
+}
+
+func (h handler) createOAuthClient(c echo.Context) error {
+	var req CreateOAuthClientRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	client, err := h.service.CreateOAuthClient(c.Request().Context(), req)
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "oauth client registered, store the secret now as it will not be shown again", http.StatusCreated, client)
+}
+
+func (h handler) deleteOAuthClient(c echo.Context) error {
+	if err := h.service.DeleteOAuthClient(c.Request().Context(), c.Param("id")); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "oauth client deleted", http.StatusOK, nil)
+}
+
+func (h handler) queryPermissions(c echo.Context) error {
+	return httpsuccess.ResponseWithJSON(c, "", http.StatusOK, Permissions())
+}
+
+func (h handler) queryRoles(c echo.Context) error {
+	roles, err := h.service.QueryRoles(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "", http.StatusOK, roles)
+}
+
+func (h handler) getRole(c echo.Context) error {
+	role, err := h.service.GetRole(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "", http.StatusOK, role)
+}
+
+func (h handler) setRolePermissions(c echo.Context) error {
+	var req SetRolePermissionsRequest
+	if err := c.Bind(&req); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	role, err := h.service.SetRolePermissions(c.Request().Context(), c.Param("id"), req)
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "role permissions updated", http.StatusOK, role)
 }
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+	"github.com/redhajuanda/gorengan/pkg/validation"
+)
+
+// apiKeyPrefix is prepended to every API key so that leaked keys are easy to recognize.
+const apiKeyPrefix = "gk_"
+
+// errInvalidAPIKey is returned by VerifyAPIKey for malformed, unknown and expired API keys.
+var errInvalidAPIKey = httperror.Unauthorized("invalid or expired api key")
+
+// APIKeyVerifier verifies the API keys presented to protected routes.
+type APIKeyVerifier interface {
+	// VerifyAPIKey checks the API key and returns the principal of the user owning it.
+	VerifyAPIKey(ctx context.Context, key string) (Principal, error)
+}
+
+// CreateAPIKeyRequest holds request data for creating an API key
+type CreateAPIKeyRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+	// Scopes restricts the key to the given permissions, an empty list grants every permission of the user.
+	// Keys created with a token restricted to some scopes must be restricted to some of those scopes.
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// NewAPIKey holds a newly created API key. The key itself cannot be retrieved later on.
+type NewAPIKey struct {
+	domain.APIKey
+	Key string `json:"key"`
+}
+
+// CreateAPIKey generates a new API key for the user with the specified ID.
+// The key cannot be granted more scopes than the token of the request carries.
+func (s service) CreateAPIKey(ctx context.Context, userID string, req CreateAPIKeyRequest) (NewAPIKey, error) {
+	if err := s.validation.Validate(req); err != nil {
+		return NewAPIKey{}, err
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return NewAPIKey{}, validation.NewValidationError("expires_at must be in the future")
+	}
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !IsRegistered(scope) {
+			return NewAPIKey{}, validation.NewValidationError(fmt.Sprintf("permission %v is not registered", scope))
+		}
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if err := s.checkAPIKeyScopes(ctx, scopes); err != nil {
+		return NewAPIKey{}, err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return NewAPIKey{}, err
+	}
+	plain := apiKeyPrefix + token
+	key := domain.APIKey{
+		ID:        domain.GenerateID(),
+		UserID:    userID,
+		Name:      req.Name,
+		Prefix:    plain[:len(apiKeyPrefix)+6],
+		KeyHash:   hashToken(plain),
+		Scopes:    scopes,
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateAPIKey(ctx, key); err != nil {
+		return NewAPIKey{}, err
+	}
+	s.logger.With(ctx, "user", userID, "api_key", key.ID).Infof("api key created")
+	return NewAPIKey{key, plain}, nil
+}
+
+// checkAPIKeyScopes makes sure that a token restricted to some scopes, because they have been requested on login,
+// only creates API keys restricted to some of those scopes. Tokens carrying every scope granted to the user
+// may create unrestricted keys.
+func (s service) checkAPIKeyScopes(ctx context.Context, scopes []string) error {
+	principal, ok := CurrentPrincipal(ctx)
+	if !ok || principal.Scopes == nil {
+		return nil
+	}
+	granted, err := s.grantedScopes(ctx, principal.Roles)
+	if err != nil {
+		return err
+	}
+	if hasScopes(principal, granted) {
+		return nil
+	}
+	if len(scopes) == 0 {
+		return validation.NewValidationError("scopes are required when the token is restricted to some scopes")
+	}
+	for _, scope := range scopes {
+		if !contains(principal.Scopes, scope) {
+			return validation.NewValidationError(fmt.Sprintf("scope %v is not granted to the token", scope))
+		}
+	}
+	return nil
+}
+
+// QueryAPIKeys returns the API keys of the user with the specified ID.
+func (s service) QueryAPIKeys(ctx context.Context, userID string) ([]domain.APIKey, error) {
+	return s.repo.QueryAPIKeys(ctx, userID)
+}
+
+// RevokeAPIKey deletes the API key with the specified ID of the user.
+func (s service) RevokeAPIKey(ctx context.Context, userID, id string) error {
+	deleted, err := s.repo.DeleteAPIKey(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return httperror.NotFound("")
+	}
+	s.logger.With(ctx, "user", userID, "api_key", id).Infof("api key revoked")
+	return nil
+}
+
+// VerifyAPIKey checks the API key and returns the principal of the user owning it,
+// restricted to the permissions of the key, if any. Malformed, unknown and expired keys are refused
+// with errInvalidAPIKey.
+func (s service) VerifyAPIKey(ctx context.Context, plain string) (Principal, error) {
+	if !strings.HasPrefix(plain, apiKeyPrefix) {
+		return Principal{}, errInvalidAPIKey
+	}
+	key, err := s.repo.GetAPIKey(ctx, hashToken(plain))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Principal{}, errInvalidAPIKey
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	now := time.Now()
+	if key.IsExpired(now) {
+		return Principal{}, errInvalidAPIKey
+	}
+	user, err := s.repo.GetUser(ctx, key.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Principal{}, errInvalidAPIKey
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+	if err := s.repo.TouchAPIKey(ctx, key.ID, now); err != nil {
+		return Principal{}, err
+	}
+
+	principal := Principal{
+		ID:       user.GetID(),
+		Username: user.GetUsername(),
+		Roles:    user.GetRoles(),
+		APIKeyID: key.ID,
+	}
+	if len(key.Scopes) > 0 {
+		principal.Scopes = key.Scopes
+	}
+	return principal, nil
+}
@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/pkg/mailer"
+)
+
+// ResendVerificationRequest holds request data for resending an email verification link
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// SendVerification sends an email verification link to the user.
+func (s service) SendVerification(ctx context.Context, user domain.User) error {
+	expiration := s.cfg.Auth.EmailVerificationExpiration
+	token, err := s.createUserToken(ctx, user.ID, domain.TokenPurposeEmailVerification, time.Duration(expiration)*time.Hour)
+	if err != nil {
+		return err
+	}
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %v,\n\nUse the following link to verify your email address. It expires in %v hours.\n\n%v/verify-email?token=%v",
+			user.FirstName, expiration, s.cfg.Server.BaseURL, url.QueryEscape(token)),
+	})
+	if err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", user.ID).Infof("email verification sent")
+	return nil
+}
+
+// ResendVerification sends a new email verification link to the unverified user with the requested email.
+// No error is returned when no unverified user has the email, so that callers cannot find out which emails are registered.
+func (s service) ResendVerification(ctx context.Context, req ResendVerificationRequest) error {
+	if err := s.validation.Validate(req); err != nil {
+		return err
+	}
+	user, err := s.repo.Login(ctx, req.Email)
+	if err != nil || user.IsEmailVerified() {
+		return nil
+	}
+	return s.SendVerification(ctx, user)
+}
+
+// VerifyEmail marks the email address of the user owning the verification token as verified.
+func (s service) VerifyEmail(ctx context.Context, token string) error {
+	userToken, err := s.useUserToken(ctx, domain.TokenPurposeEmailVerification, token)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.VerifyEmail(ctx, userToken.UserID, time.Now()); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userToken.UserID).Infof("email verified")
+	return nil
+}
@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Key is a key used to sign or verify access tokens.
+// Keys loaded from a public key file can only be used for verification.
+type Key struct {
+	ID         string
+	Method     jwt.SigningMethod
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
+}
+
+// KeySet holds the key used to sign new access tokens and every key accepted when verifying them.
+// Keeping retired keys in the set allows rotating the signing key without invalidating issued tokens.
+type KeySet struct {
+	signing Key
+	keys    map[string]Key
+}
+
+// NewHMACKeySet creates a key set that signs and verifies tokens with a shared secret using HS256.
+func NewHMACKeySet(secret string) *KeySet {
+	key := Key{Method: jwt.SigningMethodHS256, PrivateKey: []byte(secret), PublicKey: []byte(secret)}
+	return &KeySet{signing: key, keys: map[string]Key{"": key}}
+}
+
+// LoadKeySet loads every PEM file in dir as a key identified by the file name without extension.
+// Files may contain a private key, which can sign and verify tokens, or a public key, which can only verify them.
+// The signing method is derived from the key type: RS256 for RSA, ES256/ES384/ES512 for ECDSA and EdDSA for Ed25519.
+// The private key identified by activeID is used to sign new tokens.
+func LoadKeySet(dir, activeID string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	set := &KeySet{keys: map[string]Key{}}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParseKey(strings.TrimSuffix(filepath.Base(file), ".pem"), data)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading key %v: %v", file, err)
+		}
+		set.keys[key.ID] = key
+	}
+
+	active, ok := set.keys[activeID]
+	if !ok || active.PrivateKey == nil {
+		return nil, fmt.Errorf("Error loading keys: no private key with id %q found in %v", activeID, dir)
+	}
+	set.signing = active
+	return set, nil
+}
+
+// ParseKey parses a PEM encoded private or public key.
+func ParseKey(id string, data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("no PEM data found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return Key{}, fmt.Errorf("unsupported PEM block type %v", block.Type)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	key := Key{ID: id}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.PrivateKey, key.PublicKey = k, &k.PublicKey
+	case *ecdsa.PrivateKey:
+		key.PrivateKey, key.PublicKey = k, &k.PublicKey
+	case ed25519.PrivateKey:
+		key.PrivateKey, key.PublicKey = k, k.Public()
+	default:
+		key.PublicKey = k
+	}
+
+	switch k := key.PublicKey.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			key.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.Method = jwt.SigningMethodES512
+		default:
+			return Key{}, errors.New("unsupported elliptic curve")
+		}
+	case ed25519.PublicKey:
+		key.Method = SigningMethodEdDSA
+	default:
+		return Key{}, fmt.Errorf("unsupported key type %T", k)
+	}
+	return key, nil
+}
+
+// Sign signs the claims with the signing key and sets the kid header.
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.signing.Method, claims)
+	if s.signing.ID != "" {
+		token.Header["kid"] = s.signing.ID
+	}
+	return token.SignedString(s.signing.PrivateKey)
+}
+
+// Keyfunc returns the key identified by the kid header of the token.
+// It is meant to be passed to jwt.Parse.
+func (s *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown jwt key id=%v", kid)
+	}
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+	}
+	return key.PublicKey, nil
+}
+
+// JWK represents a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS represents a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the set, sorted by ID.
+// Shared secrets are never published.
+func (s *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range s.keys {
+		jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch k := key.PublicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encodeBigInt(k.N)
+			jwk.E = encodeBigInt(big.NewInt(int64(k.E)))
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = k.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(k.X.Bytes(), size))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(k.Y.Bytes(), size))
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(k)
+		default:
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+	return jwks
+}
+
+// encodeBigInt encodes an integer as the base64url encoding of its big-endian bytes.
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// padBytes left pads b with zeros to the given size.
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// SigningMethodEdDSA implements the EdDSA signing method with Ed25519 keys.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+// Alg returns the alg identifier of the signing method.
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Verify checks the signature of the signing string with an ed25519.PublicKey.
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return errors.New("ed25519: verification error")
+	}
+	return nil
+}
+
+// Sign signs the signing string with an ed25519.PrivateKey.
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKey(t *testing.T, dir, id string, key interface{}, public bool) {
+	var block *pem.Block
+	if public {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		assert.NoError(t, err)
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.NoError(t, err)
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, id+".pem"), pem.EncodeToMemory(block), 0600)
+	assert.NoError(t, err)
+}
+
+func TestLoadKeySet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	writeKey(t, dir, "rsa", rsaKey, false)
+	writeKey(t, dir, "ec", ecKey, false)
+	writeKey(t, dir, "ed", edKey, false)
+	writeKey(t, dir, "ed-public", edPublic, true)
+
+	_, err = LoadKeySet(dir, "ed-public")
+	assert.Error(t, err)
+	_, err = LoadKeySet(dir, "unknown")
+	assert.Error(t, err)
+
+	for id, alg := range map[string]string{"rsa": "RS256", "ec": "ES256", "ed": "EdDSA"} {
+		keys, err := LoadKeySet(dir, id)
+		assert.NoError(t, err)
+
+		tokenString, err := keys.Sign(jwt.MapClaims{"id": "test"})
+		assert.NoError(t, err)
+		token, err := jwt.Parse(tokenString, keys.Keyfunc)
+		assert.NoError(t, err)
+		assert.Equal(t, alg, token.Method.Alg())
+		assert.Equal(t, id, token.Header["kid"])
+	}
+
+	jwks := (&KeySet{keys: map[string]Key{}}).JWKS()
+	assert.Empty(t, jwks.Keys)
+
+	keys, err := LoadKeySet(dir, "rsa")
+	assert.NoError(t, err)
+	jwks = keys.JWKS()
+	assert.Len(t, jwks.Keys, 4)
+	assert.Equal(t, "EC", jwks.Keys[0].Kty)
+	assert.Equal(t, "P-256", jwks.Keys[0].Crv)
+	assert.Equal(t, "OKP", jwks.Keys[1].Kty)
+	assert.Equal(t, "RSA", jwks.Keys[3].Kty)
+	assert.Equal(t, "AQAB", jwks.Keys[3].E)
+}
+
+func TestKeySetRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	writeKey(t, dir, "2020-08", oldKey, false)
+	oldKeys, err := LoadKeySet(dir, "2020-08")
+	assert.NoError(t, err)
+	tokenString, err := oldKeys.Sign(jwt.MapClaims{"id": "test"})
+	assert.NoError(t, err)
+
+	// retire the old key by keeping only its public part and sign with a new one
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	writeKey(t, dir, "2020-08", &oldKey.PublicKey, true)
+	writeKey(t, dir, "2020-09", newKey, false)
+	newKeys, err := LoadKeySet(dir, "2020-09")
+	assert.NoError(t, err)
+
+	_, err = jwt.Parse(tokenString, newKeys.Keyfunc)
+	assert.NoError(t, err)
+
+	// tokens must not be accepted with a signing method other than the key's
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": "test"}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	_, err = jwt.Parse(hmacToken, newKeys.Keyfunc)
+	assert.Error(t, err)
+}
+
+func TestHMACKeySet(t *testing.T) {
+	keys := NewHMACKeySet("secret")
+	tokenString, err := keys.Sign(jwt.MapClaims{"id": "test"})
+	assert.NoError(t, err)
+	token, err := jwt.Parse(tokenString, keys.Keyfunc)
+	assert.NoError(t, err)
+	assert.Equal(t, "HS256", token.Method.Alg())
+	assert.Empty(t, keys.JWKS().Keys)
+}
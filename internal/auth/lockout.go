@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redhajuanda/gorengan/internal/httperror"
+)
+
+// LoginAttempts holds the failed login attempts recorded for an email address or an IP address.
+type LoginAttempts struct {
+	Failures    int
+	LockedUntil time.Time
+}
+
+// IsLocked checks whether logins are locked at the given time.
+func (a LoginAttempts) IsLocked(at time.Time) bool {
+	return at.Before(a.LockedUntil)
+}
+
+// LockoutStore keeps track of failed login attempts per email address and per IP address.
+type LockoutStore interface {
+	// Get returns the failed attempts recorded for the key.
+	Get(ctx context.Context, key string) (LoginAttempts, error)
+	// Fail records a failed attempt for the key and returns the updated attempts.
+	// Failures that happened more than window before the attempt are forgotten.
+	Fail(ctx context.Context, key string, at time.Time, window time.Duration) (LoginAttempts, error)
+	// Lock refuses logins for the key until the given time.
+	Lock(ctx context.Context, key string, until time.Time) error
+	// Reset forgets the failed attempts and the lock recorded for the key.
+	Reset(ctx context.Context, key string) error
+}
+
+type memoryLoginAttempts struct {
+	LoginAttempts
+	lastFailedAt time.Time
+}
+
+type memoryLockoutStore struct {
+	mu       sync.Mutex
+	attempts map[string]memoryLoginAttempts
+}
+
+// NewMemoryLockoutStore creates a lockout store that keeps failed attempts in memory.
+// It is suitable for tests and single instance deployments only, as counters are lost on restart.
+func NewMemoryLockoutStore() LockoutStore {
+	return &memoryLockoutStore{attempts: map[string]memoryLoginAttempts{}}
+}
+
+// Get returns the failed attempts recorded for the key.
+func (s *memoryLockoutStore) Get(ctx context.Context, key string) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key].LoginAttempts, nil
+}
+
+// Fail records a failed attempt for the key and returns the updated attempts.
+// Stale counters of other keys are purged along the way.
+func (s *memoryLockoutStore) Fail(ctx context.Context, key string, at time.Time, window time.Duration) (LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, attempts := range s.attempts {
+		if attempts.lastFailedAt.Before(at.Add(-window)) && !attempts.IsLocked(at) {
+			delete(s.attempts, k)
+		}
+	}
+	attempts := s.attempts[key]
+	attempts.Failures++
+	attempts.lastFailedAt = at
+	s.attempts[key] = attempts
+	return attempts.LoginAttempts, nil
+}
+
+// Lock refuses logins for the key until the given time.
+func (s *memoryLockoutStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempts := s.attempts[key]
+	attempts.LockedUntil = until
+	s.attempts[key] = attempts
+	return nil
+}
+
+// Reset forgets the failed attempts and the lock recorded for the key.
+func (s *memoryLockoutStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+type sqlLockoutStore struct {
+	db *sql.DB
+}
+
+// NewSQLLockoutStore creates a lockout store backed by the database.
+func NewSQLLockoutStore(db *sql.DB) LockoutStore {
+	return sqlLockoutStore{db}
+}
+
+// Get returns the failed attempts recorded for the key.
+func (s sqlLockoutStore) Get(ctx context.Context, key string) (LoginAttempts, error) {
+	var attempts LoginAttempts
+	var lockedUntil *time.Time
+	stmt, err := s.db.PrepareContext(ctx, "SELECT failures, locked_until FROM login_attempts WHERE attempt_key=?")
+	if err != nil {
+		return LoginAttempts{}, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	err = stmt.QueryRowContext(ctx, key).Scan(&attempts.Failures, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return LoginAttempts{}, nil
+	}
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	if lockedUntil != nil {
+		attempts.LockedUntil = *lockedUntil
+	}
+	return attempts, nil
+}
+
+// Fail records a failed attempt for the key and returns the updated attempts.
+func (s sqlLockoutStore) Fail(ctx context.Context, key string, at time.Time, window time.Duration) (LoginAttempts, error) {
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO login_attempts (attempt_key, failures, last_failed_at) VALUES (?,1,?) ON DUPLICATE KEY UPDATE failures=IF(last_failed_at < ?, 1, failures + 1), last_failed_at=VALUES(last_failed_at)")
+	if err != nil {
+		return LoginAttempts{}, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, key, at, at.Add(-window))
+	if err != nil {
+		return LoginAttempts{}, fmt.Errorf("Error exec query: %v", err)
+	}
+	return s.Get(ctx, key)
+}
+
+// Lock refuses logins for the key until the given time.
+func (s sqlLockoutStore) Lock(ctx context.Context, key string, until time.Time) error {
+	stmt, err := s.db.PrepareContext(ctx, "UPDATE login_attempts SET locked_until=? WHERE attempt_key=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, until, key)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// Reset forgets the failed attempts and the lock recorded for the key.
+func (s sqlLockoutStore) Reset(ctx context.Context, key string) error {
+	stmt, err := s.db.PrepareContext(ctx, "DELETE FROM login_attempts WHERE attempt_key=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, key)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// Unlock forgets the failed login attempts of the user with the specified ID and lifts its lockout.
+func (s service) Unlock(ctx context.Context, userID string) error {
+	user, err := s.repo.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := s.lockouts.Reset(ctx, emailLockoutKey(user.Email)); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userID).Infof("account unlocked")
+	return nil
+}
+
+// checkLockout refuses the login attempt if either the email address or the IP address is locked.
+func (s service) checkLockout(ctx context.Context, email, ip string) error {
+	now := time.Now()
+	for _, key := range lockoutKeys(email, ip) {
+		attempts, err := s.lockouts.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		if attempts.IsLocked(now) {
+			s.logger.With(ctx, "user", email, "ip", ip).Infof("authentication refused, %v is locked", key)
+			return httperror.TooManyRequests("Too many failed login attempts, please try again later")
+		}
+	}
+	return nil
+}
+
+// recordFailure counts a failed login attempt for the email address and the IP address,
+// and locks whichever exceeds its threshold. Every further failure doubles the lockout duration.
+func (s service) recordFailure(ctx context.Context, email, ip string) error {
+	now := time.Now()
+	window := time.Duration(s.cfg.Auth.LockoutWindow) * time.Minute
+	for _, key := range lockoutKeys(email, ip) {
+		threshold := s.cfg.Auth.LockoutThreshold
+		if strings.HasPrefix(key, "ip:") {
+			threshold = s.cfg.Auth.LockoutIPThreshold
+		}
+		if threshold <= 0 {
+			continue
+		}
+		attempts, err := s.lockouts.Fail(ctx, key, now, window)
+		if err != nil {
+			return err
+		}
+		if attempts.Failures < threshold {
+			continue
+		}
+		duration := lockoutDuration(attempts.Failures-threshold,
+			time.Duration(s.cfg.Auth.LockoutDuration)*time.Minute,
+			time.Duration(s.cfg.Auth.LockoutMaxDuration)*time.Minute)
+		if err := s.lockouts.Lock(ctx, key, now.Add(duration)); err != nil {
+			return err
+		}
+		s.logger.With(ctx, "user", email, "ip", ip).Infof("%v locked for %v", key, duration)
+	}
+	return nil
+}
+
+// lockoutDuration returns base doubled for every failure beyond the threshold, capped at max.
+func lockoutDuration(excess int, base, max time.Duration) time.Duration {
+	duration := time.Duration(float64(base) * math.Pow(2, float64(excess)))
+	if max > 0 && (duration > max || duration <= 0) {
+		return max
+	}
+	return duration
+}
+
+// lockoutKeys returns the lockout store keys of an email address and, if known, an IP address.
+func lockoutKeys(email, ip string) []string {
+	keys := []string{emailLockoutKey(email)}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+// emailLockoutKey returns the lockout store key of an email address.
+func emailLockoutKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
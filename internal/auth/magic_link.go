@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+	"github.com/redhajuanda/gorengan/pkg/mailer"
+)
+
+// purposeMagicLink is the purpose of the tokens sent in magic links, which log in a user without a password.
+const purposeMagicLink = "magic_link"
+
+// MagicLinkRequest holds request data for requesting a magic link
+type MagicLinkRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// MagicLinkCallbackRequest holds request data for logging in with a magic link
+type MagicLinkCallbackRequest struct {
+	Token string `validate:"required"`
+	ClientInfo
+}
+
+// SendMagicLink sends a link logging in the user with the requested email without a password.
+// No error is returned when no user has the email, so that callers cannot find out which emails are registered,
+// but requests are limited per email address whether it is registered or not.
+func (s service) SendMagicLink(ctx context.Context, req MagicLinkRequest) error {
+	if err := s.validation.Validate(req); err != nil {
+		return err
+	}
+	logger := s.logger.With(ctx, "user", req.Email)
+
+	if err := s.limitMagicLinks(ctx, req.Email); err != nil {
+		return err
+	}
+
+	user, err := s.repo.Login(ctx, req.Email)
+	if err != nil {
+		logger.Infof("magic link requested for unknown user")
+		return nil
+	}
+
+	token, err := s.generateMagicLinkToken(user.ID)
+	if err != nil {
+		return err
+	}
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf("Hi %v,\n\nUse the following link to sign in. It can only be used once and expires in %v minutes.\n\n%v/login/magic-link/callback?token=%v\n\nIf you did not request a sign-in link, you can ignore this email.",
+			user.FirstName, s.cfg.Auth.MagicLinkExpiration, s.cfg.Server.BaseURL, url.QueryEscape(token)),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Infof("magic link requested")
+	return nil
+}
+
+// LoginMagicLink exchanges the token of a magic link for an access token and a refresh token.
+// Every magic link can only be used once.
+func (s service) LoginMagicLink(ctx context.Context, req MagicLinkCallbackRequest) (Token, error) {
+	if err := s.validation.Validate(req); err != nil {
+		return Token{}, err
+	}
+	invalid := httperror.Unauthorized("Invalid or expired sign-in link")
+
+	token, err := jwt.Parse(req.Token, s.keys.Keyfunc)
+	if err != nil {
+		return Token{}, invalid
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	purpose, _ := claims["purpose"].(string)
+	userID, _ := claims["id"].(string)
+	tokenID, _ := claims["jti"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	expiresAt, _ := claims["exp"].(float64)
+	if purpose != purposeMagicLink || tokenID == "" {
+		return Token{}, invalid
+	}
+	revoked, err := s.revocations.IsRevoked(ctx, tokenID, "", userID, time.Unix(int64(issuedAt), 0))
+	if err != nil {
+		return Token{}, err
+	}
+	if revoked {
+		return Token{}, invalid
+	}
+	consumed, err := s.revocations.Consume(ctx, tokenID, time.Unix(int64(expiresAt), 0))
+	if err != nil {
+		return Token{}, err
+	}
+	if !consumed {
+		return Token{}, invalid
+	}
+
+	user, err := s.repo.GetUser(ctx, userID)
+	if err != nil {
+		return Token{}, invalid
+	}
+	logger := s.logger.With(ctx, "user", user.Email, "ip", req.IP)
+	if s.cfg.Auth.RequireEmailVerification && !user.IsEmailVerified() {
+		logger.Infof("authentication refused, email not verified")
+		return Token{}, httperror.Forbidden("Email address has not been verified")
+	}
+	logger.Infof("magic link authentication successful")
+	return s.completeLogin(ctx, user, req.ClientInfo, nil)
+}
+
+// limitMagicLinks counts a magic link request for the email address and refuses it once
+// more than the configured number of links have been requested within the window.
+func (s service) limitMagicLinks(ctx context.Context, email string) error {
+	if s.cfg.Auth.MagicLinkLimit <= 0 {
+		return nil
+	}
+	attempts, err := s.lockouts.Fail(ctx, magicLinkKey(email), time.Now(), time.Duration(s.cfg.Auth.MagicLinkWindow)*time.Minute)
+	if err != nil {
+		return err
+	}
+	if attempts.Failures > s.cfg.Auth.MagicLinkLimit {
+		s.logger.With(ctx, "user", email).Infof("magic link refused, too many requests")
+		return httperror.TooManyRequests("Too many sign-in links requested, please try again later")
+	}
+	return nil
+}
+
+// magicLinkKey returns the lockout store key counting the magic links requested for an email address.
+func magicLinkKey(email string) string {
+	return "magic-link:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// generateMagicLinkToken generates a short-lived magic_link token for the user.
+func (s service) generateMagicLinkToken(userID string) (string, error) {
+	now := time.Now()
+	return s.keys.Sign(jwt.MapClaims{
+		"jti":     domain.GenerateID(),
+		"id":      userID,
+		"purpose": purposeMagicLink,
+		"iat":     now.Unix(),
+		"exp":     now.Add(time.Duration(s.cfg.Auth.MagicLinkExpiration) * time.Minute).Unix(),
+	})
+}
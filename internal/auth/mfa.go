@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+	"github.com/redhajuanda/gorengan/pkg/totp"
+)
+
+const (
+	// purposeMFAPending is the purpose of tokens proving that a user whose two-factor authentication is enabled
+	// has entered a correct password. Such tokens can only be exchanged for an access token at /login/mfa.
+	purposeMFAPending = "mfa_pending"
+	// recoveryCodeCount is the number of recovery codes generated on enrollment.
+	recoveryCodeCount = 10
+)
+
+// MFAEnrollment holds the data a user needs to set up an authenticator app.
+type MFAEnrollment struct {
+	Secret          string   `json:"secret"`
+	ProvisioningURI string   `json:"provisioning_uri"`
+	RecoveryCodes   []string `json:"recovery_codes"`
+}
+
+// MFACodeRequest holds request data for confirming or disabling two-factor authentication
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// LoginMFARequest holds request data for completing a login with a two-factor authentication code
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	// Code is either a TOTP code or an unused recovery code
+	Code       string `json:"code" validate:"required"`
+	ClientInfo `json:"-"`
+}
+
+// EnrollMFA generates a new TOTP secret and recovery codes for the user.
+// The enrollment has to be confirmed with ConfirmMFA before it is enforced on login.
+func (s service) EnrollMFA(ctx context.Context, userID string) (MFAEnrollment, error) {
+	user, err := s.repo.GetUser(ctx, userID)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	if mfa, err := s.repo.GetMFA(ctx, userID); err == nil && mfa.IsEnabled() {
+		return MFAEnrollment{}, httperror.BadRequest("Two-factor authentication is already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = generateRecoveryCode(); err != nil {
+			return MFAEnrollment{}, err
+		}
+		hashes[i] = hashToken(normalizeRecoveryCode(codes[i]))
+	}
+
+	err = s.repo.SaveMFA(ctx, domain.MFA{UserID: userID, Secret: secret, CreatedAt: time.Now()}, hashes)
+	if err != nil {
+		return MFAEnrollment{}, err
+	}
+	s.logger.With(ctx, "user", userID).Infof("two-factor authentication enrolled")
+	return MFAEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totp.URI(secret, s.cfg.Auth.MFAIssuer, user.Email),
+		RecoveryCodes:   codes,
+	}, nil
+}
+
+// ConfirmMFA enables two-factor authentication for the user after checking a code from the authenticator app.
+func (s service) ConfirmMFA(ctx context.Context, userID string, req MFACodeRequest) error {
+	if err := s.validation.Validate(req); err != nil {
+		return err
+	}
+	mfa, err := s.repo.GetMFA(ctx, userID)
+	if err != nil {
+		return httperror.BadRequest("Two-factor authentication has not been enrolled")
+	}
+	if mfa.IsEnabled() {
+		return httperror.BadRequest("Two-factor authentication is already enabled")
+	}
+	if err := s.verifyTOTP(ctx, mfa, req.Code); err != nil {
+		return err
+	}
+	if err := s.repo.EnableMFA(ctx, userID, time.Now()); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userID).Infof("two-factor authentication enabled")
+	return nil
+}
+
+// DisableMFA disables two-factor authentication for the user after checking a TOTP or recovery code.
+func (s service) DisableMFA(ctx context.Context, userID string, req MFACodeRequest) error {
+	if err := s.validation.Validate(req); err != nil {
+		return err
+	}
+	mfa, err := s.repo.GetMFA(ctx, userID)
+	if err != nil || !mfa.IsEnabled() {
+		return httperror.BadRequest("Two-factor authentication is not enabled")
+	}
+	if err := s.verifyMFACode(ctx, mfa, req.Code); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteMFA(ctx, userID); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userID).Infof("two-factor authentication disabled")
+	return nil
+}
+
+// LoginMFA exchanges an mfa_pending token and a TOTP or recovery code for an access token and a refresh token.
+// The mfa_pending token is revoked after the first attempt, whether it succeeds or not, so that codes cannot be guessed.
+func (s service) LoginMFA(ctx context.Context, req LoginMFARequest) (Token, error) {
+	if err := s.validation.Validate(req); err != nil {
+		return Token{}, err
+	}
+	invalid := httperror.Unauthorized("Invalid or expired two-factor authentication token")
+
+	token, err := jwt.Parse(req.MFAToken, s.keys.Keyfunc)
+	if err != nil {
+		return Token{}, invalid
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	purpose, _ := claims["purpose"].(string)
+	userID, _ := claims["id"].(string)
+	tokenID, _ := claims["jti"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	expiresAt, _ := claims["exp"].(float64)
+	if purpose != purposeMFAPending || tokenID == "" {
+		return Token{}, invalid
+	}
+	revoked, err := s.revocations.IsRevoked(ctx, tokenID, "", userID, time.Unix(int64(issuedAt), 0))
+	if err != nil {
+		return Token{}, err
+	}
+	if revoked {
+		return Token{}, invalid
+	}
+	consumed, err := s.revocations.Consume(ctx, tokenID, time.Unix(int64(expiresAt), 0))
+	if err != nil {
+		return Token{}, err
+	}
+	if !consumed {
+		return Token{}, invalid
+	}
+
+	mfa, err := s.repo.GetMFA(ctx, userID)
+	if err != nil || !mfa.IsEnabled() {
+		return Token{}, invalid
+	}
+	if err := s.verifyMFACode(ctx, mfa, req.Code); err != nil {
+		return Token{}, err
+	}
+	user, err := s.repo.GetUser(ctx, userID)
+	if err != nil {
+		return Token{}, invalid
+	}
+	s.logger.With(ctx, "user", userID).Infof("two-factor authentication successful")
+	return s.startSession(ctx, user, req.ClientInfo, scopesFromClaims(claims))
+}
+
+// requiresMFA checks whether the user has confirmed a two-factor authentication enrollment.
+func (s service) requiresMFA(ctx context.Context, userID string) (bool, error) {
+	mfa, err := s.repo.GetMFA(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return mfa.IsEnabled(), nil
+}
+
+// generateMFAToken generates a short-lived mfa_pending token for the user,
+// carrying the scopes requested on login so that they apply to the session started at /login/mfa.
+func (s service) generateMFAToken(userID string, scopes []string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"jti":     domain.GenerateID(),
+		"id":      userID,
+		"purpose": purposeMFAPending,
+		"iat":     now.Unix(),
+		"exp":     now.Add(time.Duration(s.cfg.Auth.MFATokenExpiration) * time.Minute).Unix(),
+	}
+	if len(scopes) > 0 {
+		claims["scope"] = strings.Join(scopes, " ")
+	}
+	return s.keys.Sign(claims)
+}
+
+// verifyMFACode checks a TOTP code or, failing that, consumes a recovery code.
+func (s service) verifyMFACode(ctx context.Context, mfa domain.MFA, code string) error {
+	if err := s.verifyTOTP(ctx, mfa, code); err == nil {
+		return nil
+	}
+	used, err := s.repo.UseRecoveryCode(ctx, mfa.UserID, hashToken(normalizeRecoveryCode(code)), time.Now())
+	if err != nil {
+		return err
+	}
+	if !used {
+		s.logger.With(ctx, "user", mfa.UserID).Infof("two-factor authentication failed")
+		return httperror.Unauthorized("Invalid two-factor authentication code")
+	}
+	s.logger.With(ctx, "user", mfa.UserID).Infof("recovery code used")
+	return nil
+}
+
+// verifyTOTP checks a TOTP code and records its time step so that it cannot be replayed.
+func (s service) verifyTOTP(ctx context.Context, mfa domain.MFA, code string) error {
+	invalid := httperror.Unauthorized("Invalid two-factor authentication code")
+	step, ok := totp.Validate(mfa.Secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return invalid
+	}
+	used, err := s.repo.UseMFAStep(ctx, mfa.UserID, step)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return invalid
+	}
+	return nil
+}
+
+// generateRecoveryCode returns a random recovery code formatted as two groups of five characters.
+func generateRecoveryCode() (string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(secret[:10])
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode removes the formatting of a recovery code entered by a user.
+func normalizeRecoveryCode(code string) string {
+	code = strings.Replace(strings.Replace(code, "-", "", -1), " ", "", -1)
+	return strings.ToLower(code)
+}
@@ -1,41 +1,194 @@
 package auth
 
 import (
+	"strings"
+
 	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo"
-	"github.com/labstack/echo/middleware"
+	"github.com/redhajuanda/gorengan/internal/domain"
 	"github.com/redhajuanda/gorengan/internal/httperror"
 )
 
-// var IsLoggedIn = middleware.JWTWithConfig(middleware.JWTConfig{
-// 	SigningKey: []byte("test"),
-// })
+const (
+	// bearerScheme is the scheme of the Authorization header carrying an access token.
+	bearerScheme = "Bearer "
+	// apiKeyScheme is the scheme of the Authorization header carrying an API key.
+	apiKeyScheme = "ApiKey "
+	// apiKeyHeader is the header carrying an API key as an alternative to the Authorization header.
+	apiKeyHeader = "X-API-Key"
+)
 
 // IsLoggedIn is a JWT middleware
-// JWTWithConfig provides a JSON Web Token (JWT) authentication middleware.
-// - For valid token, it sets the user in context and calls next handler.
-// - For invalid token, it sends “401 - Unauthorized” response.
+// - For valid token, it sets the principal in context and calls next handler.
+// - For invalid, expired or revoked token, it sends “401 - Unauthorized” response.
 // - For missing or invalid Authorization header, it sends “400 - Bad Request”.
-func IsLoggedIn(signingKey string) echo.MiddlewareFunc {
-	return middleware.JWTWithConfig(middleware.JWTConfig{
-		SigningKey: []byte(signingKey),
-	})
+func IsLoggedIn(verifier TokenVerifier) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			if !strings.HasPrefix(auth, bearerScheme) || len(auth) == len(bearerScheme) {
+				return httperror.BadRequest("missing or malformed jwt")
+			}
+
+			token, err := verifier.Verify(c.Request().Context(), auth[len(bearerScheme):])
+			if err != nil {
+				return httperror.Unauthorized("invalid or expired jwt")
+			}
+			claims, ok := token.Claims.(jwt.MapClaims)
+			if !ok {
+				return httperror.Unauthorized("invalid or expired jwt")
+			}
+			setPrincipal(c, principalFromClaims(claims))
+			return next(c)
+		}
+	}
+}
+
+// IsAuthenticated accepts either an API key, sent as "Authorization: ApiKey <key>" or in the X-API-Key header,
+// or a JWT as IsLoggedIn does.
+// - For valid API key, it sets the principal of the key owner in context, the same way IsLoggedIn does, and calls next handler.
+// - For invalid or expired API key, it sends “401 - Unauthorized” response.
+// - Any other error, such as failing to look the key up, is returned as is.
+func IsAuthenticated(verifier TokenVerifier, apiKeys APIKeyVerifier) echo.MiddlewareFunc {
+	isLoggedIn := IsLoggedIn(verifier)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withJWT := isLoggedIn(next)
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(apiKeyHeader)
+			if auth := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, apiKeyScheme) {
+				key = auth[len(apiKeyScheme):]
+			}
+			if key == "" {
+				return withJWT(c)
+			}
+
+			principal, err := apiKeys.VerifyAPIKey(c.Request().Context(), key)
+			if err != nil {
+				return err
+			}
+			setPrincipal(c, principal)
+			return next(c)
+		}
+	}
+}
+
+// RequireRole checks whether the logged in user is assigned at least one of the given roles.
+// It must be placed after IsLoggedIn.
+func RequireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, ok := PrincipalFromContext(c)
+			if !ok {
+				return httperror.Unauthorized("")
+			}
+			for _, role := range principal.Roles {
+				if contains(roles, role) {
+					return next(c)
+				}
+			}
+			return httperror.Forbidden("")
+		}
+	}
+}
+
+// RequirePermission checks whether the roles of the logged in user are granted all of the given permissions.
+// Users with the admin role are granted every permission. Tokens and API keys carrying a scope claim
+// are further restricted to the permissions listed in it, while tokens issued to OAuth clients are
+// granted exactly those permissions. It must be placed after IsLoggedIn.
+func RequirePermission(checker PermissionChecker, permissions ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, ok := PrincipalFromContext(c)
+			if !ok {
+				return httperror.Unauthorized("")
+			}
+			if principal.Scopes != nil {
+				if !hasScopes(principal, permissions) {
+					return httperror.Forbidden("")
+				}
+				// OAuth clients act on their own behalf and are granted their scopes
+				if principal.IsClient() {
+					return next(c)
+				}
+			}
+			if contains(principal.Roles, domain.RoleAdmin) {
+				return next(c)
+			}
+
+			granted, err := checker.GetPermissions(c.Request().Context(), principal.Roles)
+			if err != nil {
+				return err
+			}
+			for _, permission := range permissions {
+				if !contains(granted, permission) {
+					return httperror.Forbidden("")
+				}
+			}
+			return next(c)
+		}
+	}
 }
 
-// IsAdmin checks wether user is an admin or not
-func IsAdmin(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		user := c.Get("user").(*jwt.Token)
-		claims := user.Claims.(jwt.MapClaims)
+// RequireScopes checks whether the scope claim of the token, or the scopes of the API key, lists all of the given scopes.
+// Unlike RequirePermission it does not look up the permissions of the roles, it only makes sure that tokens
+// minted for narrow purposes, such as reporting or impersonation, cannot reach the endpoint.
+// Principals without any scope, such as unrestricted API keys, are let through.
+// It must be placed after IsLoggedIn.
+func RequireScopes(scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, ok := PrincipalFromContext(c)
+			if !ok {
+				return httperror.Unauthorized("")
+			}
+			if principal.Scopes != nil && !hasScopes(principal, scopes) {
+				return httperror.Forbidden("")
+			}
+			return next(c)
+		}
+	}
+}
 
-		var role string
-		if val, ok := claims["role"].(string); ok {
-			role = val
+// RejectImpersonation refuses requests sent with an impersonation token with a “403 - Forbidden” response.
+// It guards the endpoints managing the credentials of a user, which must only be used by the user.
+// It must be placed after IsLoggedIn.
+func RejectImpersonation() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal, ok := PrincipalFromContext(c)
+			if !ok {
+				return httperror.Unauthorized("")
+			}
+			if principal.IsImpersonated() {
+				return httperror.Forbidden("This action is not allowed while impersonating a user")
+			}
+			return next(c)
 		}
+	}
+}
+
+// currentUserID returns the ID of the logged in user, or an empty string if the request is not authenticated.
+func currentUserID(c echo.Context) string {
+	principal, _ := PrincipalFromContext(c)
+	return principal.ID
+}
+
+// hasScopes checks whether the principal carries all of the given scopes.
+func hasScopes(principal Principal, scopes []string) bool {
+	for _, scope := range scopes {
+		if !contains(principal.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
 
-		if role != "admin" {
-			return httperror.Unauthorized("")
+// contains checks whether the slice contains the given value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
-		return next(c)
 	}
+	return false
 }
@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/pkg/validation"
+)
+
+// OAuthError represents an error response of the OAuth2 endpoints as defined by RFC 6749 section 5.2.
+type OAuthError struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Error is required by the error interface.
+func (e OAuthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+// StatusCode returns the HTTP status of the error response.
+func (e OAuthError) StatusCode() int {
+	return e.Status
+}
+
+// oauthError creates a new OAuth2 error response.
+func oauthError(status int, code, description string) OAuthError {
+	return OAuthError{Status: status, Code: code, Description: description}
+}
+
+// ClientCredentials holds the credentials a client authenticates with, sent either
+// with HTTP Basic authentication or as client_id and client_secret form parameters.
+type ClientCredentials struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// OAuthTokenRequest holds request data for the token endpoint
+type OAuthTokenRequest struct {
+	ClientCredentials
+	GrantType    string
+	Scope        string
+	RefreshToken string
+}
+
+// OAuthToken represents a successful response of the token endpoint as defined by RFC 6749 section 5.1.
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// TokenRequest holds request data for the introspection and revocation endpoints
+type TokenRequest struct {
+	ClientCredentials
+	Token         string
+	TokenTypeHint string
+}
+
+// Introspection represents a response of the introspection endpoint as defined by RFC 7662 section 2.2.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Jti       string `json:"jti,omitempty"`
+}
+
+// CreateOAuthClientRequest holds request data for registering an OAuth client
+type CreateOAuthClientRequest struct {
+	Name       string   `json:"name" validate:"required,max=100"`
+	Scopes     []string `json:"scopes"`
+	GrantTypes []string `json:"grant_types" validate:"required,min=1,dive,oneof=client_credentials refresh_token"`
+}
+
+// NewOAuthClient holds a newly registered OAuth client. The secret cannot be retrieved later on.
+type NewOAuthClient struct {
+	domain.OAuthClient
+	ClientSecret string `json:"client_secret"`
+}
+
+// CreateOAuthClient registers a new OAuth client and generates its secret.
+func (s service) CreateOAuthClient(ctx context.Context, req CreateOAuthClientRequest) (NewOAuthClient, error) {
+	if err := s.validation.Validate(req); err != nil {
+		return NewOAuthClient{}, err
+	}
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !IsRegistered(scope) {
+			return NewOAuthClient{}, validation.NewValidationError(fmt.Sprintf("permission %v is not registered", scope))
+		}
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	grantTypes := []string{}
+	for _, grantType := range req.GrantTypes {
+		if !contains(grantTypes, grantType) {
+			grantTypes = append(grantTypes, grantType)
+		}
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return NewOAuthClient{}, err
+	}
+	client := domain.OAuthClient{
+		ID:         domain.GenerateID(),
+		Name:       req.Name,
+		SecretHash: hashToken(secret),
+		Scopes:     scopes,
+		GrantTypes: grantTypes,
+		CreatedAt:  time.Now(),
+	}
+	if err := s.repo.CreateOAuthClient(ctx, client); err != nil {
+		return NewOAuthClient{}, err
+	}
+	s.logger.With(ctx, "client", client.ID).Infof("oauth client registered")
+	return NewOAuthClient{client, secret}, nil
+}
+
+// QueryOAuthClients returns all registered OAuth clients.
+func (s service) QueryOAuthClients(ctx context.Context) ([]domain.OAuthClient, error) {
+	return s.repo.QueryOAuthClients(ctx)
+}
+
+// DeleteOAuthClient deletes the OAuth client with the specified ID.
+// Access tokens already issued to the client remain valid until they expire.
+func (s service) DeleteOAuthClient(ctx context.Context, id string) error {
+	if _, err := s.repo.GetOAuthClient(ctx, id); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteOAuthClient(ctx, id); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "client", id).Infof("oauth client deleted")
+	return nil
+}
+
+// OAuthToken issues tokens for the client_credentials and refresh_token grants.
+// Errors are returned as OAuthError.
+func (s service) OAuthToken(ctx context.Context, req OAuthTokenRequest) (OAuthToken, error) {
+	client, err := s.authenticateClient(ctx, req.ClientCredentials)
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	if req.GrantType != domain.GrantTypeClientCredentials && req.GrantType != domain.GrantTypeRefreshToken {
+		return OAuthToken{}, oauthError(http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+	if !client.AllowsGrant(req.GrantType) {
+		return OAuthToken{}, oauthError(http.StatusBadRequest, "unauthorized_client", "")
+	}
+
+	if req.GrantType == domain.GrantTypeRefreshToken {
+		if req.RefreshToken == "" {
+			return OAuthToken{}, oauthError(http.StatusBadRequest, "invalid_request", "refresh_token is required")
+		}
+		token, err := s.refresh(ctx, req.RefreshToken, client.ID)
+		if err == errInvalidRefreshToken {
+			return OAuthToken{}, oauthError(http.StatusBadRequest, "invalid_grant", "")
+		}
+		if err != nil {
+			return OAuthToken{}, err
+		}
+		return OAuthToken{
+			AccessToken:  token.AccessToken,
+			TokenType:    "Bearer",
+			ExpiresIn:    token.ExpiresIn,
+			RefreshToken: token.RefreshToken,
+		}, nil
+	}
+
+	scopes := client.Scopes
+	if req.Scope != "" {
+		scopes = strings.Fields(req.Scope)
+		for _, scope := range scopes {
+			if !contains(client.Scopes, scope) {
+				return OAuthToken{}, oauthError(http.StatusBadRequest, "invalid_scope", fmt.Sprintf("scope %v is not allowed", scope))
+			}
+		}
+	}
+	scope := strings.Join(scopes, " ")
+	accessToken, err := s.generateJWTWithClaims(client, jwt.MapClaims{
+		"client_id": client.ID,
+		"scope":     scope,
+	})
+	if err != nil {
+		return OAuthToken{}, err
+	}
+	s.logger.With(ctx, "client", client.ID).Infof("client credentials granted")
+	return OAuthToken{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(s.cfg.AccessTokenLifetime().Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// Introspect returns the state of an access token or a refresh token as defined by RFC 7662.
+// Only registered clients may introspect tokens, and tokens issued to other clients are reported as inactive.
+func (s service) Introspect(ctx context.Context, req TokenRequest) (Introspection, error) {
+	client, err := s.authenticateClient(ctx, req.ClientCredentials)
+	if err != nil {
+		return Introspection{}, err
+	}
+	if req.Token == "" {
+		return Introspection{}, oauthError(http.StatusBadRequest, "invalid_request", "token is required")
+	}
+
+	if req.TokenTypeHint != "refresh_token" {
+		if token, err := NewVerifier(s.keys, s.revocations).Verify(ctx, req.Token); err == nil {
+			claims := token.Claims.(jwt.MapClaims)
+			if clientID, _ := claims["client_id"].(string); clientID != client.ID {
+				return Introspection{Active: false}, nil
+			}
+			introspection := Introspection{Active: true, TokenType: "Bearer"}
+			introspection.Sub, _ = claims["id"].(string)
+			introspection.Username, _ = claims["username"].(string)
+			introspection.ClientID, _ = claims["client_id"].(string)
+			introspection.Scope, _ = claims["scope"].(string)
+			introspection.Jti, _ = claims["jti"].(string)
+			exp, _ := claims["exp"].(float64)
+			iat, _ := claims["iat"].(float64)
+			introspection.Exp, introspection.Iat = int64(exp), int64(iat)
+			return introspection, nil
+		}
+	}
+
+	token, err := s.repo.GetRefreshToken(ctx, hashToken(req.Token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Introspection{Active: false}, nil
+	}
+	if err != nil {
+		return Introspection{}, err
+	}
+	if token.ClientID != client.ID || token.UsedAt != nil || token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+		return Introspection{Active: false}, nil
+	}
+	return Introspection{
+		Active:    true,
+		TokenType: "refresh_token",
+		Sub:       token.UserID,
+		ClientID:  token.ClientID,
+		Exp:       token.ExpiresAt.Unix(),
+		Iat:       token.CreatedAt.Unix(),
+	}, nil
+}
+
+// RevokeToken revokes an access token or the family of a refresh token as defined by RFC 7009.
+// Invalid tokens and tokens issued to other clients are ignored.
+func (s service) RevokeToken(ctx context.Context, req TokenRequest) error {
+	client, err := s.authenticateClient(ctx, req.ClientCredentials)
+	if err != nil {
+		return err
+	}
+	if req.Token == "" {
+		return oauthError(http.StatusBadRequest, "invalid_request", "token is required")
+	}
+	logger := s.logger.With(ctx, "client", client.ID)
+
+	if req.TokenTypeHint != "refresh_token" {
+		if token, err := jwt.Parse(req.Token, s.keys.Keyfunc); err == nil {
+			claims := token.Claims.(jwt.MapClaims)
+			tokenID, _ := claims["jti"].(string)
+			clientID, _ := claims["client_id"].(string)
+			exp, _ := claims["exp"].(float64)
+			if tokenID == "" || clientID != client.ID {
+				return nil
+			}
+			logger.Infof("access token %v revoked", tokenID)
+			return s.revocations.Revoke(ctx, tokenID, time.Unix(int64(exp), 0))
+		}
+	}
+
+	if !client.AllowsGrant(domain.GrantTypeRefreshToken) {
+		return nil
+	}
+	token, err := s.repo.GetRefreshToken(ctx, hashToken(req.Token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if token.ClientID != client.ID {
+		return nil
+	}
+	logger.Infof("refresh token family %v revoked", token.FamilyID)
+	return s.repo.RevokeRefreshTokenFamily(ctx, token.FamilyID, time.Now())
+}
+
+// authenticateClient checks the credentials of an OAuth client.
+func (s service) authenticateClient(ctx context.Context, credentials ClientCredentials) (domain.OAuthClient, error) {
+	invalid := oauthError(http.StatusUnauthorized, "invalid_client", "")
+	if credentials.ClientID == "" || credentials.ClientSecret == "" {
+		return domain.OAuthClient{}, invalid
+	}
+	client, err := s.repo.GetOAuthClient(ctx, credentials.ClientID)
+	if err != nil {
+		s.logger.With(ctx, "client", credentials.ClientID).Infof("client authentication failed")
+		return domain.OAuthClient{}, invalid
+	}
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(credentials.ClientSecret))) != 1 {
+		s.logger.With(ctx, "client", credentials.ClientID).Infof("client authentication failed")
+		return domain.OAuthClient{}, invalid
+	}
+	return client, nil
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhajuanda/gorengan/config"
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+	"github.com/redhajuanda/gorengan/pkg/oidc"
+	"github.com/redhajuanda/gorengan/pkg/password"
+)
+
+const (
+	// purposeOIDCSession is the purpose of tokens holding the state of a pending OpenID Connect login.
+	purposeOIDCSession = "oidc_session"
+	// oidcSessionExpiration is the time users have to sign in at the provider.
+	oidcSessionExpiration = 10 * time.Minute
+)
+
+// OIDCAuthorization holds the data needed to send a user to the OpenID Connect provider.
+type OIDCAuthorization struct {
+	// URL is the authorization URL the user has to be redirected to
+	URL string
+	// Session holds the state of the login. It must be kept by the user agent, typically in a cookie,
+	// and handed back on callback.
+	Session string
+}
+
+// OIDCCallbackRequest holds request data for completing an OpenID Connect login
+type OIDCCallbackRequest struct {
+	Code    string `validate:"required"`
+	State   string `validate:"required"`
+	Session string `validate:"required"`
+	// Error is the error code returned by the provider instead of a code, if any
+	Error string
+	ClientInfo
+}
+
+// newOIDCProvider creates the OpenID Connect provider configured for single sign-on, if any.
+func newOIDCProvider(cfg config.Config) *oidc.Provider {
+	if cfg.OIDC.Issuer == "" {
+		return nil
+	}
+	redirectURL := cfg.OIDC.RedirectURL
+	if redirectURL == "" {
+		redirectURL = strings.TrimSuffix(cfg.Server.BaseURL, "/") + "/login/oidc/callback"
+	}
+	return oidc.New(oidc.Config{
+		Issuer:       cfg.OIDC.Issuer,
+		ClientID:     cfg.OIDC.ClientID,
+		ClientSecret: cfg.OIDC.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       strings.Fields(cfg.OIDC.Scopes),
+	}, nil)
+}
+
+// StartOIDCLogin starts an authorization code flow with PKCE at the OpenID Connect provider.
+func (s service) StartOIDCLogin(ctx context.Context) (OIDCAuthorization, error) {
+	if s.provider == nil {
+		return OIDCAuthorization{}, httperror.NotFound("Single sign-on is not configured")
+	}
+	state, err := generateToken()
+	if err != nil {
+		return OIDCAuthorization{}, err
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		return OIDCAuthorization{}, err
+	}
+	verifier, err := oidc.GenerateVerifier()
+	if err != nil {
+		return OIDCAuthorization{}, err
+	}
+	url, err := s.provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return OIDCAuthorization{}, err
+	}
+
+	now := time.Now()
+	session, err := s.keys.Sign(jwt.MapClaims{
+		"jti":      domain.GenerateID(),
+		"purpose":  purposeOIDCSession,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"iat":      now.Unix(),
+		"exp":      now.Add(oidcSessionExpiration).Unix(),
+	})
+	if err != nil {
+		return OIDCAuthorization{}, err
+	}
+	return OIDCAuthorization{URL: url, Session: session}, nil
+}
+
+// OIDCCallback exchanges the authorization code returned by the OpenID Connect provider, validates the ID token
+// and logs in the user linked to the external identity. Users are linked by verified email address on their first login,
+// or created if signup is allowed.
+func (s service) OIDCCallback(ctx context.Context, req OIDCCallbackRequest) (Token, error) {
+	if s.provider == nil {
+		return Token{}, httperror.NotFound("Single sign-on is not configured")
+	}
+	if req.Error != "" {
+		s.logger.With(ctx).Infof("single sign-on failed at the provider: %v", req.Error)
+		return Token{}, httperror.Unauthorized("Single sign-on failed")
+	}
+	if err := s.validation.Validate(req); err != nil {
+		return Token{}, err
+	}
+
+	invalid := httperror.Unauthorized("Invalid or expired single sign-on session")
+	session, err := jwt.Parse(req.Session, s.keys.Keyfunc)
+	if err != nil {
+		return Token{}, invalid
+	}
+	claims := session.Claims.(jwt.MapClaims)
+	purpose, _ := claims["purpose"].(string)
+	state, _ := claims["state"].(string)
+	nonce, _ := claims["nonce"].(string)
+	verifier, _ := claims["verifier"].(string)
+	if purpose != purposeOIDCSession || subtle.ConstantTimeCompare([]byte(state), []byte(req.State)) != 1 {
+		return Token{}, invalid
+	}
+
+	token, err := s.provider.Exchange(ctx, req.Code, verifier)
+	if err != nil {
+		s.logger.With(ctx).Infof("single sign-on failed: %v", err)
+		return Token{}, httperror.Unauthorized("Single sign-on failed")
+	}
+	idClaims, err := s.provider.VerifyIDToken(ctx, token.IDToken, nonce)
+	if err != nil {
+		s.logger.With(ctx).Infof("single sign-on failed: %v", err)
+		return Token{}, httperror.Unauthorized("Single sign-on failed")
+	}
+
+	user, err := s.linkExternalIdentity(ctx, idClaims)
+	if err != nil {
+		return Token{}, err
+	}
+	s.logger.With(ctx, "user", user.ID).Infof("single sign-on successful")
+	return s.completeLogin(ctx, user, req.ClientInfo, nil)
+}
+
+// linkExternalIdentity returns the user linked to the external identity,
+// linking or creating one on the first login.
+func (s service) linkExternalIdentity(ctx context.Context, claims oidc.Claims) (domain.User, error) {
+	issuer := s.cfg.OIDC.Issuer
+	identity, err := s.repo.GetExternalIdentity(ctx, issuer, claims.Subject)
+	if err == nil {
+		return s.repo.GetUser(ctx, identity.UserID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return domain.User{}, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return domain.User{}, httperror.Forbidden("The identity provider did not share a verified email address")
+	}
+	now := time.Now()
+	identity = domain.ExternalIdentity{
+		ID:        domain.GenerateID(),
+		Issuer:    issuer,
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		CreatedAt: now,
+	}
+	logger := s.logger.With(ctx, "issuer", issuer, "subject", claims.Subject)
+
+	user, err := s.repo.Login(ctx, claims.Email)
+	if err == nil {
+		identity.UserID = user.ID
+		if err := s.repo.CreateExternalIdentity(ctx, identity); err != nil {
+			return domain.User{}, err
+		}
+		logger.Infof("external identity linked to user %v", user.ID)
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return domain.User{}, err
+	}
+	if !s.cfg.OIDC.AllowSignup {
+		return domain.User{}, httperror.Forbidden("No account is linked to this identity")
+	}
+
+	// the account gets an unknown password, which can be set through the password reset flow
+	secret, err := generateToken()
+	if err != nil {
+		return domain.User{}, err
+	}
+	hashedPwd, err := password.HashAndSalt([]byte(secret))
+	if err != nil {
+		return domain.User{}, err
+	}
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" && lastName == "" {
+		names := strings.SplitN(claims.Name, " ", 2)
+		firstName = names[0]
+		if len(names) > 1 {
+			lastName = names[1]
+		}
+	}
+	user = domain.User{
+		ID:              domain.GenerateID(),
+		FirstName:       truncate(firstName, 32),
+		LastName:        truncate(lastName, 32),
+		Email:           claims.Email,
+		Password:        hashedPwd,
+		EmailVerifiedAt: &now,
+		Roles:           []string{domain.RoleUser},
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err := s.repo.CreateExternalUser(ctx, user, identity); err != nil {
+		return domain.User{}, err
+	}
+	logger.Infof("user %v created from external identity", user.ID)
+	return user, nil
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+	"github.com/redhajuanda/gorengan/pkg/mailer"
+	"github.com/redhajuanda/gorengan/pkg/password"
+)
+
+// ForgotPasswordRequest holds request data for requesting a password reset
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// ResetPasswordRequest holds request data for resetting a password
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,password"`
+}
+
+// ForgotPassword sends a password reset link to the user with the requested email.
+// No error is returned when no user has the email, so that callers cannot find out which emails are registered.
+func (s service) ForgotPassword(ctx context.Context, req ForgotPasswordRequest) error {
+	if err := s.validation.Validate(req); err != nil {
+		return err
+	}
+	logger := s.logger.With(ctx, "user", req.Email)
+
+	user, err := s.repo.Login(ctx, req.Email)
+	if err != nil {
+		logger.Infof("password reset requested for unknown user")
+		return nil
+	}
+
+	token, err := s.createUserToken(ctx, user.ID, domain.TokenPurposePasswordReset, time.Duration(s.cfg.Auth.PasswordResetExpiration)*time.Minute)
+	if err != nil {
+		return err
+	}
+	link, err := url.Parse(s.cfg.Auth.PasswordResetURL)
+	if err != nil {
+		return fmt.Errorf("invalid password reset URL: %v", err)
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %v,\n\nUse the following link to reset your password. It expires in %v minutes.\n\n%v\n\nIf you did not request a password reset, you can ignore this email.",
+			user.FirstName, s.cfg.Auth.PasswordResetExpiration, link),
+	})
+	if err != nil {
+		return err
+	}
+	logger.Infof("password reset requested")
+	return nil
+}
+
+// ResetPassword changes the password of the user owning the reset token.
+// The token can only be used once, and every session of the user is revoked afterwards.
+// The token is not used up if the new password is refused by the password policy.
+func (s service) ResetPassword(ctx context.Context, req ResetPasswordRequest) error {
+	if err := s.validation.Validate(req); err != nil {
+		return err
+	}
+
+	pending, err := s.repo.GetUserToken(ctx, domain.TokenPurposePasswordReset, hashToken(req.Token))
+	if err != nil {
+		return httperror.BadRequest("Invalid or expired token")
+	}
+	user, err := s.repo.GetUser(ctx, pending.UserID)
+	if err != nil {
+		return httperror.BadRequest("Invalid or expired token")
+	}
+	if err := s.CheckNewPassword(ctx, user, req.Password); err != nil {
+		return err
+	}
+
+	token, err := s.useUserToken(ctx, domain.TokenPurposePasswordReset, req.Token)
+	if err != nil {
+		return err
+	}
+	hashedPwd, err := password.HashAndSalt([]byte(req.Password))
+	if err != nil {
+		return err
+	}
+	if err := s.repo.UpdatePassword(ctx, token.UserID, hashedPwd); err != nil {
+		return err
+	}
+	if err := s.AddPasswordHistory(ctx, user.ID, user.Password); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", token.UserID).Infof("password reset")
+	return s.RevokeSessions(ctx, token.UserID)
+}
+
+// CheckNewPassword checks the new password of a user against the password policy and the password history.
+func (s service) CheckNewPassword(ctx context.Context, user domain.User, pwd string) error {
+	policy := password.CurrentPolicy()
+	var previous []string
+	if policy.History > 1 {
+		var err error
+		if previous, err = s.repo.QueryPasswordHistory(ctx, user.ID, policy.History-1); err != nil {
+			return err
+		}
+	}
+	return policy.CheckChange(pwd, user.Password, previous, user.Email, user.FirstName, user.LastName)
+}
+
+// AddPasswordHistory records the hash of a previous password of the user with the specified ID.
+func (s service) AddPasswordHistory(ctx context.Context, userID, hash string) error {
+	return s.repo.AddPasswordHistory(ctx, userID, hash, time.Now())
+}
+
+// createUserToken creates a single-use token for the given purpose and returns its plain value.
+func (s service) createUserToken(ctx context.Context, userID, purpose string, lifetime time.Duration) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = s.repo.CreateUserToken(ctx, domain.UserToken{
+		ID:        domain.GenerateID(),
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(lifetime),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// useUserToken consumes the single-use token for the given purpose.
+// An error is returned if the token does not exist, has expired or has already been used.
+func (s service) useUserToken(ctx context.Context, purpose, plainToken string) (domain.UserToken, error) {
+	invalid := httperror.BadRequest("Invalid or expired token")
+	token, err := s.repo.GetUserToken(ctx, purpose, hashToken(plainToken))
+	if err != nil {
+		return domain.UserToken{}, invalid
+	}
+	if token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+		return domain.UserToken{}, invalid
+	}
+	used, err := s.repo.UseUserToken(ctx, token.ID, time.Now())
+	if err != nil {
+		return domain.UserToken{}, err
+	}
+	if !used {
+		return domain.UserToken{}, invalid
+	}
+	return token, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+const (
+	// PermissionRolesRead allows listing roles and the permissions mapped to them.
+	PermissionRolesRead = "roles:read"
+	// PermissionRolesWrite allows changing the permissions mapped to roles.
+	PermissionRolesWrite = "roles:write"
+	// PermissionSessionsRevoke allows revoking every token issued to a user.
+	PermissionSessionsRevoke = "sessions:revoke"
+	// PermissionAccountsUnlock allows lifting the lockout caused by failed login attempts.
+	PermissionAccountsUnlock = "accounts:unlock"
+	// PermissionClientsRead allows listing registered OAuth clients.
+	PermissionClientsRead = "clients:read"
+	// PermissionClientsWrite allows registering and deleting OAuth clients.
+	PermissionClientsWrite = "clients:write"
+	// PermissionUsersImpersonate allows administrators to impersonate users.
+	PermissionUsersImpersonate = "users:impersonate"
+	// PermissionCredentialsWrite allows users to change their own profile, password, two-factor authentication
+	// and API keys. It is granted to every user, so that only tokens and API keys restricted to other scopes lack it.
+	PermissionCredentialsWrite = "credentials:write"
+)
+
+// Permission represents a fine-grained action that can be granted to roles.
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// PermissionChecker resolves the permissions granted to a set of roles.
+type PermissionChecker interface {
+	// GetPermissions returns the names of the permissions mapped to any of the given roles.
+	GetPermissions(ctx context.Context, roles []string) ([]string, error)
+}
+
+// registry holds every permission registered by the application modules.
+var registry = struct {
+	sync.RWMutex
+	permissions map[string]Permission
+}{permissions: map[string]Permission{}}
+
+// RegisterPermissions registers the permissions exposed by a module.
+// Modules should call it from their RegisterService so the permissions can be mapped to roles.
+func RegisterPermissions(permissions ...Permission) {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, permission := range permissions {
+		registry.permissions[permission.Name] = permission
+	}
+}
+
+// Permissions returns all registered permissions sorted by name.
+func Permissions() []Permission {
+	registry.RLock()
+	defer registry.RUnlock()
+	result := make([]Permission, 0, len(registry.permissions))
+	for _, permission := range registry.permissions {
+		result = append(result, permission)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// IsRegistered checks whether a permission with the given name has been registered.
+func IsRegistered(name string) bool {
+	registry.RLock()
+	defer registry.RUnlock()
+	_, ok := registry.permissions[name]
+	return ok
+}
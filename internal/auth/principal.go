@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+// principalKey is the key under which the principal of a request is stored in the echo context.
+const principalKey = "principal"
+
+// principalContextKey is the type of the key under which the principal is stored in a context.Context.
+type principalContextKey struct{}
+
+// Principal represents the authenticated caller of a request, decoded from an access token or an API key.
+type Principal struct {
+	ID       string
+	Username string
+	Roles    []string
+	// Scopes restricts the principal to the listed permissions, nil grants every permission of its roles
+	Scopes []string
+	// ClientID is the ID of the OAuth client the token has been issued to, if any
+	ClientID string
+	// APIKeyID is the ID of the API key used to authenticate, if any
+	APIKeyID string
+	// Actor is the administrator impersonating the principal, if any
+	Actor *Actor
+	// TokenID, SessionID and ExpiresAt are those of the access token, they are empty for API keys
+	TokenID   string
+	SessionID string
+	ExpiresAt time.Time
+}
+
+// Actor represents the administrator behind an impersonation token.
+type Actor struct {
+	ID       string
+	Username string
+}
+
+// GetID returns the ID of the effective user.
+func (p Principal) GetID() string {
+	return p.ID
+}
+
+// GetUsername returns the name of the effective user.
+func (p Principal) GetUsername() string {
+	return p.Username
+}
+
+// GetRoles returns the names of the roles assigned to the effective user.
+func (p Principal) GetRoles() []string {
+	return p.Roles
+}
+
+// RealID returns the ID of the user who actually sent the request,
+// which is the administrator if the principal is impersonated.
+func (p Principal) RealID() string {
+	if p.Actor != nil {
+		return p.Actor.ID
+	}
+	return p.ID
+}
+
+// IsImpersonated checks whether the principal is impersonated by an administrator.
+func (p Principal) IsImpersonated() bool {
+	return p.Actor != nil
+}
+
+// IsClient checks whether the principal is an OAuth client acting on its own behalf.
+func (p Principal) IsClient() bool {
+	return p.ClientID != "" && p.ClientID == p.ID
+}
+
+// WithPrincipal returns a copy of the context holding the principal.
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// CurrentPrincipal returns the principal stored in the context by the auth middlewares.
+// It returns false if the request is not authenticated.
+func CurrentPrincipal(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(Principal)
+	return principal, ok
+}
+
+// CurrentIdentity returns the identity of the effective user of the request, or nil if the request is not authenticated.
+func CurrentIdentity(ctx context.Context) Identity {
+	principal, ok := CurrentPrincipal(ctx)
+	if !ok {
+		return nil
+	}
+	return principal
+}
+
+// PrincipalFromContext returns the principal stored in the echo context by the auth middlewares.
+// It returns false if the request is not authenticated.
+func PrincipalFromContext(c echo.Context) (Principal, bool) {
+	principal, ok := c.Get(principalKey).(Principal)
+	return principal, ok
+}
+
+// setPrincipal stores the principal in the echo context and in the context of the request.
+func setPrincipal(c echo.Context, principal Principal) {
+	c.Set(principalKey, principal)
+	c.SetRequest(c.Request().WithContext(WithPrincipal(c.Request().Context(), principal)))
+}
+
+// scopesFromClaims returns the permissions listed in the scope claim, or an empty list if there is none.
+func scopesFromClaims(claims jwt.MapClaims) []string {
+	scope, _ := claims["scope"].(string)
+	return append([]string{}, strings.Fields(scope)...)
+}
+
+// principalFromClaims decodes the principal from the claims of an access token.
+func principalFromClaims(claims jwt.MapClaims) Principal {
+	principal := Principal{Roles: []string{}}
+	principal.ID, _ = claims["id"].(string)
+	principal.Username, _ = claims["username"].(string)
+	principal.ClientID, _ = claims["client_id"].(string)
+	principal.TokenID, _ = claims["jti"].(string)
+	principal.SessionID, _ = claims["sid"].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		principal.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	values, _ := claims["roles"].([]interface{})
+	for _, value := range values {
+		if role, ok := value.(string); ok {
+			principal.Roles = append(principal.Roles, role)
+		}
+	}
+	if _, ok := claims["scope"].(string); ok {
+		principal.Scopes = scopesFromClaims(claims)
+	}
+	if act, ok := claims["act"].(map[string]interface{}); ok {
+		actor := Actor{}
+		actor.ID, _ = act["sub"].(string)
+		actor.Username, _ = act["username"].(string)
+		if actor.ID != "" {
+			principal.Actor = &actor
+		}
+	}
+	return principal
+}
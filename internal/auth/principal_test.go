@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrincipalFromClaims(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	principal := principalFromClaims(jwt.MapClaims{
+		"jti":      "token",
+		"sid":      "session",
+		"id":       "user",
+		"username": "jane@doe.com",
+		"roles":    []interface{}{"user"},
+		"scope":    "users:read",
+		"exp":      float64(exp),
+		"act":      map[string]interface{}{"sub": "admin", "username": "super@admin.com"},
+	})
+	assert.Equal(t, "user", principal.GetID())
+	assert.Equal(t, "jane@doe.com", principal.GetUsername())
+	assert.Equal(t, []string{"user"}, principal.GetRoles())
+	assert.Equal(t, []string{"users:read"}, principal.Scopes)
+	assert.Equal(t, "token", principal.TokenID)
+	assert.Equal(t, "session", principal.SessionID)
+	assert.Equal(t, exp, principal.ExpiresAt.Unix())
+	assert.True(t, principal.IsImpersonated())
+	assert.Equal(t, "admin", principal.RealID())
+	assert.False(t, principal.IsClient())
+
+	principal = principalFromClaims(jwt.MapClaims{"id": "client", "client_id": "client", "scope": ""})
+	assert.False(t, principal.IsImpersonated())
+	assert.Equal(t, "client", principal.RealID())
+	assert.True(t, principal.IsClient())
+	assert.NotNil(t, principal.Scopes)
+	assert.Empty(t, principal.Scopes)
+	assert.Empty(t, principal.Roles)
+}
+
+func TestCurrentIdentity(t *testing.T) {
+	assert.Nil(t, CurrentIdentity(context.Background()))
+	_, ok := CurrentPrincipal(context.Background())
+	assert.False(t, ok)
+
+	ctx := WithPrincipal(context.Background(), Principal{ID: "user"})
+	identity := CurrentIdentity(ctx)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "user", identity.GetID())
+	}
+
+	// the principal is stored in both the echo context and the context of the request
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+	setPrincipal(c, Principal{ID: "user"})
+	principal, ok := PrincipalFromContext(c)
+	assert.True(t, ok)
+	assert.Equal(t, "user", principal.ID)
+	principal, ok = CurrentPrincipal(c.Request().Context())
+	assert.True(t, ok)
+	assert.Equal(t, "user", principal.ID)
+}
+
+func TestMiddlewaresWithoutPrincipal(t *testing.T) {
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+	assert.Error(t, RequireRole("admin")(ok)(c))
+	assert.Error(t, RequirePermission(nil, "users:read")(ok)(c))
+	assert.Error(t, RejectImpersonation()(ok)(c))
+	assert.Error(t, RequireScopes("users:read")(ok)(c))
+}
+
+func TestRequireScopes(t *testing.T) {
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	check := func(principal Principal, scopes ...string) error {
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		setPrincipal(c, principal)
+		return RequireScopes(scopes...)(ok)(c)
+	}
+	reporting := Principal{ID: "user", Scopes: []string{"users:read", "reports:read"}}
+	assert.NoError(t, check(reporting, "users:read"))
+	assert.NoError(t, check(reporting, "users:read", "reports:read"))
+	assert.Error(t, check(reporting, "users:read", "users:write"))
+	assert.Error(t, check(Principal{ID: "user", Scopes: []string{}}, "users:read"))
+	// principals without any scope are not restricted
+	assert.NoError(t, check(Principal{ID: "user"}, "users:write"))
+}
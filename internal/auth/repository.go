@@ -3,14 +3,108 @@ package auth
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/redhajuanda/gorengan/internal/domain"
 )
 
 // Repository encapsulates the logic to access users from the data source.
 type Repository interface {
-	// Get returns the user with the specified user ID.
+	// Login returns the user with the specified email along with the names of its roles.
 	Login(ctx context.Context, email string) (domain.User, error)
+	// GetUser returns the user with the specified ID along with the names of its roles.
+	// Like Login, it ignores soft-deleted users.
+	GetUser(ctx context.Context, id string) (domain.User, error)
+	// GetPermissions returns the names of the permissions mapped to any of the given roles.
+	GetPermissions(ctx context.Context, roles []string) ([]string, error)
+	// GetRole returns the role with the specified ID along with its permissions.
+	GetRole(ctx context.Context, id string) (domain.Role, error)
+	// QueryRoles returns all roles along with their permissions.
+	QueryRoles(ctx context.Context) ([]domain.Role, error)
+	// SetRolePermissions replaces the permissions mapped to the role with given ID.
+	SetRolePermissions(ctx context.Context, id string, permissions []string) error
+	// CreateRefreshToken saves a new refresh token in the storage.
+	CreateRefreshToken(ctx context.Context, token domain.RefreshToken) error
+	// GetRefreshToken returns the refresh token with the specified hash.
+	GetRefreshToken(ctx context.Context, hash string) (domain.RefreshToken, error)
+	// UseRefreshToken marks the refresh token with given ID as used.
+	// It returns false if the token has already been used.
+	UseRefreshToken(ctx context.Context, id string, usedAt time.Time) (bool, error)
+	// RevokeRefreshTokenFamily revokes every refresh token of the given family.
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string, revokedAt time.Time) error
+	// RevokeUserRefreshTokens revokes every refresh token of the user with given ID.
+	RevokeUserRefreshTokens(ctx context.Context, userID string, revokedAt time.Time) error
+	// CreateUserToken saves a new user token in the storage.
+	CreateUserToken(ctx context.Context, token domain.UserToken) error
+	// GetUserToken returns the user token with the specified purpose and hash.
+	GetUserToken(ctx context.Context, purpose, hash string) (domain.UserToken, error)
+	// UseUserToken marks the user token with given ID as used.
+	// It returns false if the token has already been used.
+	UseUserToken(ctx context.Context, id string, usedAt time.Time) (bool, error)
+	// UpdatePassword updates the password hash of the user with given ID.
+	UpdatePassword(ctx context.Context, userID, hash string) error
+	// QueryPasswordHistory returns the hashes of the previous passwords of the user with given ID, most recent first.
+	QueryPasswordHistory(ctx context.Context, userID string, limit int) ([]string, error)
+	// AddPasswordHistory records the hash of a previous password of the user with given ID.
+	AddPasswordHistory(ctx context.Context, userID, hash string, createdAt time.Time) error
+	// VerifyEmail marks the email address of the user with given ID as verified.
+	VerifyEmail(ctx context.Context, userID string, verifiedAt time.Time) error
+	// GetMFA returns the two-factor authentication settings of the user with given ID.
+	GetMFA(ctx context.Context, userID string) (domain.MFA, error)
+	// SaveMFA creates or replaces the two-factor authentication settings of a user along with its recovery code hashes.
+	SaveMFA(ctx context.Context, mfa domain.MFA, recoveryCodeHashes []string) error
+	// EnableMFA marks the two-factor authentication settings of the user with given ID as confirmed.
+	EnableMFA(ctx context.Context, userID string, enabledAt time.Time) error
+	// DeleteMFA removes the two-factor authentication settings and recovery codes of the user with given ID.
+	DeleteMFA(ctx context.Context, userID string) error
+	// UseMFAStep records the TOTP time step used by the user with given ID.
+	// It returns false if the same or a later step has already been used.
+	UseMFAStep(ctx context.Context, userID string, step int64) (bool, error)
+	// UseRecoveryCode marks the recovery code with given hash of the user as used.
+	// It returns false if no such unused code exists.
+	UseRecoveryCode(ctx context.Context, userID, hash string, usedAt time.Time) (bool, error)
+	// CreateAPIKey saves a new API key in the storage.
+	CreateAPIKey(ctx context.Context, key domain.APIKey) error
+	// GetAPIKey returns the API key with the specified hash.
+	GetAPIKey(ctx context.Context, hash string) (domain.APIKey, error)
+	// QueryAPIKeys returns the API keys of the user with given ID, newest first.
+	QueryAPIKeys(ctx context.Context, userID string) ([]domain.APIKey, error)
+	// DeleteAPIKey deletes the API key with given ID of the user.
+	// It returns false if the user has no such key.
+	DeleteAPIKey(ctx context.Context, userID, id string) (bool, error)
+	// TouchAPIKey records when the API key with given ID was last used.
+	TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error
+	// GetExternalIdentity returns the external identity with the specified issuer and subject.
+	GetExternalIdentity(ctx context.Context, issuer, subject string) (domain.ExternalIdentity, error)
+	// CreateExternalIdentity links an existing user to an external identity.
+	CreateExternalIdentity(ctx context.Context, identity domain.ExternalIdentity) error
+	// CreateExternalUser creates a new user with the given roles, linked to an external identity.
+	CreateExternalUser(ctx context.Context, user domain.User, identity domain.ExternalIdentity) error
+	// CreateOAuthClient saves a new OAuth client in the storage.
+	CreateOAuthClient(ctx context.Context, client domain.OAuthClient) error
+	// GetOAuthClient returns the OAuth client with the specified ID.
+	GetOAuthClient(ctx context.Context, id string) (domain.OAuthClient, error)
+	// QueryOAuthClients returns all OAuth clients.
+	QueryOAuthClients(ctx context.Context) ([]domain.OAuthClient, error)
+	// DeleteOAuthClient deletes the OAuth client with the specified ID.
+	DeleteOAuthClient(ctx context.Context, id string) error
+	// CreateSession saves a new session in the storage.
+	CreateSession(ctx context.Context, session domain.Session) error
+	// GetSession returns the session with the specified ID.
+	GetSession(ctx context.Context, id string) (domain.Session, error)
+	// QuerySessions returns the sessions of the user with given ID that have not been terminated
+	// and were seen after the given time, most recently seen first.
+	QuerySessions(ctx context.Context, userID string, seenAfter time.Time) ([]domain.Session, error)
+	// TouchSession records when the session with given ID was last seen.
+	TouchSession(ctx context.Context, id string, seenAt time.Time) error
+	// TerminateSession marks the session with given ID as terminated.
+	TerminateSession(ctx context.Context, id string, terminatedAt time.Time) error
+	// TerminateUserSessions marks every session of the user with given ID as terminated.
+	TerminateUserSessions(ctx context.Context, userID string, terminatedAt time.Time) error
+	// CreateAuditLog saves a new audit log entry in the storage.
+	CreateAuditLog(ctx context.Context, entry domain.AuditLog) error
 }
 
 type repository struct {
@@ -22,16 +116,735 @@ func NewRepository(db *sql.DB) Repository {
 	return repository{db}
 }
 
-// Get returns the user with the specified user ID.
+// Login returns the user with the specified email along with the names of its roles.
 func (r repository) Login(ctx context.Context, email string) (domain.User, error) {
+	return r.getUser(ctx, "email", email)
+}
+
+// GetUser returns the user with the specified ID along with the names of its roles.
+func (r repository) GetUser(ctx context.Context, id string) (domain.User, error) {
+	return r.getUser(ctx, "id", id)
+}
+
+// getUser returns the user whose column equals the given value along with the names of its roles.
+// Soft-deleted users are not returned, so that they can neither log in nor use their tokens and API keys.
+func (r repository) getUser(ctx context.Context, column string, value string) (domain.User, error) {
 	var user domain.User
-	stmt, err := r.db.PrepareContext(ctx, "SELECT id, first_name, last_name, email, password, address, created_at, updated_at FROM users WHERE email=?")
+	var roles sql.NullString
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, first_name, last_name, email, password, address, email_verified_at, created_at, updated_at, (SELECT GROUP_CONCAT(roles.name) FROM user_roles JOIN roles ON roles.id=user_roles.role_id WHERE user_roles.user_id=users.id) FROM users WHERE "+column+"=? AND deleted_at IS NULL")
 	if err != nil {
 		return domain.User{}, err
 	}
-	row := stmt.QueryRowContext(ctx, email)
-	if err := row.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.Address, &user.CreatedAt, &user.UpdatedAt); err != nil {
+	row := stmt.QueryRowContext(ctx, value)
+	if err := row.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.Address, &user.EmailVerifiedAt, &user.CreatedAt, &user.UpdatedAt, &roles); err != nil {
 		return domain.User{}, err
 	}
+	user.Roles = splitList(roles)
 	return user, nil
 }
+
+// GetPermissions returns the names of the permissions mapped to any of the given roles.
+func (r repository) GetPermissions(ctx context.Context, roles []string) ([]string, error) {
+	permissions := []string{}
+	if len(roles) == 0 {
+		return permissions, nil
+	}
+	args := make([]interface{}, len(roles))
+	for i, role := range roles {
+		args[i] = role
+	}
+	query := fmt.Sprintf("SELECT DISTINCT role_permissions.permission FROM role_permissions JOIN roles ON roles.id=role_permissions.role_id WHERE roles.name IN (%v)", placeholders(len(roles)))
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// GetRole returns the role with the specified ID along with its permissions.
+func (r repository) GetRole(ctx context.Context, id string) (domain.Role, error) {
+	var role domain.Role
+	var permissions sql.NullString
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, name, description, created_at, updated_at, (SELECT GROUP_CONCAT(permission) FROM role_permissions WHERE role_id=roles.id) FROM roles WHERE id=?")
+	if err != nil {
+		return domain.Role{}, err
+	}
+	row := stmt.QueryRowContext(ctx, id)
+	if err := row.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.UpdatedAt, &permissions); err != nil {
+		return domain.Role{}, err
+	}
+	role.Permissions = splitList(permissions)
+	return role, nil
+}
+
+// QueryRoles returns all roles along with their permissions.
+func (r repository) QueryRoles(ctx context.Context) ([]domain.Role, error) {
+	roles := []domain.Role{}
+	rows, err := r.db.QueryContext(ctx, "SELECT id, name, description, created_at, updated_at, (SELECT GROUP_CONCAT(permission) FROM role_permissions WHERE role_id=roles.id) FROM roles ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role domain.Role
+		var permissions sql.NullString
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.UpdatedAt, &permissions); err != nil {
+			return nil, err
+		}
+		role.Permissions = splitList(permissions)
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// SetRolePermissions replaces the permissions mapped to the role with given ID.
+func (r repository) SetRolePermissions(ctx context.Context, id string, permissions []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM role_permissions WHERE role_id=?", id); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO role_permissions (role_id, permission) VALUES (?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	for _, permission := range permissions {
+		if _, err := stmt.ExecContext(ctx, id, permission); err != nil {
+			return fmt.Errorf("Error exec query: %v", err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE roles SET updated_at=? WHERE id=?", time.Now(), id); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return tx.Commit()
+}
+
+// CreateRefreshToken saves a new refresh token in the storage.
+func (r repository) CreateRefreshToken(ctx context.Context, token domain.RefreshToken) error {
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO refresh_tokens (id, user_id, family_id, client_id, token_hash, expires_at, created_at) VALUES (?,?,?,?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	clientID := sql.NullString{String: token.ClientID, Valid: token.ClientID != ""}
+	_, err = stmt.ExecContext(ctx, token.ID, token.UserID, token.FamilyID, clientID, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// GetRefreshToken returns the refresh token with the specified hash.
+func (r repository) GetRefreshToken(ctx context.Context, hash string) (domain.RefreshToken, error) {
+	var token domain.RefreshToken
+	var clientID sql.NullString
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, user_id, family_id, client_id, token_hash, expires_at, used_at, revoked_at, created_at FROM refresh_tokens WHERE token_hash=?")
+	if err != nil {
+		return domain.RefreshToken{}, err
+	}
+	row := stmt.QueryRowContext(ctx, hash)
+	if err := row.Scan(&token.ID, &token.UserID, &token.FamilyID, &clientID, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.RevokedAt, &token.CreatedAt); err != nil {
+		return domain.RefreshToken{}, err
+	}
+	token.ClientID = clientID.String
+	return token, nil
+}
+
+// UseRefreshToken marks the refresh token with given ID as used.
+// It returns false if the token has already been used.
+func (r repository) UseRefreshToken(ctx context.Context, id string, usedAt time.Time) (bool, error) {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE refresh_tokens SET used_at=? WHERE id=? AND used_at IS NULL")
+	if err != nil {
+		return false, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	res, err := stmt.ExecContext(ctx, usedAt, id)
+	if err != nil {
+		return false, fmt.Errorf("Error exec query: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token of the given family.
+func (r repository) RevokeRefreshTokenFamily(ctx context.Context, familyID string, revokedAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE refresh_tokens SET revoked_at=? WHERE family_id=? AND revoked_at IS NULL")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, revokedAt, familyID)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user with given ID.
+func (r repository) RevokeUserRefreshTokens(ctx context.Context, userID string, revokedAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE refresh_tokens SET revoked_at=? WHERE user_id=? AND revoked_at IS NULL")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, revokedAt, userID)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// CreateUserToken saves a new user token in the storage.
+func (r repository) CreateUserToken(ctx context.Context, token domain.UserToken) error {
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO user_tokens (id, user_id, purpose, token_hash, expires_at, created_at) VALUES (?,?,?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, token.ID, token.UserID, token.Purpose, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// GetUserToken returns the user token with the specified purpose and hash.
+func (r repository) GetUserToken(ctx context.Context, purpose, hash string) (domain.UserToken, error) {
+	var token domain.UserToken
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, user_id, purpose, token_hash, expires_at, used_at, created_at FROM user_tokens WHERE purpose=? AND token_hash=?")
+	if err != nil {
+		return domain.UserToken{}, err
+	}
+	row := stmt.QueryRowContext(ctx, purpose, hash)
+	if err := row.Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.CreatedAt); err != nil {
+		return domain.UserToken{}, err
+	}
+	return token, nil
+}
+
+// UseUserToken marks the user token with given ID as used.
+// It returns false if the token has already been used.
+func (r repository) UseUserToken(ctx context.Context, id string, usedAt time.Time) (bool, error) {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE user_tokens SET used_at=? WHERE id=? AND used_at IS NULL")
+	if err != nil {
+		return false, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	res, err := stmt.ExecContext(ctx, usedAt, id)
+	if err != nil {
+		return false, fmt.Errorf("Error exec query: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// UpdatePassword updates the password hash of the user with given ID.
+func (r repository) UpdatePassword(ctx context.Context, userID, hash string) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE users SET password=?, updated_at=?, version=version+1 WHERE id=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, hash, time.Now(), userID)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// QueryPasswordHistory returns the hashes of the previous passwords of the user with given ID, most recent first.
+func (r repository) QueryPasswordHistory(ctx context.Context, userID string, limit int) ([]string, error) {
+	hashes := []string{}
+	stmt, err := r.db.PrepareContext(ctx, "SELECT password_hash FROM password_history WHERE user_id=? ORDER BY created_at DESC LIMIT ?")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// AddPasswordHistory records the hash of a previous password of the user with given ID.
+func (r repository) AddPasswordHistory(ctx context.Context, userID, hash string, createdAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO password_history (id, user_id, password_hash, created_at) VALUES (?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, domain.GenerateID(), userID, hash, createdAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// VerifyEmail marks the email address of the user with given ID as verified.
+func (r repository) VerifyEmail(ctx context.Context, userID string, verifiedAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE users SET email_verified_at=?, version=version+1 WHERE id=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, verifiedAt, userID)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// GetMFA returns the two-factor authentication settings of the user with given ID.
+func (r repository) GetMFA(ctx context.Context, userID string) (domain.MFA, error) {
+	var mfa domain.MFA
+	stmt, err := r.db.PrepareContext(ctx, "SELECT user_id, secret, enabled_at, last_used_step, created_at FROM user_mfa WHERE user_id=?")
+	if err != nil {
+		return domain.MFA{}, err
+	}
+	row := stmt.QueryRowContext(ctx, userID)
+	if err := row.Scan(&mfa.UserID, &mfa.Secret, &mfa.EnabledAt, &mfa.LastUsedStep, &mfa.CreatedAt); err != nil {
+		return domain.MFA{}, err
+	}
+	return mfa, nil
+}
+
+// SaveMFA creates or replaces the two-factor authentication settings of a user along with its recovery code hashes.
+func (r repository) SaveMFA(ctx context.Context, mfa domain.MFA, recoveryCodeHashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "REPLACE INTO user_mfa (user_id, secret, enabled_at, last_used_step, created_at) VALUES (?,?,?,?,?)", mfa.UserID, mfa.Secret, mfa.EnabledAt, mfa.LastUsedStep, mfa.CreatedAt); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id=?", mfa.UserID); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO mfa_recovery_codes (id, user_id, code_hash) VALUES (?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := stmt.ExecContext(ctx, domain.GenerateID(), mfa.UserID, hash); err != nil {
+			return fmt.Errorf("Error exec query: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// EnableMFA marks the two-factor authentication settings of the user with given ID as confirmed.
+func (r repository) EnableMFA(ctx context.Context, userID string, enabledAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE user_mfa SET enabled_at=? WHERE user_id=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, enabledAt, userID)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// DeleteMFA removes the two-factor authentication settings and recovery codes of the user with given ID.
+func (r repository) DeleteMFA(ctx context.Context, userID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id=?", userID); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_mfa WHERE user_id=?", userID); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return tx.Commit()
+}
+
+// UseMFAStep records the TOTP time step used by the user with given ID.
+// It returns false if the same or a later step has already been used.
+func (r repository) UseMFAStep(ctx context.Context, userID string, step int64) (bool, error) {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE user_mfa SET last_used_step=? WHERE user_id=? AND last_used_step < ?")
+	if err != nil {
+		return false, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	res, err := stmt.ExecContext(ctx, step, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("Error exec query: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// UseRecoveryCode marks the recovery code with given hash of the user as used.
+// It returns false if no such unused code exists.
+func (r repository) UseRecoveryCode(ctx context.Context, userID, hash string, usedAt time.Time) (bool, error) {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE mfa_recovery_codes SET used_at=? WHERE user_id=? AND code_hash=? AND used_at IS NULL")
+	if err != nil {
+		return false, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	res, err := stmt.ExecContext(ctx, usedAt, userID, hash)
+	if err != nil {
+		return false, fmt.Errorf("Error exec query: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// CreateAPIKey saves a new API key in the storage.
+func (r repository) CreateAPIKey(ctx context.Context, key domain.APIKey) error {
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, expires_at, created_at) VALUES (?,?,?,?,?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, key.ID, key.UserID, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","), key.ExpiresAt, key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// GetAPIKey returns the API key with the specified hash.
+func (r repository) GetAPIKey(ctx context.Context, hash string) (domain.APIKey, error) {
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, created_at FROM api_keys WHERE key_hash=?")
+	if err != nil {
+		return domain.APIKey{}, err
+	}
+	return scanAPIKey(stmt.QueryRowContext(ctx, hash))
+}
+
+// QueryAPIKeys returns the API keys of the user with given ID, newest first.
+func (r repository) QueryAPIKeys(ctx context.Context, userID string) ([]domain.APIKey, error) {
+	keys := []domain.APIKey{}
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, created_at FROM api_keys WHERE user_id=? ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteAPIKey deletes the API key with given ID of the user.
+// It returns false if the user has no such key.
+func (r repository) DeleteAPIKey(ctx context.Context, userID, id string) (bool, error) {
+	stmt, err := r.db.PrepareContext(ctx, "DELETE FROM api_keys WHERE id=? AND user_id=?")
+	if err != nil {
+		return false, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	res, err := stmt.ExecContext(ctx, id, userID)
+	if err != nil {
+		return false, fmt.Errorf("Error exec query: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+// TouchAPIKey records when the API key with given ID was last used.
+func (r repository) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE api_keys SET last_used_at=? WHERE id=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, usedAt, id)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// GetExternalIdentity returns the external identity with the specified issuer and subject.
+func (r repository) GetExternalIdentity(ctx context.Context, issuer, subject string) (domain.ExternalIdentity, error) {
+	var identity domain.ExternalIdentity
+	var email sql.NullString
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, user_id, issuer, subject, email, created_at FROM external_identities WHERE issuer=? AND subject=?")
+	if err != nil {
+		return domain.ExternalIdentity{}, err
+	}
+	row := stmt.QueryRowContext(ctx, issuer, subject)
+	if err := row.Scan(&identity.ID, &identity.UserID, &identity.Issuer, &identity.Subject, &email, &identity.CreatedAt); err != nil {
+		return domain.ExternalIdentity{}, err
+	}
+	identity.Email = email.String
+	return identity, nil
+}
+
+// CreateExternalIdentity links an existing user to an external identity.
+func (r repository) CreateExternalIdentity(ctx context.Context, identity domain.ExternalIdentity) error {
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO external_identities (id, user_id, issuer, subject, email, created_at) VALUES (?,?,?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, identity.ID, identity.UserID, identity.Issuer, identity.Subject, identity.Email, identity.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// CreateExternalUser creates a new user with the given roles, linked to an external identity.
+func (r repository) CreateExternalUser(ctx context.Context, user domain.User, identity domain.ExternalIdentity) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO users (id, first_name, last_name, email, password, address, email_verified_at, created_at, updated_at) VALUES (?,?,?,?,?,?,?,?,?)",
+		user.ID, user.FirstName, user.LastName, user.Email, user.Password, user.Address, user.EmailVerifiedAt, user.CreatedAt, user.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	for _, role := range user.Roles {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name=?", user.ID, role); err != nil {
+			return fmt.Errorf("Error exec query: %v", err)
+		}
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO external_identities (id, user_id, issuer, subject, email, created_at) VALUES (?,?,?,?,?,?)",
+		identity.ID, user.ID, identity.Issuer, identity.Subject, identity.Email, identity.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return tx.Commit()
+}
+
+// CreateOAuthClient saves a new OAuth client in the storage.
+func (r repository) CreateOAuthClient(ctx context.Context, client domain.OAuthClient) error {
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO oauth_clients (id, name, secret_hash, scopes, grant_types, created_at) VALUES (?,?,?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, client.ID, client.Name, client.SecretHash, strings.Join(client.Scopes, ","), strings.Join(client.GrantTypes, ","), client.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// GetOAuthClient returns the OAuth client with the specified ID.
+func (r repository) GetOAuthClient(ctx context.Context, id string) (domain.OAuthClient, error) {
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, name, secret_hash, scopes, grant_types, created_at FROM oauth_clients WHERE id=?")
+	if err != nil {
+		return domain.OAuthClient{}, err
+	}
+	return scanOAuthClient(stmt.QueryRowContext(ctx, id))
+}
+
+// QueryOAuthClients returns all OAuth clients.
+func (r repository) QueryOAuthClients(ctx context.Context) ([]domain.OAuthClient, error) {
+	clients := []domain.OAuthClient{}
+	rows, err := r.db.QueryContext(ctx, "SELECT id, name, secret_hash, scopes, grant_types, created_at FROM oauth_clients ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+// DeleteOAuthClient deletes the OAuth client with the specified ID.
+func (r repository) DeleteOAuthClient(ctx context.Context, id string) error {
+	stmt, err := r.db.PrepareContext(ctx, "DELETE FROM oauth_clients WHERE id=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, id)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// CreateSession saves a new session in the storage.
+func (r repository) CreateSession(ctx context.Context, session domain.Session) error {
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO sessions (id, user_id, user_agent, ip, scopes, created_at, last_seen_at) VALUES (?,?,?,?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, session.ID, session.UserID, session.UserAgent, session.IP, strings.Join(session.Scopes, ","), session.CreatedAt, session.LastSeenAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// GetSession returns the session with the specified ID.
+func (r repository) GetSession(ctx context.Context, id string) (domain.Session, error) {
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, user_id, user_agent, ip, scopes, created_at, last_seen_at, terminated_at FROM sessions WHERE id=?")
+	if err != nil {
+		return domain.Session{}, err
+	}
+	return scanSession(stmt.QueryRowContext(ctx, id))
+}
+
+// QuerySessions returns the sessions of the user with given ID that have not been terminated
+// and were seen after the given time, most recently seen first.
+func (r repository) QuerySessions(ctx context.Context, userID string, seenAfter time.Time) ([]domain.Session, error) {
+	sessions := []domain.Session{}
+	stmt, err := r.db.PrepareContext(ctx, "SELECT id, user_id, user_agent, ip, scopes, created_at, last_seen_at, terminated_at FROM sessions WHERE user_id=? AND terminated_at IS NULL AND last_seen_at > ? ORDER BY last_seen_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, userID, seenAfter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchSession records when the session with given ID was last seen.
+func (r repository) TouchSession(ctx context.Context, id string, seenAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE sessions SET last_seen_at=? WHERE id=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, seenAt, id)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// TerminateSession marks the session with given ID as terminated.
+func (r repository) TerminateSession(ctx context.Context, id string, terminatedAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE sessions SET terminated_at=? WHERE id=? AND terminated_at IS NULL")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, terminatedAt, id)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// TerminateUserSessions marks every session of the user with given ID as terminated.
+func (r repository) TerminateUserSessions(ctx context.Context, userID string, terminatedAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE sessions SET terminated_at=? WHERE user_id=? AND terminated_at IS NULL")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, terminatedAt, userID)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// CreateAuditLog saves a new audit log entry in the storage.
+func (r repository) CreateAuditLog(ctx context.Context, entry domain.AuditLog) error {
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO audit_logs (id, actor_id, action, target_id, details, ip, user_agent, created_at) VALUES (?,?,?,?,?,?,?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, entry.ID, entry.ActorID, entry.Action, entry.TargetID, entry.Details, entry.IP, entry.UserAgent, entry.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// scanSession scans a row of the sessions table.
+func scanSession(row interface{ Scan(...interface{}) error }) (domain.Session, error) {
+	var session domain.Session
+	var userAgent, ip, scopes sql.NullString
+	var lastSeenAt *time.Time
+	if err := row.Scan(&session.ID, &session.UserID, &userAgent, &ip, &scopes, &session.CreatedAt, &lastSeenAt, &session.TerminatedAt); err != nil {
+		return domain.Session{}, err
+	}
+	session.UserAgent, session.IP = userAgent.String, ip.String
+	session.Scopes = splitList(scopes)
+	if lastSeenAt != nil {
+		session.LastSeenAt = *lastSeenAt
+	}
+	return session, nil
+}
+
+// scanOAuthClient scans a row of the oauth_clients table.
+func scanOAuthClient(row interface{ Scan(...interface{}) error }) (domain.OAuthClient, error) {
+	var client domain.OAuthClient
+	var scopes, grantTypes sql.NullString
+	if err := row.Scan(&client.ID, &client.Name, &client.SecretHash, &scopes, &grantTypes, &client.CreatedAt); err != nil {
+		return domain.OAuthClient{}, err
+	}
+	client.Scopes = splitList(scopes)
+	client.GrantTypes = splitList(grantTypes)
+	return client, nil
+}
+
+// scanAPIKey scans a row of the api_keys table.
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (domain.APIKey, error) {
+	var key domain.APIKey
+	var scopes sql.NullString
+	if err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &scopes, &key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt); err != nil {
+		return domain.APIKey{}, err
+	}
+	key.Scopes = splitList(scopes)
+	return key, nil
+}
+
+// placeholders returns n comma separated SQL placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// splitList converts the comma separated values returned by GROUP_CONCAT into a slice.
+func splitList(roles sql.NullString) []string {
+	if !roles.Valid || roles.String == "" {
+		return []string{}
+	}
+	return strings.Split(roles.String, ",")
+}
@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RevocationStore keeps track of access tokens that have been revoked before they expire.
+type RevocationStore interface {
+	// Revoke revokes the token with the given ID until it expires.
+	Revoke(ctx context.Context, tokenID string, expiresAt time.Time) error
+	// Consume revokes the token with the given ID until it expires and reports whether it was not revoked yet,
+	// so that a single-use token is accepted once only even when presented concurrently.
+	Consume(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error)
+	// RevokeSession revokes every token belonging to the session with the given ID until expiresAt.
+	RevokeSession(ctx context.Context, sessionID string, expiresAt time.Time) error
+	// RevokeUser revokes every token issued to the user at or before the given time.
+	RevokeUser(ctx context.Context, userID string, before time.Time) error
+	// IsRevoked checks whether the token with the given ID, belonging to the session and issued to the user at issuedAt,
+	// has been revoked. The session ID may be empty for tokens that do not belong to a session.
+	IsRevoked(ctx context.Context, tokenID, sessionID, userID string, issuedAt time.Time) (bool, error)
+}
+
+type memoryRevocationStore struct {
+	sync.Mutex
+	tokens   map[string]time.Time
+	sessions map[string]time.Time
+	users    map[string]time.Time
+}
+
+// NewMemoryRevocationStore creates a revocation store that keeps revocations in memory.
+// It is suitable for tests and single instance deployments only, as revocations are lost on restart.
+func NewMemoryRevocationStore() RevocationStore {
+	return &memoryRevocationStore{
+		tokens:   map[string]time.Time{},
+		sessions: map[string]time.Time{},
+		users:    map[string]time.Time{},
+	}
+}
+
+// Revoke revokes the token with the given ID until it expires.
+func (s *memoryRevocationStore) Revoke(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for id, exp := range s.tokens {
+		if exp.Before(now) {
+			delete(s.tokens, id)
+		}
+	}
+	s.tokens[tokenID] = expiresAt
+	return nil
+}
+
+// Consume revokes the token with the given ID until it expires and reports whether it was not revoked yet.
+func (s *memoryRevocationStore) Consume(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.tokens[tokenID]; ok {
+		return false, nil
+	}
+	s.tokens[tokenID] = expiresAt
+	return true, nil
+}
+
+// RevokeSession revokes every token belonging to the session with the given ID until expiresAt.
+func (s *memoryRevocationStore) RevokeSession(ctx context.Context, sessionID string, expiresAt time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for id, exp := range s.sessions {
+		if exp.Before(now) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[sessionID] = expiresAt
+	return nil
+}
+
+// RevokeUser revokes every token issued to the user at or before the given time.
+func (s *memoryRevocationStore) RevokeUser(ctx context.Context, userID string, before time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	s.users[userID] = before
+	return nil
+}
+
+// IsRevoked checks whether the token with the given ID, belonging to the session and issued to the user at issuedAt,
+// has been revoked.
+func (s *memoryRevocationStore) IsRevoked(ctx context.Context, tokenID, sessionID, userID string, issuedAt time.Time) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.tokens[tokenID]; ok {
+		return true, nil
+	}
+	if _, ok := s.sessions[sessionID]; ok && sessionID != "" {
+		return true, nil
+	}
+	if before, ok := s.users[userID]; ok && issuedAt.Unix() <= before.Unix() {
+		return true, nil
+	}
+	return false, nil
+}
+
+type sqlRevocationStore struct {
+	db *sql.DB
+}
+
+// NewSQLRevocationStore creates a revocation store backed by the database.
+func NewSQLRevocationStore(db *sql.DB) RevocationStore {
+	return sqlRevocationStore{db}
+}
+
+// Revoke revokes the token with the given ID until it expires.
+// Revocations of tokens that have already expired are purged along the way.
+func (s sqlRevocationStore) Revoke(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < ?", time.Now()); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	stmt, err := s.db.PrepareContext(ctx, "INSERT IGNORE INTO revoked_tokens (id, expires_at) VALUES (?,?)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, tokenID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// Consume revokes the token with the given ID until it expires and reports whether it was not revoked yet.
+func (s sqlRevocationStore) Consume(ctx context.Context, tokenID string, expiresAt time.Time) (bool, error) {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM revoked_tokens WHERE expires_at < ?", time.Now()); err != nil {
+		return false, fmt.Errorf("Error exec query: %v", err)
+	}
+	stmt, err := s.db.PrepareContext(ctx, "INSERT IGNORE INTO revoked_tokens (id, expires_at) VALUES (?,?)")
+	if err != nil {
+		return false, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	result, err := stmt.ExecContext(ctx, tokenID, expiresAt)
+	if err != nil {
+		return false, fmt.Errorf("Error exec query: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// RevokeSession revokes every token belonging to the session with the given ID until expiresAt.
+// Revocations of sessions whose tokens have all expired are purged along the way.
+func (s sqlRevocationStore) RevokeSession(ctx context.Context, sessionID string, expiresAt time.Time) error {
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM revoked_sessions WHERE expires_at < ?", time.Now()); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO revoked_sessions (id, expires_at) VALUES (?,?) ON DUPLICATE KEY UPDATE expires_at=VALUES(expires_at)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, sessionID, expiresAt)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// RevokeUser revokes every token issued to the user at or before the given time.
+func (s sqlRevocationStore) RevokeUser(ctx context.Context, userID string, before time.Time) error {
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO user_revocations (user_id, revoked_before) VALUES (?,?) ON DUPLICATE KEY UPDATE revoked_before=VALUES(revoked_before)")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	_, err = stmt.ExecContext(ctx, userID, before.Truncate(time.Second))
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	return nil
+}
+
+// IsRevoked checks whether the token with the given ID, belonging to the session and issued to the user at issuedAt,
+// has been revoked.
+func (s sqlRevocationStore) IsRevoked(ctx context.Context, tokenID, sessionID, userID string, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	stmt, err := s.db.PrepareContext(ctx, "SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE id=?) OR EXISTS(SELECT 1 FROM revoked_sessions WHERE id=?) OR EXISTS(SELECT 1 FROM user_revocations WHERE user_id=? AND revoked_before >= ?)")
+	if err != nil {
+		return false, err
+	}
+	row := stmt.QueryRowContext(ctx, tokenID, sessionID, userID, issuedAt)
+	if err := row.Scan(&revoked); err != nil {
+		return false, err
+	}
+	return revoked, nil
+}
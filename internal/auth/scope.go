@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+)
+
+// grantedScopes returns the permissions the roles allow an access token to carry in its scope claim.
+// Users with the admin role are granted every registered permission, other users are granted the permissions
+// mapped to their roles along with PermissionCredentialsWrite.
+func (s service) grantedScopes(ctx context.Context, roles []string) ([]string, error) {
+	if contains(roles, domain.RoleAdmin) {
+		permissions := Permissions()
+		names := make([]string, 0, len(permissions))
+		for _, permission := range permissions {
+			names = append(names, permission.Name)
+		}
+		return names, nil
+	}
+	permissions, err := s.repo.GetPermissions(ctx, roles)
+	if err != nil {
+		return nil, err
+	}
+	if !contains(permissions, PermissionCredentialsWrite) {
+		permissions = append(permissions, PermissionCredentialsWrite)
+	}
+	return permissions, nil
+}
+
+// requestScopes intersects the scopes requested on login with the permissions of the roles.
+// It returns nil if no scope is requested, meaning that tokens carry every permission of the roles,
+// and refuses the login if none of the requested scopes is granted.
+func (s service) requestScopes(ctx context.Context, roles, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+	granted, err := s.grantedScopes(ctx, roles)
+	if err != nil {
+		return nil, err
+	}
+	scopes := intersectScopes(requested, granted)
+	if len(scopes) == 0 {
+		return nil, httperror.Forbidden("None of the requested scopes is granted to you")
+	}
+	return scopes, nil
+}
+
+// intersectScopes returns the scopes found in both lists, without duplicates, in the order of the first one.
+func intersectScopes(scopes, granted []string) []string {
+	result := []string{}
+	for _, scope := range scopes {
+		if contains(granted, scope) && !contains(result, scope) {
+			result = append(result, scope)
+		}
+	}
+	return result
+}
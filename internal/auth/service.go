@@ -2,11 +2,19 @@ package auth
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/redhajuanda/gorengan/config"
+	"github.com/redhajuanda/gorengan/internal/domain"
 	"github.com/redhajuanda/gorengan/internal/httperror"
 	"github.com/redhajuanda/gorengan/pkg/log"
+	"github.com/redhajuanda/gorengan/pkg/mailer"
+	"github.com/redhajuanda/gorengan/pkg/oidc"
 	"github.com/redhajuanda/gorengan/pkg/password"
 	"github.com/redhajuanda/gorengan/pkg/validation"
 )
@@ -14,8 +22,79 @@ import (
 // Service encapsulates the authentication logic.
 type Service interface {
 	// authenticate authenticates a user using username and password.
-	// It returns a JWT token if authentication succeeds. Otherwise, an error is returned.
-	Login(ctx context.Context, req LoginRequest) (string, error)
+	// It returns an access token and a refresh token if authentication succeeds. Otherwise, an error is returned.
+	Login(ctx context.Context, req LoginRequest) (Token, error)
+	// Refresh exchanges a refresh token for a new access token and a rotated refresh token.
+	Refresh(ctx context.Context, req RefreshRequest) (Token, error)
+	// Logout revokes the access token with the given ID and terminates its session.
+	Logout(ctx context.Context, userID, tokenID, sessionID string, expiresAt time.Time, req LogoutRequest) error
+	// RevokeSessions revokes every access and refresh token issued to the user with the specified ID.
+	RevokeSessions(ctx context.Context, userID string) error
+	// RevokeOtherSessions terminates every session of the user with the specified ID except the given one.
+	RevokeOtherSessions(ctx context.Context, userID, sessionID string) error
+	// GetRole returns the role with the specified ID along with its permissions.
+	GetRole(ctx context.Context, id string) (domain.Role, error)
+	// QueryRoles returns all roles along with their permissions.
+	QueryRoles(ctx context.Context) ([]domain.Role, error)
+	// SetRolePermissions replaces the permissions mapped to the role with the specified ID.
+	SetRolePermissions(ctx context.Context, id string, req SetRolePermissionsRequest) (domain.Role, error)
+	// ForgotPassword sends a password reset link to the user with the requested email, if any.
+	ForgotPassword(ctx context.Context, req ForgotPasswordRequest) error
+	// ResetPassword changes the password of the user owning the reset token.
+	ResetPassword(ctx context.Context, req ResetPasswordRequest) error
+	// CheckNewPassword checks the new password of a user against the password policy and the password history.
+	CheckNewPassword(ctx context.Context, user domain.User, pwd string) error
+	// AddPasswordHistory records the hash of a previous password of the user with the specified ID.
+	AddPasswordHistory(ctx context.Context, userID, hash string) error
+	// SendVerification sends an email verification link to the user.
+	SendVerification(ctx context.Context, user domain.User) error
+	// ResendVerification sends a new email verification link to the unverified user with the requested email, if any.
+	ResendVerification(ctx context.Context, req ResendVerificationRequest) error
+	// VerifyEmail marks the email address of the user owning the verification token as verified.
+	VerifyEmail(ctx context.Context, token string) error
+	// EnrollMFA generates a new TOTP secret and recovery codes for the user with the specified ID.
+	EnrollMFA(ctx context.Context, userID string) (MFAEnrollment, error)
+	// ConfirmMFA enables two-factor authentication for the user with the specified ID.
+	ConfirmMFA(ctx context.Context, userID string, req MFACodeRequest) error
+	// DisableMFA disables two-factor authentication for the user with the specified ID.
+	DisableMFA(ctx context.Context, userID string, req MFACodeRequest) error
+	// LoginMFA exchanges an mfa_pending token and a code for an access token and a refresh token.
+	LoginMFA(ctx context.Context, req LoginMFARequest) (Token, error)
+	// SendMagicLink sends a one-time sign-in link to the user with the requested email, if any.
+	SendMagicLink(ctx context.Context, req MagicLinkRequest) error
+	// LoginMagicLink exchanges the token of a magic link for an access token and a refresh token.
+	LoginMagicLink(ctx context.Context, req MagicLinkCallbackRequest) (Token, error)
+	// Unlock lifts the lockout of the user with the specified ID caused by failed login attempts.
+	Unlock(ctx context.Context, userID string) error
+	// CreateAPIKey generates a new API key for the user with the specified ID.
+	CreateAPIKey(ctx context.Context, userID string, req CreateAPIKeyRequest) (NewAPIKey, error)
+	// QueryAPIKeys returns the API keys of the user with the specified ID.
+	QueryAPIKeys(ctx context.Context, userID string) ([]domain.APIKey, error)
+	// RevokeAPIKey deletes the API key with the specified ID of the user.
+	RevokeAPIKey(ctx context.Context, userID, id string) error
+	APIKeyVerifier
+	// StartOIDCLogin starts an authorization code flow at the OpenID Connect provider.
+	StartOIDCLogin(ctx context.Context) (OIDCAuthorization, error)
+	// OIDCCallback completes an authorization code flow and logs in the user linked to the external identity.
+	OIDCCallback(ctx context.Context, req OIDCCallbackRequest) (Token, error)
+	// CreateOAuthClient registers a new OAuth client and generates its secret.
+	CreateOAuthClient(ctx context.Context, req CreateOAuthClientRequest) (NewOAuthClient, error)
+	// QueryOAuthClients returns all registered OAuth clients.
+	QueryOAuthClients(ctx context.Context) ([]domain.OAuthClient, error)
+	// DeleteOAuthClient deletes the OAuth client with the specified ID.
+	DeleteOAuthClient(ctx context.Context, id string) error
+	// OAuthToken issues tokens for the client_credentials and refresh_token grants.
+	OAuthToken(ctx context.Context, req OAuthTokenRequest) (OAuthToken, error)
+	// Introspect returns the state of an access token or a refresh token.
+	Introspect(ctx context.Context, req TokenRequest) (Introspection, error)
+	// RevokeToken revokes an access token or the family of a refresh token.
+	RevokeToken(ctx context.Context, req TokenRequest) error
+	// QuerySessions returns the active sessions of the user with the specified ID.
+	QuerySessions(ctx context.Context, userID, currentID string) ([]domain.Session, error)
+	// TerminateSession terminates the session with the specified ID of the user.
+	TerminateSession(ctx context.Context, userID, id string) error
+	// Impersonate issues a short-lived access token allowing an administrator to act as the user with the specified ID.
+	Impersonate(ctx context.Context, actorID, userID string, req ImpersonateRequest) (Token, error)
 }
 
 // Identity represents an authenticated user identity.
@@ -24,67 +103,366 @@ type Identity interface {
 	GetID() string
 	// GetName returns the user name.
 	GetUsername() string
-	// GetRole returns user role
-	GetRole() string
+	// GetRoles returns the names of the roles assigned to the user.
+	GetRoles() []string
+}
+
+// Token represents the tokens issued to an authenticated user.
+// If the user has enabled two-factor authentication, Login only returns an MFA token
+// that has to be exchanged along with a code at /login/mfa.
+type Token struct {
+	AccessToken  string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// ExpiresIn is the lifetime of the access token in seconds
+	ExpiresIn int `json:"expires_in,omitempty"`
+	// Scope is the space separated list of permissions the access token is restricted to
+	Scope       string `json:"scope,omitempty"`
+	MFARequired bool   `json:"mfa_required,omitempty"`
+	MFAToken    string `json:"mfa_token,omitempty"`
 }
 
 type service struct {
-	signingKey      string
-	tokenExpiration int
-	logger          log.Logger
-	repo            Repository
-	validation      *validation.CustomValidator
+	cfg         config.Config
+	keys        *KeySet
+	revocations RevocationStore
+	lockouts    LockoutStore
+	mailer      mailer.Mailer
+	logger      log.Logger
+	repo        Repository
+	provider    *oidc.Provider
+	validation  *validation.CustomValidator
 }
 
 // NewService creates a new authentication service.
-func NewService(signingKey string, tokenExpiration int, logger log.Logger, repo Repository) Service {
-	return service{signingKey, tokenExpiration, logger, repo, validation.New()}
+func NewService(cfg config.Config, keys *KeySet, revocations RevocationStore, lockouts LockoutStore, mailer mailer.Mailer, logger log.Logger, repo Repository) Service {
+	return service{cfg, keys, revocations, lockouts, mailer, logger, repo, newOIDCProvider(cfg), validation.New()}
 }
 
 // LoginRequest holds request data for login
 type LoginRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
+	// Scopes optionally restricts the access tokens to the listed permissions among those granted to the user
+	Scopes []string `json:"scopes"`
+	// ClientInfo describes the device of the user, the IP address is also used to count failed attempts
+	ClientInfo `json:"-"`
+}
+
+// RefreshRequest holds request data for refreshing an access token
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
 }
 
-// Login authenticates a user and generates a JWT token if authentication succeeds.
+// LogoutRequest holds request data for logout
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SetRolePermissionsRequest holds request data for changing the permissions mapped to a role
+type SetRolePermissionsRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+// Login authenticates a user and generates a JWT token along with a refresh token if authentication succeeds.
+// If the user has enabled two-factor authentication, a short-lived mfa_pending token is returned instead.
 // Otherwise, an error is returned.
-func (s service) Login(ctx context.Context, req LoginRequest) (string, error) {
+func (s service) Login(ctx context.Context, req LoginRequest) (Token, error) {
 	err := s.validation.Validate(req)
 	if err != nil {
-		return "", err
+		return Token{}, err
 	}
-	if identity := s.authenticate(ctx, req.Email, req.Password); identity != nil {
-		return s.generateJWT(identity)
+	identity, err := s.authenticate(ctx, req.Email, req.Password, req.IP)
+	if err != nil {
+		return Token{}, err
 	}
-	return "", httperror.Unauthorized("Invalid email or password")
+	return s.completeLogin(ctx, identity, req.ClientInfo, req.Scopes)
 }
 
-// authenticate authenticates a user using email and password.
-// If email and password are correct, an identity is returned. Otherwise, nil is returned.
-func (s service) authenticate(ctx context.Context, email, plainPwd string) Identity {
-	logger := s.logger.With(ctx, "user", email)
+// completeLogin starts a session for an authenticated identity, whose tokens are restricted to the requested scopes
+// granted to the user, or issues an mfa_pending token if the user has enabled two-factor authentication.
+func (s service) completeLogin(ctx context.Context, identity Identity, client ClientInfo, requested []string) (Token, error) {
+	scopes, err := s.requestScopes(ctx, identity.GetRoles(), requested)
+	if err != nil {
+		return Token{}, err
+	}
+	mfaRequired, err := s.requiresMFA(ctx, identity.GetID())
+	if err != nil {
+		return Token{}, err
+	}
+	if mfaRequired {
+		mfaToken, err := s.generateMFAToken(identity.GetID(), scopes)
+		if err != nil {
+			return Token{}, err
+		}
+		return Token{MFARequired: true, MFAToken: mfaToken}, nil
+	}
+	return s.startSession(ctx, identity, client, scopes)
+}
 
-	user, err := s.repo.Login(ctx, email)
+// Refresh exchanges a refresh token for a new access token and a rotated refresh token.
+// Every refresh token can only be used once. If an already used refresh token is presented again,
+// the whole token family is revoked as the token has most likely been stolen.
+func (s service) Refresh(ctx context.Context, req RefreshRequest) (Token, error) {
+	err := s.validation.Validate(req)
+	if err != nil {
+		return Token{}, err
+	}
+	return s.refresh(ctx, req.RefreshToken, "")
+}
+
+// errInvalidRefreshToken is returned when a refresh token cannot be exchanged.
+var errInvalidRefreshToken = httperror.Unauthorized("Invalid or expired refresh token")
+
+// refresh rotates a refresh token issued to the OAuth client with the given ID, an empty ID standing for
+// the tokens issued on login. Tokens issued to anyone else are refused with errInvalidRefreshToken.
+func (s service) refresh(ctx context.Context, plainToken, clientID string) (Token, error) {
+	invalid := errInvalidRefreshToken
+	token, err := s.repo.GetRefreshToken(ctx, hashToken(plainToken))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, invalid
+	}
 	if err != nil {
-		return nil
+		return Token{}, err
+	}
+	if token.ClientID != clientID {
+		return Token{}, invalid
 	}
+	logger := s.logger.With(ctx, "user", token.UserID, "family", token.FamilyID)
 
-	if email == user.Email && password.ComparePasswords(user.Password, []byte(plainPwd)) {
+	if token.RevokedAt != nil || time.Now().After(token.ExpiresAt) {
+		return Token{}, invalid
+	}
+	if token.UsedAt != nil {
+		return Token{}, s.revokeRefreshTokenFamily(ctx, token, invalid)
+	}
+	used, err := s.repo.UseRefreshToken(ctx, token.ID, time.Now())
+	if err != nil {
+		return Token{}, err
+	}
+	if !used {
+		return Token{}, s.revokeRefreshTokenFamily(ctx, token, invalid)
+	}
+
+	user, err := s.repo.GetUser(ctx, token.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, invalid
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	session, err := s.repo.GetSession(ctx, token.FamilyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, invalid
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	if err := s.repo.TouchSession(ctx, session.ID, time.Now()); err != nil {
+		return Token{}, err
+	}
+	logger.Infof("refresh token rotated")
+	return s.issueTokens(ctx, user, session, token.ClientID)
+}
+
+// Logout revokes the access token with the given ID and terminates its session.
+// The family of the refresh token is revoked as well if supplied.
+func (s service) Logout(ctx context.Context, userID, tokenID, sessionID string, expiresAt time.Time, req LogoutRequest) error {
+	if err := s.revocations.Revoke(ctx, tokenID, expiresAt); err != nil {
+		return err
+	}
+	if sessionID != "" {
+		if err := s.terminateSession(ctx, userID, sessionID); err != nil {
+			return err
+		}
+	}
+	if req.RefreshToken != "" {
+		token, err := s.repo.GetRefreshToken(ctx, hashToken(req.RefreshToken))
+		if err == nil && token.UserID == userID {
+			if err := s.repo.RevokeRefreshTokenFamily(ctx, token.FamilyID, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+	s.logger.With(ctx, "user", userID).Infof("logged out")
+	return nil
+}
+
+// RevokeSessions revokes every access and refresh token issued to the user with the specified ID.
+func (s service) RevokeSessions(ctx context.Context, userID string) error {
+	if _, err := s.repo.GetUser(ctx, userID); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := s.revocations.RevokeUser(ctx, userID, now); err != nil {
+		return err
+	}
+	if err := s.repo.RevokeUserRefreshTokens(ctx, userID, now); err != nil {
+		return err
+	}
+	if err := s.repo.TerminateUserSessions(ctx, userID, now); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userID).Infof("sessions revoked")
+	return nil
+}
+
+// revokeRefreshTokenFamily revokes the family of a refresh token that has been reused and returns err.
+func (s service) revokeRefreshTokenFamily(ctx context.Context, token domain.RefreshToken, err error) error {
+	s.logger.With(ctx, "user", token.UserID, "family", token.FamilyID).Infof("refresh token reuse detected, revoking token family")
+	if revokeErr := s.repo.RevokeRefreshTokenFamily(ctx, token.FamilyID, time.Now()); revokeErr != nil {
+		return revokeErr
+	}
+	return err
+}
+
+// issueTokens generates an access token for the identity and a refresh token belonging to the family of the session.
+// The family ID is the ID of the session, which is embedded in the access token as the sid claim.
+// The scope claim lists the permissions currently granted to the identity, restricted to the scopes of the session if any.
+func (s service) issueTokens(ctx context.Context, identity Identity, session domain.Session, clientID string) (Token, error) {
+	scopes, err := s.grantedScopes(ctx, identity.GetRoles())
+	if err != nil {
+		return Token{}, err
+	}
+	if len(session.Scopes) > 0 {
+		scopes = intersectScopes(session.Scopes, scopes)
+	}
+	scope := strings.Join(scopes, " ")
+	familyID := session.ID
+	claims := jwt.MapClaims{"sid": familyID, "scope": scope}
+	if clientID != "" {
+		claims["client_id"] = clientID
+	}
+	accessToken, err := s.generateJWTWithClaims(identity, claims)
+	if err != nil {
+		return Token{}, err
+	}
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		return Token{}, err
+	}
+	now := time.Now()
+	err = s.repo.CreateRefreshToken(ctx, domain.RefreshToken{
+		ID:        domain.GenerateID(),
+		UserID:    identity.GetID(),
+		FamilyID:  familyID,
+		ClientID:  clientID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: now.Add(time.Duration(s.cfg.JWT.RefreshTokenExpiration) * time.Hour),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return Token{}, err
+	}
+
+	return Token{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.cfg.AccessTokenLifetime().Seconds()),
+		Scope:        scope,
+	}, nil
+}
+
+// authenticate authenticates a user using email and password.
+// If email and password are correct, an identity is returned. Otherwise, an error is returned.
+// Users who have not verified their email address are refused if email verification is required.
+func (s service) authenticate(ctx context.Context, email, plainPwd, ip string) (Identity, error) {
+	logger := s.logger.With(ctx, "user", email, "ip", ip)
+	invalid := httperror.Unauthorized("Invalid email or password")
+
+	if err := s.checkLockout(ctx, email, ip); err != nil {
+		return nil, err
+	}
+
+	user, err := s.repo.Login(ctx, email)
+	if err == nil && email == user.Email && password.ComparePasswords(user.Password, []byte(plainPwd)) {
+		if err := s.lockouts.Reset(ctx, emailLockoutKey(email)); err != nil {
+			return nil, err
+		}
+		if password.NeedsRehash(user.Password) {
+			s.rehashPassword(ctx, user.ID, plainPwd)
+		}
+		if s.cfg.Auth.RequireEmailVerification && !user.IsEmailVerified() {
+			logger.Infof("authentication refused, email not verified")
+			return nil, httperror.Forbidden("Email address has not been verified")
+		}
 		logger.Infof("authentication successful")
-		return user
+		return user, nil
 	}
 
 	logger.Infof("authentication failed")
-	return nil
+	if err := s.recordFailure(ctx, email, ip); err != nil {
+		return nil, err
+	}
+	return nil, invalid
+}
+
+// rehashPassword replaces the hash of the password of a user with one using the current hashing parameters.
+// Failures are only logged, since the password is rehashed again on the next login.
+func (s service) rehashPassword(ctx context.Context, userID, plainPwd string) {
+	logger := s.logger.With(ctx, "user", userID)
+	hashedPwd, err := password.HashAndSalt([]byte(plainPwd))
+	if err == nil {
+		err = s.repo.UpdatePassword(ctx, userID, hashedPwd)
+	}
+	if err != nil {
+		logger.Errorf("failed to rehash password: %v", err)
+		return
+	}
+	logger.Infof("password rehashed")
 }
 
 // generateJWT generates a JWT that encodes an identity.
 func (s service) generateJWT(identity Identity) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	return s.generateJWTWithClaims(identity, nil)
+}
+
+// generateJWTWithClaims generates a JWT that encodes an identity along with additional claims.
+func (s service) generateJWTWithClaims(identity Identity, extra jwt.MapClaims) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"jti":      domain.GenerateID(),
 		"id":       identity.GetID(),
 		"username": identity.GetUsername(),
-		"role":     identity.GetRole(),
-		"exp":      time.Now().Add(time.Duration(s.tokenExpiration) * time.Hour).Unix(),
-	}).SignedString([]byte(s.signingKey))
+		"roles":    identity.GetRoles(),
+		"iat":      now.Unix(),
+		"exp":      now.Add(s.cfg.AccessTokenLifetime()).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return s.keys.Sign(claims)
+}
+
+// GetRole returns the role with the specified ID along with its permissions.
+func (s service) GetRole(ctx context.Context, id string) (domain.Role, error) {
+	return s.repo.GetRole(ctx, id)
+}
+
+// QueryRoles returns all roles along with their permissions.
+func (s service) QueryRoles(ctx context.Context) ([]domain.Role, error) {
+	return s.repo.QueryRoles(ctx)
+}
+
+// SetRolePermissions replaces the permissions mapped to the role with the specified ID.
+// Only registered permissions can be mapped to a role.
+func (s service) SetRolePermissions(ctx context.Context, id string, req SetRolePermissionsRequest) (domain.Role, error) {
+	if _, err := s.repo.GetRole(ctx, id); err != nil {
+		return domain.Role{}, err
+	}
+
+	permissions := []string{}
+	for _, permission := range req.Permissions {
+		if !IsRegistered(permission) {
+			return domain.Role{}, validation.NewValidationError(fmt.Sprintf("permission %v is not registered", permission))
+		}
+		if !contains(permissions, permission) {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	if err := s.repo.SetRolePermissions(ctx, id, permissions); err != nil {
+		return domain.Role{}, err
+	}
+	return s.repo.GetRole(ctx, id)
 }
@@ -0,0 +1,1295 @@
+// +build all service
+
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+	"github.com/redhajuanda/gorengan/config"
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+	"github.com/redhajuanda/gorengan/pkg/log"
+	"github.com/redhajuanda/gorengan/pkg/mailer"
+	"github.com/redhajuanda/gorengan/pkg/oidc/oidctest"
+	"github.com/redhajuanda/gorengan/pkg/password"
+	"github.com/redhajuanda/gorengan/pkg/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+// serviceTest holds a service under test along with its mocked dependencies.
+type serviceTest struct {
+	Service
+	repo        *mockRepository
+	revocations RevocationStore
+	lockouts    LockoutStore
+	mailer      *mockMailer
+	keys        *KeySet
+}
+
+func createNewServiceTest(t *testing.T) serviceTest {
+	return createNewServiceTestWithConfig(t, func(cfg *config.Config) {})
+}
+
+func createNewServiceTestWithConfig(t *testing.T, configure func(cfg *config.Config)) serviceTest {
+	logger, _ := log.NewForTest()
+	revocations := NewMemoryRevocationStore()
+	lockouts := NewMemoryLockoutStore()
+	var cfg config.Config
+	cfg.Server.BaseURL = "http://localhost:3000"
+	cfg.JWT.AccessTokenExpiration = 15
+	cfg.JWT.RefreshTokenExpiration = 24
+	cfg.Auth.PasswordResetExpiration = 60
+	cfg.Auth.PasswordResetURL = "http://localhost:8080/password/reset"
+	cfg.Auth.EmailVerificationExpiration = 48
+	configure(&cfg)
+	hashedPwd, err := password.HashAndSalt([]byte("secret"))
+	assert.NoError(t, err)
+
+	repo := &mockRepository{
+		users: []domain.User{
+			{
+				ID:        domain.GenerateID(),
+				FirstName: "Super",
+				LastName:  "Admin",
+				Email:     "super@admin.com",
+				Password:  hashedPwd,
+				Roles:     []string{domain.RoleAdmin},
+				CreatedAt: time.Now(),
+				UpdatedAt: time.Now(),
+			},
+		},
+		roles: []domain.Role{
+			{ID: domain.GenerateID(), Name: "support", Permissions: []string{}},
+		},
+	}
+	mails := &mockMailer{}
+	keys := NewHMACKeySet("secret")
+	return serviceTest{NewService(cfg, keys, revocations, lockouts, mails, logger, repo), repo, revocations, lockouts, mails, keys}
+}
+
+func TestServiceLogin(t *testing.T) {
+	s := createNewServiceTest(t)
+
+	token, err := s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.AccessToken)
+	assert.NotEmpty(t, token.RefreshToken)
+
+	_, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "wrong"})
+	assert.Error(t, err)
+}
+
+func TestServiceLoginRehash(t *testing.T) {
+	s := createNewServiceTest(t)
+	weak, err := password.New(password.Config{Algorithm: password.Bcrypt, BcryptCost: 4})
+	assert.NoError(t, err)
+	hashedPwd, err := weak.Hash([]byte("secret"))
+	assert.NoError(t, err)
+	s.repo.users[0].Password = hashedPwd
+
+	_, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, hashedPwd, s.repo.users[0].Password)
+	assert.False(t, password.NeedsRehash(s.repo.users[0].Password))
+	assert.True(t, password.ComparePasswords(s.repo.users[0].Password, []byte("secret")))
+}
+
+func TestServiceRefresh(t *testing.T) {
+	s := createNewServiceTest(t)
+
+	token, err := s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+
+	rotated, err := s.Refresh(context.Background(), RefreshRequest{RefreshToken: token.RefreshToken})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rotated.AccessToken)
+	assert.NotEqual(t, token.RefreshToken, rotated.RefreshToken)
+
+	// reusing a rotated refresh token revokes the whole family
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: token.RefreshToken})
+	assert.Error(t, err)
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: rotated.RefreshToken})
+	assert.Error(t, err)
+	for _, refreshToken := range s.repo.refreshTokens {
+		assert.NotNil(t, refreshToken.RevokedAt)
+	}
+
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: "unknown"})
+	assert.Error(t, err)
+}
+
+func TestServiceLogout(t *testing.T) {
+	s := createNewServiceTest(t)
+	verifier := NewVerifier(s.keys, s.revocations)
+
+	token, err := s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	jwtToken, err := verifier.Verify(context.Background(), token.AccessToken)
+	assert.NoError(t, err)
+
+	claims := jwtToken.Claims.(jwt.MapClaims)
+	err = s.Logout(context.Background(), claims["id"].(string), claims["jti"].(string), claims["sid"].(string), time.Now().Add(time.Hour), LogoutRequest{
+		RefreshToken: token.RefreshToken,
+	})
+	assert.NoError(t, err)
+
+	_, err = verifier.Verify(context.Background(), token.AccessToken)
+	assert.Error(t, err)
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: token.RefreshToken})
+	assert.Error(t, err)
+
+	// tokens issued after logout are still valid
+	token, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	_, err = verifier.Verify(context.Background(), token.AccessToken)
+	assert.NoError(t, err)
+
+	// revoking sessions invalidates every token issued so far
+	assert.NoError(t, s.RevokeSessions(context.Background(), s.repo.users[0].ID))
+	_, err = verifier.Verify(context.Background(), token.AccessToken)
+	assert.Error(t, err)
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: token.RefreshToken})
+	assert.Error(t, err)
+}
+
+func TestServiceResetPassword(t *testing.T) {
+	s := createNewServiceTest(t)
+
+	// unknown emails are silently ignored
+	err := s.ForgotPassword(context.Background(), ForgotPasswordRequest{Email: "unknown@admin.com"})
+	assert.NoError(t, err)
+	assert.Empty(t, s.mailer.messages)
+
+	err = s.ForgotPassword(context.Background(), ForgotPasswordRequest{Email: "super@admin.com"})
+	assert.NoError(t, err)
+	assert.Len(t, s.mailer.messages, 1)
+	assert.Contains(t, s.mailer.messages[0].Body, "http://localhost:8080/password/reset?token=")
+	token := tokenFromMessage(t, s.mailer.messages[0])
+
+	// passwords refused by the policy do not use up the token
+	err = s.ResetPassword(context.Background(), ResetPasswordRequest{Token: token, Password: "short"})
+	assert.Error(t, err)
+	password.SetPolicy(password.Policy{MinLength: 8, History: 1})
+	err = s.ResetPassword(context.Background(), ResetPasswordRequest{Token: token, Password: "secret super"})
+	assert.Error(t, err, "password must not contain the email address")
+	err = s.ResetPassword(context.Background(), ResetPasswordRequest{Token: token, Password: "secretsecret"})
+	assert.NoError(t, err)
+	password.SetPolicy(password.DefaultPolicy())
+	assert.Len(t, s.repo.passwordHistory[s.repo.users[0].ID], 1)
+	err = s.ForgotPassword(context.Background(), ForgotPasswordRequest{Email: "super@admin.com"})
+	assert.NoError(t, err)
+	token = tokenFromMessage(t, s.mailer.messages[1])
+
+	err = s.ResetPassword(context.Background(), ResetPasswordRequest{Token: token, Password: "new secret"})
+	assert.NoError(t, err)
+
+	// reset tokens are single-use
+	err = s.ResetPassword(context.Background(), ResetPasswordRequest{Token: token, Password: "other secret"})
+	assert.Error(t, err)
+
+	_, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.Error(t, err)
+	_, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "new secret"})
+	assert.NoError(t, err)
+}
+
+func TestServiceVerifyEmail(t *testing.T) {
+	s := createNewServiceTestWithConfig(t, func(cfg *config.Config) {
+		cfg.Auth.RequireEmailVerification = true
+	})
+
+	_, err := s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.Error(t, err)
+
+	err = s.SendVerification(context.Background(), s.repo.users[0])
+	assert.NoError(t, err)
+	assert.Len(t, s.mailer.messages, 1)
+	token := tokenFromMessage(t, s.mailer.messages[0])
+
+	assert.NoError(t, s.VerifyEmail(context.Background(), token))
+	assert.Error(t, s.VerifyEmail(context.Background(), token))
+	assert.True(t, s.repo.users[0].IsEmailVerified())
+
+	_, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+
+	// verified users do not get new links
+	err = s.ResendVerification(context.Background(), ResendVerificationRequest{Email: "super@admin.com"})
+	assert.NoError(t, err)
+	assert.Len(t, s.mailer.messages, 1)
+}
+
+func TestServiceSetRolePermissions(t *testing.T) {
+	s := createNewServiceTest(t)
+	RegisterPermissions(Permission{Name: "tests:read"})
+
+	role, err := s.SetRolePermissions(context.Background(), s.repo.roles[0].ID, SetRolePermissionsRequest{
+		Permissions: []string{"tests:read", "tests:read"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tests:read"}, role.Permissions)
+
+	_, err = s.SetRolePermissions(context.Background(), s.repo.roles[0].ID, SetRolePermissionsRequest{
+		Permissions: []string{"tests:unknown"},
+	})
+	assert.Error(t, err)
+
+	permissions, err := s.repo.GetPermissions(context.Background(), []string{"support"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tests:read"}, permissions)
+}
+
+func TestServiceMFA(t *testing.T) {
+	s := createNewServiceTestWithConfig(t, func(cfg *config.Config) {
+		cfg.Auth.MFAIssuer = "gorengan"
+		cfg.Auth.MFATokenExpiration = 5
+	})
+	userID := s.repo.users[0].ID
+
+	enrollment, err := s.EnrollMFA(context.Background(), userID)
+	assert.NoError(t, err)
+	assert.Contains(t, enrollment.ProvisioningURI, "otpauth://totp/")
+	assert.Len(t, enrollment.RecoveryCodes, recoveryCodeCount)
+
+	// the enrollment is not enforced before it is confirmed
+	token, err := s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	assert.False(t, token.MFARequired)
+
+	assert.Error(t, s.ConfirmMFA(context.Background(), userID, MFACodeRequest{Code: "000000"}))
+	code, err := totp.Code(enrollment.Secret, time.Now())
+	assert.NoError(t, err)
+	assert.NoError(t, s.ConfirmMFA(context.Background(), userID, MFACodeRequest{Code: code}))
+	_, err = s.EnrollMFA(context.Background(), userID)
+	assert.Error(t, err)
+
+	token, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	assert.True(t, token.MFARequired)
+	assert.Empty(t, token.AccessToken)
+
+	// the mfa_pending token is not an access token
+	_, err = NewVerifier(s.keys, s.revocations).Verify(context.Background(), token.MFAToken)
+	assert.Error(t, err)
+
+	// a code cannot be replayed, and a failed attempt burns the mfa_pending token
+	_, err = s.LoginMFA(context.Background(), LoginMFARequest{MFAToken: token.MFAToken, Code: code})
+	assert.Error(t, err)
+	code, err = totp.Code(enrollment.Secret, time.Now().Add(30*time.Second))
+	assert.NoError(t, err)
+	_, err = s.LoginMFA(context.Background(), LoginMFARequest{MFAToken: token.MFAToken, Code: code})
+	assert.Error(t, err)
+
+	token, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	token, err = s.LoginMFA(context.Background(), LoginMFARequest{MFAToken: token.MFAToken, Code: code})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.AccessToken)
+	assert.NotEmpty(t, token.RefreshToken)
+
+	// recovery codes are single-use
+	token, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	recoveryCode := strings.ToUpper(enrollment.RecoveryCodes[0])
+	_, err = s.LoginMFA(context.Background(), LoginMFARequest{MFAToken: token.MFAToken, Code: recoveryCode})
+	assert.NoError(t, err)
+	assert.Error(t, s.DisableMFA(context.Background(), userID, MFACodeRequest{Code: recoveryCode}))
+
+	assert.NoError(t, s.DisableMFA(context.Background(), userID, MFACodeRequest{Code: enrollment.RecoveryCodes[1]}))
+	token, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	assert.False(t, token.MFARequired)
+}
+
+func TestServiceLockout(t *testing.T) {
+	s := createNewServiceTestWithConfig(t, func(cfg *config.Config) {
+		cfg.Auth.LockoutThreshold = 3
+		cfg.Auth.LockoutIPThreshold = 5
+		cfg.Auth.LockoutWindow = 15
+		cfg.Auth.LockoutDuration = 1
+		cfg.Auth.LockoutMaxDuration = 60
+	})
+	login := func(email, pwd, ip string) error {
+		_, err := s.Login(context.Background(), LoginRequest{Email: email, Password: pwd, ClientInfo: ClientInfo{IP: ip}})
+		return err
+	}
+
+	// a successful login resets the counter of the email address
+	assert.Error(t, login("super@admin.com", "wrong", "10.0.0.1"))
+	assert.Error(t, login("super@admin.com", "wrong", "10.0.0.1"))
+	assert.NoError(t, login("super@admin.com", "secret", "10.0.0.1"))
+
+	for i := 0; i < 3; i++ {
+		assert.Error(t, login("super@admin.com", "wrong", "10.0.0.2"))
+	}
+	err := login("super@admin.com", "secret", "10.0.0.3")
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusTooManyRequests, err.(httperror.ErrorResponse).Status)
+	}
+	attempts, err := s.lockouts.Get(context.Background(), emailLockoutKey("super@admin.com"))
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), attempts.LockedUntil, time.Second)
+
+	assert.NoError(t, s.Unlock(context.Background(), s.repo.users[0].ID))
+	assert.NoError(t, login("super@admin.com", "secret", "10.0.0.3"))
+
+	// the IP address is locked regardless of the email addresses tried
+	for i := 0; i < 5; i++ {
+		assert.Error(t, login(fmt.Sprintf("user%v@example.com", i), "wrong", "10.0.0.4"))
+	}
+	assert.Error(t, login("super@admin.com", "secret", "10.0.0.4"))
+	assert.NoError(t, login("super@admin.com", "secret", "10.0.0.5"))
+}
+
+func TestLockoutDuration(t *testing.T) {
+	assert.Equal(t, time.Minute, lockoutDuration(0, time.Minute, time.Hour))
+	assert.Equal(t, 8*time.Minute, lockoutDuration(3, time.Minute, time.Hour))
+	assert.Equal(t, time.Hour, lockoutDuration(10, time.Minute, time.Hour))
+	assert.Equal(t, time.Hour, lockoutDuration(100, time.Minute, time.Hour))
+}
+
+func TestServiceAPIKeys(t *testing.T) {
+	s := createNewServiceTest(t)
+	userID := s.repo.users[0].ID
+	RegisterPermissions(Permission{Name: "tests:read"}, Permission{Name: "tests:write"})
+
+	_, err := s.CreateAPIKey(context.Background(), userID, CreateAPIKeyRequest{Name: "ci", Scopes: []string{"tests:unknown"}})
+	assert.Error(t, err)
+	past := time.Now().Add(-time.Hour)
+	_, err = s.CreateAPIKey(context.Background(), userID, CreateAPIKeyRequest{Name: "ci", ExpiresAt: &past})
+	assert.Error(t, err)
+
+	key, err := s.CreateAPIKey(context.Background(), userID, CreateAPIKeyRequest{Name: "ci", Scopes: []string{"tests:read"}})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key.Key, key.Prefix))
+	assert.NotEqual(t, key.Key, s.repo.apiKeys[0].KeyHash)
+
+	principal, err := s.VerifyAPIKey(context.Background(), key.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, userID, principal.ID)
+	assert.Equal(t, key.ID, principal.APIKeyID)
+	assert.Equal(t, []string{"tests:read"}, principal.Scopes)
+	assert.NotNil(t, s.repo.apiKeys[0].LastUsedAt)
+	_, err = s.VerifyAPIKey(context.Background(), key.Key+"x")
+	assert.Equal(t, errInvalidAPIKey, err)
+	_, err = s.VerifyAPIKey(context.Background(), "malformed")
+	assert.Equal(t, errInvalidAPIKey, err)
+
+	// scopes restrict the key even though its owner is an admin
+	e := echo.New()
+	handler := IsAuthenticated(NewVerifier(s.keys, s.revocations), s)(
+		RequirePermission(s.repo, "tests:read")(func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}),
+	)
+	denied := IsAuthenticated(NewVerifier(s.keys, s.revocations), s)(
+		RequirePermission(s.repo, "tests:write")(func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}),
+	)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderAuthorization, "ApiKey "+key.Key)
+	assert.NoError(t, handler(e.NewContext(req, httptest.NewRecorder())))
+	assert.Error(t, denied(e.NewContext(req, httptest.NewRecorder())))
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", key.Key)
+	assert.NoError(t, handler(e.NewContext(req, httptest.NewRecorder())))
+
+	// keys created with a restricted token cannot be granted more scopes than the token
+	reporting := WithPrincipal(context.Background(), Principal{ID: userID, Roles: []string{domain.RoleAdmin}, Scopes: []string{"tests:read", PermissionCredentialsWrite}})
+	_, err = s.CreateAPIKey(reporting, userID, CreateAPIKeyRequest{Name: "ci"})
+	assert.Error(t, err)
+	_, err = s.CreateAPIKey(reporting, userID, CreateAPIKeyRequest{Name: "ci", Scopes: []string{"tests:read", "tests:write"}})
+	assert.Error(t, err)
+	_, err = s.CreateAPIKey(reporting, userID, CreateAPIKeyRequest{Name: "ci", Scopes: []string{"tests:read"}})
+	assert.NoError(t, err)
+	// tokens carrying every scope granted to the user may create unrestricted keys
+	login, err := s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	_, err = s.CreateAPIKey(WithPrincipal(context.Background(), Principal{ID: userID, Roles: []string{domain.RoleAdmin}, Scopes: strings.Fields(login.Scope)}), userID, CreateAPIKeyRequest{Name: "ci"})
+	assert.NoError(t, err)
+
+	keys, err := s.QueryAPIKeys(context.Background(), userID)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+	assert.Error(t, s.RevokeAPIKey(context.Background(), domain.GenerateID(), key.ID))
+	assert.NoError(t, s.RevokeAPIKey(context.Background(), userID, key.ID))
+	_, err = s.VerifyAPIKey(context.Background(), key.Key)
+	assert.Equal(t, errInvalidAPIKey, err)
+	assert.Equal(t, errInvalidAPIKey, handler(e.NewContext(req, httptest.NewRecorder())))
+
+	// failing to look the key up is not reported as an invalid key
+	failure := errors.New("connection refused")
+	handler = IsAuthenticated(NewVerifier(s.keys, s.revocations), failingAPIKeys{failure})(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	assert.Equal(t, failure, handler(e.NewContext(req, httptest.NewRecorder())))
+}
+
+// failingAPIKeys is an APIKeyVerifier failing with the given error.
+type failingAPIKeys struct {
+	err error
+}
+
+// VerifyAPIKey returns the error of the verifier.
+func (f failingAPIKeys) VerifyAPIKey(ctx context.Context, key string) (Principal, error) {
+	return Principal{}, f.err
+}
+
+func TestServiceOIDC(t *testing.T) {
+	stub := oidctest.NewProvider("gorengan", "secret")
+	defer stub.Close()
+	s := createNewServiceTestWithConfig(t, func(cfg *config.Config) {
+		cfg.OIDC.Issuer = stub.URL
+		cfg.OIDC.ClientID = stub.ClientID
+		cfg.OIDC.ClientSecret = stub.ClientSecret
+		cfg.OIDC.Scopes = "email profile"
+		cfg.OIDC.AllowSignup = true
+	})
+	login := func(claims map[string]interface{}) (Token, error) {
+		authorization, err := s.StartOIDCLogin(context.Background())
+		assert.NoError(t, err)
+		assert.Contains(t, authorization.URL, "redirect_uri="+url.QueryEscape("http://localhost:3000/login/oidc/callback"))
+		code, state, err := stub.Authorize(authorization.URL, claims)
+		assert.NoError(t, err)
+		return s.OIDCCallback(context.Background(), OIDCCallbackRequest{Code: code, State: state, Session: authorization.Session})
+	}
+
+	// the state must match the session
+	authorization, err := s.StartOIDCLogin(context.Background())
+	assert.NoError(t, err)
+	code, _, err := stub.Authorize(authorization.URL, map[string]interface{}{"sub": "1"})
+	assert.NoError(t, err)
+	_, err = s.OIDCCallback(context.Background(), OIDCCallbackRequest{Code: code, State: "forged", Session: authorization.Session})
+	assert.Error(t, err)
+	// the session is not an access token
+	_, err = NewVerifier(s.keys, s.revocations).Verify(context.Background(), authorization.Session)
+	assert.Error(t, err)
+
+	// unverified email addresses are neither linked nor used to sign up
+	_, err = login(map[string]interface{}{"sub": "1", "email": "super@admin.com", "email_verified": false})
+	assert.Error(t, err)
+	assert.Empty(t, s.repo.identities)
+
+	// existing users are linked by verified email address
+	token, err := login(map[string]interface{}{"sub": "1", "email": "super@admin.com", "email_verified": true})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.AccessToken)
+	if assert.Len(t, s.repo.identities, 1) {
+		assert.Equal(t, s.repo.users[0].ID, s.repo.identities[0].UserID)
+	}
+	// later logins use the link even if the email address changed
+	_, err = login(map[string]interface{}{"sub": "1", "email": "super@example.com", "email_verified": true})
+	assert.NoError(t, err)
+	assert.Len(t, s.repo.identities, 1)
+
+	// unknown users are created
+	_, err = login(map[string]interface{}{"sub": "2", "email": "jane@example.com", "email_verified": true, "name": "Jane Doe"})
+	assert.NoError(t, err)
+	if assert.Len(t, s.repo.users, 2) {
+		assert.Equal(t, "Jane", s.repo.users[1].FirstName)
+		assert.Equal(t, "Doe", s.repo.users[1].LastName)
+		assert.Equal(t, []string{domain.RoleUser}, s.repo.users[1].Roles)
+		assert.True(t, s.repo.users[1].IsEmailVerified())
+	}
+}
+
+func TestServiceOIDCNotConfigured(t *testing.T) {
+	s := createNewServiceTest(t)
+	_, err := s.StartOIDCLogin(context.Background())
+	assert.Error(t, err)
+}
+
+func TestServiceOAuth(t *testing.T) {
+	s := createNewServiceTest(t)
+	RegisterPermissions(Permission{Name: "tests:read"}, Permission{Name: "tests:write"})
+
+	_, err := s.CreateOAuthClient(context.Background(), CreateOAuthClientRequest{Name: "reports", GrantTypes: []string{"password"}})
+	assert.Error(t, err)
+	client, err := s.CreateOAuthClient(context.Background(), CreateOAuthClientRequest{
+		Name:       "reports",
+		Scopes:     []string{"tests:read", "tests:write"},
+		GrantTypes: []string{domain.GrantTypeClientCredentials, domain.GrantTypeRefreshToken},
+	})
+	assert.NoError(t, err)
+	credentials := ClientCredentials{ClientID: client.ID, ClientSecret: client.ClientSecret}
+
+	// client authentication and grant validation
+	_, err = s.OAuthToken(context.Background(), OAuthTokenRequest{
+		ClientCredentials: ClientCredentials{ClientID: client.ID, ClientSecret: "wrong"},
+		GrantType:         domain.GrantTypeClientCredentials,
+	})
+	assert.Equal(t, "invalid_client", err.(OAuthError).Code)
+	_, err = s.OAuthToken(context.Background(), OAuthTokenRequest{ClientCredentials: credentials, GrantType: "password"})
+	assert.Equal(t, "unsupported_grant_type", err.(OAuthError).Code)
+	_, err = s.OAuthToken(context.Background(), OAuthTokenRequest{ClientCredentials: credentials, GrantType: domain.GrantTypeClientCredentials, Scope: "roles:write"})
+	assert.Equal(t, "invalid_scope", err.(OAuthError).Code)
+
+	token, err := s.OAuthToken(context.Background(), OAuthTokenRequest{ClientCredentials: credentials, GrantType: domain.GrantTypeClientCredentials, Scope: "tests:read"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer", token.TokenType)
+	assert.Equal(t, "tests:read", token.Scope)
+	assert.Empty(t, token.RefreshToken)
+
+	// client tokens are granted their scopes only
+	e := echo.New()
+	verifier := NewVerifier(s.keys, s.revocations)
+	request := func(permission string) error {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token.AccessToken)
+		return IsLoggedIn(verifier)(RequirePermission(s.repo, permission)(func(c echo.Context) error {
+			return c.NoContent(http.StatusOK)
+		}))(e.NewContext(req, httptest.NewRecorder()))
+	}
+	assert.NoError(t, request("tests:read"))
+	assert.Error(t, request("tests:write"))
+
+	introspection, err := s.Introspect(context.Background(), TokenRequest{ClientCredentials: credentials, Token: token.AccessToken})
+	assert.NoError(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, client.ID, introspection.ClientID)
+	assert.Equal(t, "tests:read", introspection.Scope)
+
+	assert.NoError(t, s.RevokeToken(context.Background(), TokenRequest{ClientCredentials: credentials, Token: token.AccessToken}))
+	introspection, err = s.Introspect(context.Background(), TokenRequest{ClientCredentials: credentials, Token: token.AccessToken})
+	assert.NoError(t, err)
+	assert.False(t, introspection.Active)
+	assert.Error(t, request("tests:read"))
+
+	// refresh tokens issued on login cannot be used by clients
+	login, err := s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	introspection, err = s.Introspect(context.Background(), TokenRequest{ClientCredentials: credentials, Token: login.RefreshToken, TokenTypeHint: "refresh_token"})
+	assert.NoError(t, err)
+	assert.False(t, introspection.Active)
+	introspection, err = s.Introspect(context.Background(), TokenRequest{ClientCredentials: credentials, Token: login.AccessToken})
+	assert.NoError(t, err)
+	assert.False(t, introspection.Active)
+	_, err = s.OAuthToken(context.Background(), OAuthTokenRequest{ClientCredentials: credentials, GrantType: domain.GrantTypeRefreshToken, RefreshToken: login.RefreshToken})
+	assert.Equal(t, "invalid_grant", err.(OAuthError).Code)
+	assert.NoError(t, s.RevokeToken(context.Background(), TokenRequest{ClientCredentials: credentials, Token: login.RefreshToken}))
+	login, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: login.RefreshToken})
+	assert.NoError(t, err)
+
+	// refresh tokens issued to the client can be exchanged and revoked by that client only
+	loginToken, err := s.repo.GetRefreshToken(context.Background(), hashToken(login.RefreshToken))
+	assert.NoError(t, err)
+	issued := Token{RefreshToken: "client-refresh-token"}
+	assert.NoError(t, s.repo.CreateRefreshToken(context.Background(), domain.RefreshToken{
+		ID:        domain.GenerateID(),
+		UserID:    loginToken.UserID,
+		FamilyID:  loginToken.FamilyID,
+		ClientID:  client.ID,
+		TokenHash: hashToken(issued.RefreshToken),
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+	}))
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: issued.RefreshToken})
+	assert.Error(t, err)
+	introspection, err = s.Introspect(context.Background(), TokenRequest{ClientCredentials: credentials, Token: issued.RefreshToken, TokenTypeHint: "refresh_token"})
+	assert.NoError(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, client.ID, introspection.ClientID)
+	refreshed, err := s.OAuthToken(context.Background(), OAuthTokenRequest{ClientCredentials: credentials, GrantType: domain.GrantTypeRefreshToken, RefreshToken: issued.RefreshToken})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, refreshed.RefreshToken)
+	introspection, err = s.Introspect(context.Background(), TokenRequest{ClientCredentials: credentials, Token: refreshed.AccessToken})
+	assert.NoError(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, client.ID, introspection.ClientID)
+	assert.NoError(t, s.RevokeToken(context.Background(), TokenRequest{ClientCredentials: credentials, Token: refreshed.RefreshToken}))
+	_, err = s.OAuthToken(context.Background(), OAuthTokenRequest{ClientCredentials: credentials, GrantType: domain.GrantTypeRefreshToken, RefreshToken: refreshed.RefreshToken})
+	assert.Equal(t, "invalid_grant", err.(OAuthError).Code)
+
+	assert.NoError(t, s.DeleteOAuthClient(context.Background(), client.ID))
+	_, err = s.OAuthToken(context.Background(), OAuthTokenRequest{ClientCredentials: credentials, GrantType: domain.GrantTypeClientCredentials})
+	assert.Error(t, err)
+}
+
+func TestServiceSessions(t *testing.T) {
+	s := createNewServiceTest(t)
+	userID := s.repo.users[0].ID
+	verifier := NewVerifier(s.keys, s.revocations)
+	login := func(userAgent string) (Token, string) {
+		token, err := s.Login(context.Background(), LoginRequest{
+			Email:      "super@admin.com",
+			Password:   "secret",
+			ClientInfo: ClientInfo{IP: "10.0.0.1", UserAgent: userAgent},
+		})
+		assert.NoError(t, err)
+		jwtToken, err := verifier.Verify(context.Background(), token.AccessToken)
+		assert.NoError(t, err)
+		return token, jwtToken.Claims.(jwt.MapClaims)["sid"].(string)
+	}
+
+	laptop, laptopID := login("laptop")
+	phone, phoneID := login("phone")
+	sessions, err := s.QuerySessions(context.Background(), userID, phoneID)
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 2) {
+		assert.Equal(t, "phone", sessions[0].UserAgent)
+		assert.True(t, sessions[0].Current)
+		assert.Equal(t, "10.0.0.1", sessions[1].IP)
+		assert.False(t, sessions[1].Current)
+	}
+
+	// refreshing keeps the session
+	refreshed, err := s.Refresh(context.Background(), RefreshRequest{RefreshToken: laptop.RefreshToken})
+	assert.NoError(t, err)
+	jwtToken, err := verifier.Verify(context.Background(), refreshed.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, laptopID, jwtToken.Claims.(jwt.MapClaims)["sid"])
+
+	// sessions of other users cannot be terminated
+	assert.Error(t, s.TerminateSession(context.Background(), domain.GenerateID(), laptopID))
+	assert.NoError(t, s.TerminateSession(context.Background(), userID, laptopID))
+	_, err = verifier.Verify(context.Background(), refreshed.AccessToken)
+	assert.Error(t, err)
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: refreshed.RefreshToken})
+	assert.Error(t, err)
+	_, err = verifier.Verify(context.Background(), phone.AccessToken)
+	assert.NoError(t, err)
+
+	sessions, err = s.QuerySessions(context.Background(), userID, phoneID)
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	// revoking the other sessions keeps the current one
+	tablet, _ := login("tablet")
+	assert.NoError(t, s.RevokeOtherSessions(context.Background(), userID, phoneID))
+	_, err = verifier.Verify(context.Background(), tablet.AccessToken)
+	assert.Error(t, err)
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: tablet.RefreshToken})
+	assert.Error(t, err)
+	_, err = verifier.Verify(context.Background(), phone.AccessToken)
+	assert.NoError(t, err)
+	_, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: phone.RefreshToken})
+	assert.NoError(t, err)
+}
+
+func TestServiceImpersonate(t *testing.T) {
+	s := createNewServiceTestWithConfig(t, func(cfg *config.Config) {
+		cfg.Auth.ImpersonationExpiration = 5
+		cfg.Auth.ImpersonationScopes = "tests:read"
+	})
+	admin := s.repo.users[0]
+	user := domain.User{ID: domain.GenerateID(), Email: "jane@doe.com", Roles: []string{domain.RoleUser}}
+	s.repo.users = append(s.repo.users, user)
+	req := ImpersonateRequest{Reason: "reproduce ticket 42", ClientInfo: ClientInfo{IP: "10.0.0.1"}}
+
+	_, err := s.Impersonate(context.Background(), admin.ID, user.ID, ImpersonateRequest{})
+	assert.Error(t, err)
+	_, err = s.Impersonate(context.Background(), admin.ID, admin.ID, req)
+	assert.Error(t, err)
+	_, err = s.Impersonate(context.Background(), admin.ID, domain.GenerateID(), req)
+	assert.Error(t, err)
+	assert.Empty(t, s.repo.auditLogs)
+
+	token, err := s.Impersonate(context.Background(), admin.ID, user.ID, req)
+	assert.NoError(t, err)
+	assert.Empty(t, token.RefreshToken)
+	assert.Equal(t, 300, token.ExpiresIn)
+	if assert.Len(t, s.repo.auditLogs, 1) {
+		entry := s.repo.auditLogs[0]
+		assert.Equal(t, domain.AuditActionImpersonate, entry.Action)
+		assert.Equal(t, admin.ID, entry.ActorID)
+		assert.Equal(t, user.ID, entry.TargetID)
+		assert.Equal(t, req.Reason, entry.Details)
+		assert.Equal(t, "10.0.0.1", entry.IP)
+	}
+
+	// the effective and the real user are both available to handlers
+	e := echo.New()
+	var effectiveID, realID string
+	handler := IsLoggedIn(NewVerifier(s.keys, s.revocations))(func(c echo.Context) error {
+		principal, _ := CurrentPrincipal(c.Request().Context())
+		effectiveID, realID = principal.ID, principal.RealID()
+		return c.NoContent(http.StatusOK)
+	})
+	httpReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	httpReq.Header.Set(echo.HeaderAuthorization, "Bearer "+token.AccessToken)
+	assert.NoError(t, handler(e.NewContext(httpReq, httptest.NewRecorder())))
+	assert.Equal(t, user.ID, effectiveID)
+	assert.Equal(t, admin.ID, realID)
+
+	// impersonation tokens are restricted to the impersonation scopes
+	RegisterPermissions(Permission{Name: "tests:read"}, Permission{Name: "tests:write"})
+	s.repo.roles = append(s.repo.roles, domain.Role{ID: domain.GenerateID(), Name: domain.RoleUser, Permissions: []string{"tests:read", "tests:write"}})
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	isLoggedIn := IsLoggedIn(NewVerifier(s.keys, s.revocations))
+	assert.NoError(t, isLoggedIn(RequirePermission(s.repo, "tests:read")(ok))(e.NewContext(httpReq, httptest.NewRecorder())))
+	assert.Error(t, isLoggedIn(RequirePermission(s.repo, "tests:write")(ok))(e.NewContext(httpReq, httptest.NewRecorder())))
+	assert.Error(t, isLoggedIn(RejectImpersonation()(ok))(e.NewContext(httpReq, httptest.NewRecorder())))
+
+	// administrators cannot be impersonated
+	other := domain.User{ID: domain.GenerateID(), Email: "other@admin.com", Roles: []string{domain.RoleAdmin}}
+	s.repo.users = append(s.repo.users, other)
+	_, err = s.Impersonate(context.Background(), admin.ID, other.ID, req)
+	assert.Error(t, err)
+}
+
+func TestServiceLoginScopes(t *testing.T) {
+	s := createNewServiceTest(t)
+	RegisterPermissions(Permission{Name: "tests:read"}, Permission{Name: "tests:write"}, Permission{Name: PermissionUsersImpersonate})
+	hashedPwd, err := password.HashAndSalt([]byte("secret"))
+	assert.NoError(t, err)
+	user := domain.User{ID: domain.GenerateID(), Email: "jane@doe.com", Password: hashedPwd, Roles: []string{"reporter"}}
+	s.repo.users = append(s.repo.users, user)
+	s.repo.roles = append(s.repo.roles, domain.Role{ID: domain.GenerateID(), Name: "reporter", Permissions: []string{"tests:read"}})
+	verifier := NewVerifier(s.keys, s.revocations)
+	scopes := func(token Token) []string {
+		jwtToken, err := verifier.Verify(context.Background(), token.AccessToken)
+		assert.NoError(t, err)
+		return principalFromClaims(jwtToken.Claims.(jwt.MapClaims)).Scopes
+	}
+
+	// tokens carry every permission granted to the user unless a narrower scope is requested
+	token, err := s.Login(context.Background(), LoginRequest{Email: "jane@doe.com", Password: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tests:read", PermissionCredentialsWrite}, scopes(token))
+	assert.Equal(t, "tests:read "+PermissionCredentialsWrite, token.Scope)
+	token, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret"})
+	assert.NoError(t, err)
+	assert.Contains(t, scopes(token), "tests:write")
+	assert.Contains(t, scopes(token), PermissionUsersImpersonate)
+
+	// requested scopes are intersected with the permissions of the user
+	token, err = s.Login(context.Background(), LoginRequest{Email: "jane@doe.com", Password: "secret", Scopes: []string{"tests:read", "tests:write"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tests:read"}, scopes(token))
+	_, err = s.Login(context.Background(), LoginRequest{Email: "jane@doe.com", Password: "secret", Scopes: []string{"tests:write"}})
+	assert.Error(t, err)
+
+	// a reporting token of an administrator cannot reach admin endpoints
+	token, err = s.Login(context.Background(), LoginRequest{Email: "super@admin.com", Password: "secret", Scopes: []string{"tests:read"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tests:read"}, scopes(token))
+	e := echo.New()
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	httpReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	httpReq.Header.Set(echo.HeaderAuthorization, "Bearer "+token.AccessToken)
+	isLoggedIn := IsLoggedIn(verifier)
+	assert.NoError(t, isLoggedIn(RequireScopes("tests:read")(ok))(e.NewContext(httpReq, httptest.NewRecorder())))
+	assert.Error(t, isLoggedIn(RequireScopes(PermissionUsersImpersonate)(ok))(e.NewContext(httpReq, httptest.NewRecorder())))
+	assert.Error(t, isLoggedIn(RequireScopes(PermissionCredentialsWrite)(ok))(e.NewContext(httpReq, httptest.NewRecorder())))
+	assert.Error(t, isLoggedIn(RequirePermission(s.repo, "tests:write")(ok))(e.NewContext(httpReq, httptest.NewRecorder())))
+
+	// the scopes of the session are kept when the token is refreshed
+	token, err = s.Refresh(context.Background(), RefreshRequest{RefreshToken: token.RefreshToken})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tests:read"}, scopes(token))
+}
+
+func TestRevocationStoreConsume(t *testing.T) {
+	revocations := NewMemoryRevocationStore()
+	expiresAt := time.Now().Add(time.Minute)
+
+	// tokens are consumed once only
+	consumed, err := revocations.Consume(context.Background(), "magic", expiresAt)
+	assert.NoError(t, err)
+	assert.True(t, consumed)
+	consumed, err = revocations.Consume(context.Background(), "magic", expiresAt)
+	assert.NoError(t, err)
+	assert.False(t, consumed)
+	revoked, err := revocations.IsRevoked(context.Background(), "magic", "", "", time.Now())
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+
+	assert.NoError(t, revocations.Revoke(context.Background(), "pending", expiresAt))
+	consumed, err = revocations.Consume(context.Background(), "pending", expiresAt)
+	assert.NoError(t, err)
+	assert.False(t, consumed)
+}
+
+func TestServiceMagicLink(t *testing.T) {
+	s := createNewServiceTestWithConfig(t, func(cfg *config.Config) {
+		cfg.Auth.MagicLinkExpiration = 10
+		cfg.Auth.MagicLinkLimit = 2
+		cfg.Auth.MagicLinkWindow = 60
+	})
+	req := MagicLinkCallbackRequest{ClientInfo: ClientInfo{IP: "10.0.0.1"}}
+
+	// unknown emails are silently ignored
+	err := s.SendMagicLink(context.Background(), MagicLinkRequest{Email: "unknown@admin.com"})
+	assert.NoError(t, err)
+	assert.Empty(t, s.mailer.messages)
+
+	err = s.SendMagicLink(context.Background(), MagicLinkRequest{Email: "super@admin.com"})
+	assert.NoError(t, err)
+	assert.Len(t, s.mailer.messages, 1)
+	req.Token = tokenFromMessage(t, s.mailer.messages[0])
+
+	// magic link tokens are not access tokens
+	_, err = NewVerifier(s.keys, s.revocations).Verify(context.Background(), req.Token)
+	assert.Error(t, err)
+
+	token, err := s.LoginMagicLink(context.Background(), req)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.AccessToken)
+	assert.NotEmpty(t, token.RefreshToken)
+	_, err = NewVerifier(s.keys, s.revocations).Verify(context.Background(), token.AccessToken)
+	assert.NoError(t, err)
+
+	// magic links are single-use
+	_, err = s.LoginMagicLink(context.Background(), req)
+	assert.Error(t, err)
+
+	// other tokens cannot be used as magic links
+	req.Token = token.AccessToken
+	_, err = s.LoginMagicLink(context.Background(), req)
+	assert.Error(t, err)
+
+	// requests are limited per email address
+	err = s.SendMagicLink(context.Background(), MagicLinkRequest{Email: "super@admin.com"})
+	assert.NoError(t, err)
+	err = s.SendMagicLink(context.Background(), MagicLinkRequest{Email: "Super@Admin.com"})
+	assert.Error(t, err)
+	assert.Len(t, s.mailer.messages, 2)
+	err = s.SendMagicLink(context.Background(), MagicLinkRequest{Email: "unknown@admin.com"})
+	assert.NoError(t, err)
+}
+
+// tokenFromMessage extracts the token query parameter of the link sent in a message.
+func tokenFromMessage(t *testing.T, msg mailer.Message) string {
+	for _, field := range strings.Fields(msg.Body) {
+		if u, err := url.Parse(field); err == nil && u.Query().Get("token") != "" {
+			return u.Query().Get("token")
+		}
+	}
+	t.Fatalf("no token found in message: %v", msg.Body)
+	return ""
+}
+
+type mockMailer struct {
+	messages []mailer.Message
+}
+
+// Send records the message.
+func (m *mockMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+type mockRepository struct {
+	users         []domain.User
+	roles         []domain.Role
+	refreshTokens []domain.RefreshToken
+	userTokens    []domain.UserToken
+	mfa           map[string]domain.MFA
+	recoveryCodes map[string]map[string]bool
+	apiKeys       []domain.APIKey
+	identities    []domain.ExternalIdentity
+	clients       []domain.OAuthClient
+	sessions      []domain.Session
+	auditLogs     []domain.AuditLog
+	// passwordHistory holds the hashes of previous passwords by user ID, most recent last
+	passwordHistory map[string][]string
+}
+
+// Login returns the user with the specified email along with the names of its roles.
+func (m *mockRepository) Login(ctx context.Context, email string) (domain.User, error) {
+	for _, user := range m.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return domain.User{}, sql.ErrNoRows
+}
+
+// GetUser returns the user with the specified ID along with the names of its roles.
+func (m *mockRepository) GetUser(ctx context.Context, id string) (domain.User, error) {
+	for _, user := range m.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return domain.User{}, sql.ErrNoRows
+}
+
+// GetPermissions returns the names of the permissions mapped to any of the given roles.
+func (m *mockRepository) GetPermissions(ctx context.Context, roles []string) ([]string, error) {
+	permissions := []string{}
+	for _, role := range m.roles {
+		if contains(roles, role.Name) {
+			permissions = append(permissions, role.Permissions...)
+		}
+	}
+	return permissions, nil
+}
+
+// GetRole returns the role with the specified ID along with its permissions.
+func (m *mockRepository) GetRole(ctx context.Context, id string) (domain.Role, error) {
+	for _, role := range m.roles {
+		if role.ID == id {
+			return role, nil
+		}
+	}
+	return domain.Role{}, sql.ErrNoRows
+}
+
+// QueryRoles returns all roles along with their permissions.
+func (m *mockRepository) QueryRoles(ctx context.Context) ([]domain.Role, error) {
+	return m.roles, nil
+}
+
+// SetRolePermissions replaces the permissions mapped to the role with given ID.
+func (m *mockRepository) SetRolePermissions(ctx context.Context, id string, permissions []string) error {
+	for i, role := range m.roles {
+		if role.ID == id {
+			m.roles[i].Permissions = permissions
+		}
+	}
+	return nil
+}
+
+// CreateRefreshToken saves a new refresh token in the storage.
+func (m *mockRepository) CreateRefreshToken(ctx context.Context, token domain.RefreshToken) error {
+	m.refreshTokens = append(m.refreshTokens, token)
+	return nil
+}
+
+// GetRefreshToken returns the refresh token with the specified hash.
+func (m *mockRepository) GetRefreshToken(ctx context.Context, hash string) (domain.RefreshToken, error) {
+	for _, token := range m.refreshTokens {
+		if token.TokenHash == hash {
+			return token, nil
+		}
+	}
+	return domain.RefreshToken{}, sql.ErrNoRows
+}
+
+// UseRefreshToken marks the refresh token with given ID as used.
+func (m *mockRepository) UseRefreshToken(ctx context.Context, id string, usedAt time.Time) (bool, error) {
+	for i, token := range m.refreshTokens {
+		if token.ID == id && token.UsedAt == nil {
+			m.refreshTokens[i].UsedAt = &usedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token of the given family.
+func (m *mockRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string, revokedAt time.Time) error {
+	for i, token := range m.refreshTokens {
+		if token.FamilyID == familyID && token.RevokedAt == nil {
+			m.refreshTokens[i].RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user with given ID.
+func (m *mockRepository) RevokeUserRefreshTokens(ctx context.Context, userID string, revokedAt time.Time) error {
+	for i, token := range m.refreshTokens {
+		if token.UserID == userID && token.RevokedAt == nil {
+			m.refreshTokens[i].RevokedAt = &revokedAt
+		}
+	}
+	return nil
+}
+
+// CreateUserToken saves a new user token in the storage.
+func (m *mockRepository) CreateUserToken(ctx context.Context, token domain.UserToken) error {
+	m.userTokens = append(m.userTokens, token)
+	return nil
+}
+
+// GetUserToken returns the user token with the specified purpose and hash.
+func (m *mockRepository) GetUserToken(ctx context.Context, purpose, hash string) (domain.UserToken, error) {
+	for _, token := range m.userTokens {
+		if token.Purpose == purpose && token.TokenHash == hash {
+			return token, nil
+		}
+	}
+	return domain.UserToken{}, sql.ErrNoRows
+}
+
+// UseUserToken marks the user token with given ID as used.
+func (m *mockRepository) UseUserToken(ctx context.Context, id string, usedAt time.Time) (bool, error) {
+	for i, token := range m.userTokens {
+		if token.ID == id && token.UsedAt == nil {
+			m.userTokens[i].UsedAt = &usedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// UpdatePassword updates the password hash of the user with given ID.
+func (m *mockRepository) UpdatePassword(ctx context.Context, userID, hash string) error {
+	for i, user := range m.users {
+		if user.ID == userID {
+			m.users[i].Password = hash
+		}
+	}
+	return nil
+}
+
+// VerifyEmail marks the email address of the user with given ID as verified.
+func (m *mockRepository) VerifyEmail(ctx context.Context, userID string, verifiedAt time.Time) error {
+	for i, user := range m.users {
+		if user.ID == userID {
+			m.users[i].EmailVerifiedAt = &verifiedAt
+		}
+	}
+	return nil
+}
+
+// GetMFA returns the two-factor authentication settings of the user with given ID.
+func (m *mockRepository) GetMFA(ctx context.Context, userID string) (domain.MFA, error) {
+	mfa, ok := m.mfa[userID]
+	if !ok {
+		return domain.MFA{}, sql.ErrNoRows
+	}
+	return mfa, nil
+}
+
+// SaveMFA creates or replaces the two-factor authentication settings of a user along with its recovery code hashes.
+func (m *mockRepository) SaveMFA(ctx context.Context, mfa domain.MFA, recoveryCodeHashes []string) error {
+	if m.mfa == nil {
+		m.mfa = map[string]domain.MFA{}
+		m.recoveryCodes = map[string]map[string]bool{}
+	}
+	m.mfa[mfa.UserID] = mfa
+	m.recoveryCodes[mfa.UserID] = map[string]bool{}
+	for _, hash := range recoveryCodeHashes {
+		m.recoveryCodes[mfa.UserID][hash] = false
+	}
+	return nil
+}
+
+// EnableMFA marks the two-factor authentication settings of the user with given ID as confirmed.
+func (m *mockRepository) EnableMFA(ctx context.Context, userID string, enabledAt time.Time) error {
+	if mfa, ok := m.mfa[userID]; ok {
+		mfa.EnabledAt = &enabledAt
+		m.mfa[userID] = mfa
+	}
+	return nil
+}
+
+// DeleteMFA removes the two-factor authentication settings and recovery codes of the user with given ID.
+func (m *mockRepository) DeleteMFA(ctx context.Context, userID string) error {
+	delete(m.mfa, userID)
+	delete(m.recoveryCodes, userID)
+	return nil
+}
+
+// UseMFAStep records the TOTP time step used by the user with given ID.
+func (m *mockRepository) UseMFAStep(ctx context.Context, userID string, step int64) (bool, error) {
+	mfa, ok := m.mfa[userID]
+	if !ok || mfa.LastUsedStep >= step {
+		return false, nil
+	}
+	mfa.LastUsedStep = step
+	m.mfa[userID] = mfa
+	return true, nil
+}
+
+// UseRecoveryCode marks the recovery code with given hash of the user as used.
+func (m *mockRepository) UseRecoveryCode(ctx context.Context, userID, hash string, usedAt time.Time) (bool, error) {
+	used, ok := m.recoveryCodes[userID][hash]
+	if !ok || used {
+		return false, nil
+	}
+	m.recoveryCodes[userID][hash] = true
+	return true, nil
+}
+
+// CreateAPIKey saves a new API key in the storage.
+func (m *mockRepository) CreateAPIKey(ctx context.Context, key domain.APIKey) error {
+	m.apiKeys = append(m.apiKeys, key)
+	return nil
+}
+
+// GetAPIKey returns the API key with the specified hash.
+func (m *mockRepository) GetAPIKey(ctx context.Context, hash string) (domain.APIKey, error) {
+	for _, key := range m.apiKeys {
+		if key.KeyHash == hash {
+			return key, nil
+		}
+	}
+	return domain.APIKey{}, sql.ErrNoRows
+}
+
+// QueryAPIKeys returns the API keys of the user with given ID, newest first.
+func (m *mockRepository) QueryAPIKeys(ctx context.Context, userID string) ([]domain.APIKey, error) {
+	keys := []domain.APIKey{}
+	for i := len(m.apiKeys) - 1; i >= 0; i-- {
+		if m.apiKeys[i].UserID == userID {
+			keys = append(keys, m.apiKeys[i])
+		}
+	}
+	return keys, nil
+}
+
+// DeleteAPIKey deletes the API key with given ID of the user.
+func (m *mockRepository) DeleteAPIKey(ctx context.Context, userID, id string) (bool, error) {
+	for i, key := range m.apiKeys {
+		if key.ID == id && key.UserID == userID {
+			m.apiKeys = append(m.apiKeys[:i], m.apiKeys[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// TouchAPIKey records when the API key with given ID was last used.
+func (m *mockRepository) TouchAPIKey(ctx context.Context, id string, usedAt time.Time) error {
+	for i, key := range m.apiKeys {
+		if key.ID == id {
+			m.apiKeys[i].LastUsedAt = &usedAt
+		}
+	}
+	return nil
+}
+
+// GetExternalIdentity returns the external identity with the specified issuer and subject.
+func (m *mockRepository) GetExternalIdentity(ctx context.Context, issuer, subject string) (domain.ExternalIdentity, error) {
+	for _, identity := range m.identities {
+		if identity.Issuer == issuer && identity.Subject == subject {
+			return identity, nil
+		}
+	}
+	return domain.ExternalIdentity{}, sql.ErrNoRows
+}
+
+// CreateExternalIdentity links an existing user to an external identity.
+func (m *mockRepository) CreateExternalIdentity(ctx context.Context, identity domain.ExternalIdentity) error {
+	m.identities = append(m.identities, identity)
+	return nil
+}
+
+// CreateExternalUser creates a new user with the given roles, linked to an external identity.
+func (m *mockRepository) CreateExternalUser(ctx context.Context, user domain.User, identity domain.ExternalIdentity) error {
+	m.users = append(m.users, user)
+	identity.UserID = user.ID
+	m.identities = append(m.identities, identity)
+	return nil
+}
+
+// CreateOAuthClient saves a new OAuth client in the storage.
+func (m *mockRepository) CreateOAuthClient(ctx context.Context, client domain.OAuthClient) error {
+	m.clients = append(m.clients, client)
+	return nil
+}
+
+// GetOAuthClient returns the OAuth client with the specified ID.
+func (m *mockRepository) GetOAuthClient(ctx context.Context, id string) (domain.OAuthClient, error) {
+	for _, client := range m.clients {
+		if client.ID == id {
+			return client, nil
+		}
+	}
+	return domain.OAuthClient{}, sql.ErrNoRows
+}
+
+// QueryOAuthClients returns all OAuth clients.
+func (m *mockRepository) QueryOAuthClients(ctx context.Context) ([]domain.OAuthClient, error) {
+	return m.clients, nil
+}
+
+// DeleteOAuthClient deletes the OAuth client with the specified ID.
+func (m *mockRepository) DeleteOAuthClient(ctx context.Context, id string) error {
+	for i, client := range m.clients {
+		if client.ID == id {
+			m.clients = append(m.clients[:i], m.clients[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// CreateSession saves a new session in the storage.
+func (m *mockRepository) CreateSession(ctx context.Context, session domain.Session) error {
+	m.sessions = append(m.sessions, session)
+	return nil
+}
+
+// GetSession returns the session with the specified ID.
+func (m *mockRepository) GetSession(ctx context.Context, id string) (domain.Session, error) {
+	for _, session := range m.sessions {
+		if session.ID == id {
+			return session, nil
+		}
+	}
+	return domain.Session{}, sql.ErrNoRows
+}
+
+// QuerySessions returns the sessions of the user with given ID that have not been terminated
+// and were seen after the given time, most recently seen first.
+func (m *mockRepository) QuerySessions(ctx context.Context, userID string, seenAfter time.Time) ([]domain.Session, error) {
+	sessions := []domain.Session{}
+	for i := len(m.sessions) - 1; i >= 0; i-- {
+		session := m.sessions[i]
+		if session.UserID == userID && session.TerminatedAt == nil && session.LastSeenAt.After(seenAfter) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+// TouchSession records when the session with given ID was last seen.
+func (m *mockRepository) TouchSession(ctx context.Context, id string, seenAt time.Time) error {
+	for i, session := range m.sessions {
+		if session.ID == id {
+			m.sessions[i].LastSeenAt = seenAt
+		}
+	}
+	return nil
+}
+
+// TerminateSession marks the session with given ID as terminated.
+func (m *mockRepository) TerminateSession(ctx context.Context, id string, terminatedAt time.Time) error {
+	for i, session := range m.sessions {
+		if session.ID == id && session.TerminatedAt == nil {
+			m.sessions[i].TerminatedAt = &terminatedAt
+		}
+	}
+	return nil
+}
+
+// TerminateUserSessions marks every session of the user with given ID as terminated.
+func (m *mockRepository) TerminateUserSessions(ctx context.Context, userID string, terminatedAt time.Time) error {
+	for i, session := range m.sessions {
+		if session.UserID == userID && session.TerminatedAt == nil {
+			m.sessions[i].TerminatedAt = &terminatedAt
+		}
+	}
+	return nil
+}
+
+// CreateAuditLog saves a new audit log entry in the storage.
+func (m *mockRepository) CreateAuditLog(ctx context.Context, entry domain.AuditLog) error {
+	m.auditLogs = append(m.auditLogs, entry)
+	return nil
+}
+
+// QueryPasswordHistory returns the hashes of the previous passwords of the user with given ID, most recent first.
+func (m *mockRepository) QueryPasswordHistory(ctx context.Context, userID string, limit int) ([]string, error) {
+	hashes := []string{}
+	history := m.passwordHistory[userID]
+	for i := len(history) - 1; i >= 0 && len(hashes) < limit; i-- {
+		hashes = append(hashes, history[i])
+	}
+	return hashes, nil
+}
+
+// AddPasswordHistory records the hash of a previous password of the user with given ID.
+func (m *mockRepository) AddPasswordHistory(ctx context.Context, userID, hash string, createdAt time.Time) error {
+	if m.passwordHistory == nil {
+		m.passwordHistory = map[string][]string{}
+	}
+	m.passwordHistory[userID] = append(m.passwordHistory[userID], hash)
+	return nil
+}
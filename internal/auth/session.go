@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+)
+
+// ClientInfo describes the device a user logs in from.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+// QuerySessions returns the active sessions of the user with the specified ID.
+// The session with the given current ID is flagged as the current one.
+func (s service) QuerySessions(ctx context.Context, userID, currentID string) ([]domain.Session, error) {
+	seenAfter := time.Now().Add(-time.Duration(s.cfg.JWT.RefreshTokenExpiration) * time.Hour)
+	sessions, err := s.repo.QuerySessions(ctx, userID, seenAfter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+	return sessions, nil
+}
+
+// TerminateSession terminates the session with the specified ID of the user.
+// Its refresh tokens are revoked and its access tokens are refused from now on.
+func (s service) TerminateSession(ctx context.Context, userID, id string) error {
+	session, err := s.repo.GetSession(ctx, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return httperror.NotFound("")
+	}
+	if err != nil {
+		return err
+	}
+	if session.UserID != userID {
+		return httperror.NotFound("")
+	}
+	return s.terminateSession(ctx, session.UserID, session.ID)
+}
+
+// RevokeOtherSessions terminates every session of the user with the specified ID except the one with the given ID,
+// revoking their refresh token families and access tokens.
+func (s service) RevokeOtherSessions(ctx context.Context, userID, sessionID string) error {
+	seenAfter := time.Now().Add(-time.Duration(s.cfg.JWT.RefreshTokenExpiration) * time.Hour)
+	sessions, err := s.repo.QuerySessions(ctx, userID, seenAfter)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			continue
+		}
+		if err := s.terminateSession(ctx, userID, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSession creates a session for the identity and issues its first tokens.
+// The tokens of the session are restricted to the given scopes, unless none is given.
+func (s service) startSession(ctx context.Context, identity Identity, client ClientInfo, scopes []string) (Token, error) {
+	now := time.Now()
+	session := domain.Session{
+		ID:         domain.GenerateID(),
+		UserID:     identity.GetID(),
+		UserAgent:  truncate(client.UserAgent, 255),
+		IP:         client.IP,
+		Scopes:     scopes,
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		return Token{}, err
+	}
+	s.logger.With(ctx, "user", session.UserID, "session", session.ID).Infof("session started")
+	return s.issueTokens(ctx, identity, session, "")
+}
+
+// terminateSession terminates a session, revokes its refresh token family and the access tokens issued for it.
+func (s service) terminateSession(ctx context.Context, userID, id string) error {
+	now := time.Now()
+	if err := s.repo.TerminateSession(ctx, id, now); err != nil {
+		return err
+	}
+	if err := s.repo.RevokeRefreshTokenFamily(ctx, id, now); err != nil {
+		return err
+	}
+	// access tokens of the session cannot outlive the revocation as no new ones can be issued
+	expiresAt := now.Add(s.cfg.AccessTokenLifetime())
+	if err := s.revocations.RevokeSession(ctx, id, expiresAt); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", userID, "session", id).Infof("session terminated")
+	return nil
+}
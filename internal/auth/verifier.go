@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// TokenVerifier verifies the access tokens presented to protected routes.
+type TokenVerifier interface {
+	// Verify parses the token string and checks its signature, expiry and revocation status.
+	Verify(ctx context.Context, tokenString string) (*jwt.Token, error)
+}
+
+type verifier struct {
+	keys        *KeySet
+	revocations RevocationStore
+}
+
+// NewVerifier creates a new access token verifier accepting tokens signed by any key of the set.
+func NewVerifier(keys *KeySet, revocations RevocationStore) TokenVerifier {
+	return verifier{keys, revocations}
+}
+
+// Verify parses the token string and checks its signature, expiry and revocation status.
+func (v verifier) Verify(ctx context.Context, tokenString string) (*jwt.Token, error) {
+	token, err := jwt.Parse(tokenString, v.keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	tokenID, _ := claims["jti"].(string)
+	userID, _ := claims["id"].(string)
+	sessionID, _ := claims["sid"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+	if tokenID == "" {
+		return nil, errors.New("token has no jti claim")
+	}
+	if purpose, ok := claims["purpose"]; ok {
+		return nil, fmt.Errorf("token with purpose %v is not an access token", purpose)
+	}
+	revoked, err := v.revocations.IsRevoked(ctx, tokenID, sessionID, userID, time.Unix(int64(issuedAt), 0))
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errors.New("token has been revoked")
+	}
+	return token, nil
+}
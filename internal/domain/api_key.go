@@ -0,0 +1,29 @@
+package domain
+
+import "time"
+
+// APIKey represents a long-lived key allowing machine clients to act on behalf of a user.
+// Only the hash of the key is stored, the key itself is shown once on creation.
+type APIKey struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	// Prefix is the beginning of the key, allowing users to recognize their keys
+	Prefix  string `json:"prefix"`
+	KeyHash string `json:"-"`
+	// Scopes are the permissions the key is restricted to, an empty list grants every permission of the user
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// GetTableName returns database table name
+func (k APIKey) GetTableName() string {
+	return "api_keys"
+}
+
+// IsExpired checks whether the key has expired at the given time.
+func (k APIKey) IsExpired(at time.Time) bool {
+	return k.ExpiresAt != nil && !at.Before(*k.ExpiresAt)
+}
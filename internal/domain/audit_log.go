@@ -0,0 +1,25 @@
+package domain
+
+import "time"
+
+// AuditActionImpersonate is the audit action recorded when an administrator impersonates a user.
+const AuditActionImpersonate = "user.impersonate"
+
+// AuditLog records a sensitive action performed by a user.
+type AuditLog struct {
+	ID string `json:"id"`
+	// ActorID is the ID of the user who performed the action
+	ActorID string `json:"actor_id"`
+	Action  string `json:"action"`
+	// TargetID is the ID of the user the action was performed on
+	TargetID  string    `json:"target_id"`
+	Details   string    `json:"details"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetTableName returns database table name
+func (a AuditLog) GetTableName() string {
+	return "audit_logs"
+}
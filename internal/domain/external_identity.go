@@ -0,0 +1,20 @@
+package domain
+
+import "time"
+
+// ExternalIdentity links a user to an account at an external OpenID Connect provider.
+type ExternalIdentity struct {
+	ID     string
+	UserID string
+	// Issuer identifies the provider
+	Issuer string
+	// Subject is the identifier of the account at the provider
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+// GetTableName returns database table name
+func (i ExternalIdentity) GetTableName() string {
+	return "external_identities"
+}
@@ -0,0 +1,23 @@
+package domain
+
+import "time"
+
+// MFA represents the TOTP two-factor authentication settings of a user.
+// An enrollment only takes effect once it has been confirmed with a valid code.
+type MFA struct {
+	UserID       string
+	Secret       string
+	EnabledAt    *time.Time
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// GetTableName returns database table name
+func (m MFA) GetTableName() string {
+	return "user_mfa"
+}
+
+// IsEnabled checks whether the enrollment has been confirmed.
+func (m MFA) IsEnabled() bool {
+	return m.EnabledAt != nil
+}
@@ -0,0 +1,51 @@
+package domain
+
+import "time"
+
+const (
+	// GrantTypeClientCredentials is the OAuth2 grant allowing clients to get tokens on their own behalf.
+	GrantTypeClientCredentials = "client_credentials"
+	// GrantTypeRefreshToken is the OAuth2 grant allowing clients to exchange refresh tokens.
+	GrantTypeRefreshToken = "refresh_token"
+)
+
+// OAuthClient represents an application registered to get tokens from the OAuth2 endpoints.
+type OAuthClient struct {
+	ID         string `json:"client_id"`
+	Name       string `json:"name"`
+	SecretHash string `json:"-"`
+	// Scopes are the permissions the client may request
+	Scopes     []string  `json:"scopes"`
+	GrantTypes []string  `json:"grant_types"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GetTableName returns database table name
+func (c OAuthClient) GetTableName() string {
+	return "oauth_clients"
+}
+
+// GetID returns the client ID.
+func (c OAuthClient) GetID() string {
+	return c.ID
+}
+
+// GetUsername returns the client name.
+func (c OAuthClient) GetUsername() string {
+	return c.Name
+}
+
+// GetRoles returns no role, clients are only granted their scopes.
+func (c OAuthClient) GetRoles() []string {
+	return []string{}
+}
+
+// AllowsGrant checks whether the client may use the given grant type.
+func (c OAuthClient) AllowsGrant(grantType string) bool {
+	for _, g := range c.GrantTypes {
+		if g == grantType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package domain
+
+import "time"
+
+// RefreshToken represents an opaque token that can be exchanged once for a new access token.
+// Tokens obtained by rotating each other belong to the same family.
+type RefreshToken struct {
+	ID       string
+	UserID   string
+	FamilyID string
+	// ClientID is the ID of the OAuth client the token was issued to, empty for tokens issued on login
+	ClientID  string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// GetTableName returns database table name
+func (t RefreshToken) GetTableName() string {
+	return "refresh_tokens"
+}
@@ -0,0 +1,26 @@
+package domain
+
+import "time"
+
+const (
+	// RoleAdmin is the name of the role granted full access to every resource.
+	// Admins are granted every permission, whether or not it is mapped to the role.
+	RoleAdmin = "admin"
+	// RoleUser is the name of the role assigned to newly created users.
+	RoleUser = "user"
+)
+
+// Role represents a named set of privileges that can be assigned to users.
+type Role struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// GetTableName returns database table name
+func (r Role) GetTableName() string {
+	return "roles"
+}
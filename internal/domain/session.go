@@ -0,0 +1,24 @@
+package domain
+
+import "time"
+
+// Session represents a login of a user on a device. Its ID is shared by the family of refresh tokens
+// issued on login and is embedded in every access token in the sid claim.
+type Session struct {
+	ID        string `json:"id"`
+	UserID    string `json:"-"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	// Scopes restricts the tokens of the session to the listed permissions, empty if no scope was requested on login
+	Scopes       []string   `json:"scopes"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastSeenAt   time.Time  `json:"last_seen_at"`
+	TerminatedAt *time.Time `json:"-"`
+	// Current is set on the session of the token used to list sessions, it is not stored
+	Current bool `json:"current"`
+}
+
+// GetTableName returns database table name
+func (s Session) GetTableName() string {
+	return "sessions"
+}
@@ -4,14 +4,20 @@ import "time"
 
 // User represents a user.
 type User struct {
-	ID        string    `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"`
-	Address   string    `json:"address"`
+	ID              string     `json:"id"`
+	FirstName       string     `json:"first_name"`
+	LastName        string     `json:"last_name"`
+	Email           string     `json:"email"`
+	Password        string     `json:"-"`
+	Address         string     `json:"address"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	Roles           []string   `json:"roles"`
+	// Version is incremented on every update of the user, guarding against concurrent updates
+	Version   int       `json:"-"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set on soft-deleted users, which are kept until they are purged
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // GetTableName returns database table name
@@ -29,7 +35,17 @@ func (u User) GetUsername() string {
 	return u.Email
 }
 
-// GetRole returns the user role
-func (u User) GetRole() string {
-	return "admin"
+// GetRoles returns the names of the roles assigned to the user.
+func (u User) GetRoles() []string {
+	return u.Roles
+}
+
+// IsDeleted checks whether the user has been soft-deleted.
+func (u User) IsDeleted() bool {
+	return u.DeletedAt != nil
+}
+
+// IsEmailVerified checks whether the user has verified the ownership of the email address.
+func (u User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
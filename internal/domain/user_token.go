@@ -0,0 +1,26 @@
+package domain
+
+import "time"
+
+const (
+	// TokenPurposePasswordReset is the purpose of tokens allowing users to reset a forgotten password.
+	TokenPurposePasswordReset = "password_reset"
+	// TokenPurposeEmailVerification is the purpose of tokens allowing users to verify their email address.
+	TokenPurposeEmailVerification = "email_verification"
+)
+
+// UserToken represents a single-use, expiring token sent to a user to prove ownership of the account.
+type UserToken struct {
+	ID        string
+	UserID    string
+	Purpose   string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// GetTableName returns database table name
+func (t UserToken) GetTableName() string {
+	return "user_tokens"
+}
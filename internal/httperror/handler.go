@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/labstack/echo"
+	"github.com/redhajuanda/gorengan/pkg/password"
 	"github.com/redhajuanda/gorengan/pkg/validation"
 )
 
@@ -19,6 +20,10 @@ func CustomHTTPErrorHandler(err error, c echo.Context) {
 		err = BadRequest(err.Error())
 	}
 
+	if _, ok := err.(password.PolicyError); ok {
+		err = BadRequest(err.Error())
+	}
+
 	if errors.Is(err, sql.ErrNoRows) {
 		err = NotFound("")
 	}
@@ -65,6 +65,17 @@ func Forbidden(msg string) ErrorResponse {
 	}
 }
 
+// TooManyRequests creates a new error response representing a rate limiting failure (HTTP 429)
+func TooManyRequests(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "You have sent too many requests, please try again later."
+	}
+	return ErrorResponse{
+		Status:  http.StatusTooManyRequests,
+		Message: msg,
+	}
+}
+
 // BadRequest creates a new error response representing a bad request (HTTP 400)
 func BadRequest(msg string) ErrorResponse {
 	if msg == "" {
@@ -75,3 +86,25 @@ func BadRequest(msg string) ErrorResponse {
 		Message: msg,
 	}
 }
+
+// PreconditionFailed creates a new error response representing a failed precondition (HTTP 412)
+func PreconditionFailed(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The resource has been modified since it was retrieved."
+	}
+	return ErrorResponse{
+		Status:  http.StatusPreconditionFailed,
+		Message: msg,
+	}
+}
+
+// PreconditionRequired creates a new error response representing a missing precondition (HTTP 428)
+func PreconditionRequired(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The request must be conditional."
+	}
+	return ErrorResponse{
+		Status:  http.StatusPreconditionRequired,
+		Message: msg,
+	}
+}
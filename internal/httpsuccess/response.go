@@ -1,6 +1,12 @@
 package httpsuccess
 
-import "github.com/labstack/echo"
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+	"github.com/redhajuanda/gorengan/pkg/pagination"
+)
 
 func ResponseWithJSON(c echo.Context, msg string, code int, data interface{}) error {
 	if msg == "" {
@@ -19,3 +25,15 @@ type Response struct {
 	Message string      `json:"message"`
 	Data    interface{} `json:"data"`
 }
+
+// ResponseWithPage writes a page of a paginated list along with a Link header (RFC 8288) pointing at the other pages
+// and, when the total number of items is known, an X-Total-Count header holding it.
+func ResponseWithPage(c echo.Context, msg string, page pagination.Page) error {
+	if link := page.LinkHeader(c.Request().URL); link != "" {
+		c.Response().Header().Set("Link", link)
+	}
+	if total := page.Total(); total >= 0 {
+		c.Response().Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+	return ResponseWithJSON(c, msg, http.StatusOK, page)
+}
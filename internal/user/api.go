@@ -4,27 +4,66 @@ import (
 	"net/http"
 
 	"github.com/labstack/echo"
-	"github.com/redhajuanda/gorengan/config"
 	"github.com/redhajuanda/gorengan/internal/auth"
+	"github.com/redhajuanda/gorengan/internal/domain"
 	"github.com/redhajuanda/gorengan/internal/httperror"
 	"github.com/redhajuanda/gorengan/internal/httpsuccess"
 	"github.com/redhajuanda/gorengan/pkg/log"
 	"github.com/redhajuanda/gorengan/pkg/pagination"
 )
 
+const (
+	// PermissionRead allows reading users.
+	PermissionRead = "users:read"
+	// PermissionWrite allows creating and updating users.
+	PermissionWrite = "users:write"
+	// PermissionDelete allows deleting users.
+	PermissionDelete = "users:delete"
+	// PermissionRolesAssign allows administrators to assign roles to users.
+	PermissionRolesAssign = "roles:assign"
+)
+
 // RegisterService registers a new user service
-func RegisterService(r echo.Group, service Service, cfg config.Config, logger log.Logger) {
+func RegisterService(r echo.Group, service Service, verifier auth.TokenVerifier, apiKeys auth.APIKeyVerifier, checker auth.PermissionChecker, logger log.Logger) {
 	handler := handler{service, logger}
 
-	r.Use(auth.IsLoggedIn(cfg.JWT.SigningKey))
-	r.Use(auth.IsAdmin)
+	auth.RegisterPermissions(
+		auth.Permission{Name: PermissionRead, Description: "View users"},
+		auth.Permission{Name: PermissionWrite, Description: "Create and update users"},
+		auth.Permission{Name: PermissionDelete, Description: "Delete users"},
+		auth.Permission{Name: PermissionRolesAssign, Description: "Assign roles to users, administrators only"},
+	)
+
+	r.Use(auth.IsAuthenticated(verifier, apiKeys))
+
+	// the following endpoints require a valid JWT or API key
+	rejectImpersonation := auth.RejectImpersonation()
+	requireCredentials := auth.RequireScopes(auth.PermissionCredentialsWrite)
+	r.GET("/me", handler.getProfile)
+	r.PATCH("/me", handler.updateProfile, rejectImpersonation, requireCredentials)
+	r.POST("/me/password", handler.changePassword, rejectImpersonation, requireCredentials)
+	r.GET("/users/:id", handler.get, auth.RequirePermission(checker, PermissionRead))
+	r.GET("/users", handler.query, auth.RequirePermission(checker, PermissionRead), requireDeletePermissionForDeleted(checker))
+	r.POST("/users", handler.create, auth.RequirePermission(checker, PermissionWrite))
+	r.PUT("/users/:id", handler.update, auth.RequirePermission(checker, PermissionWrite))
+	// assigning roles grants their permissions, so it is restricted to administrators
+	r.PUT("/users/:id/roles", handler.setRoles, auth.RequireRole(domain.RoleAdmin), auth.RequireScopes(PermissionRolesAssign))
+	r.DELETE("/users/:id", handler.delete, auth.RequirePermission(checker, PermissionDelete))
+	r.POST("/users/:id/restore", handler.restore, auth.RequirePermission(checker, PermissionDelete))
+}
 
-	// the following endpoints require a valid JWT
-	r.GET("/users/:id", handler.get)
-	r.GET("/users", handler.query)
-	r.POST("/users", handler.create)
-	r.PUT("/users/:id", handler.update)
-	r.DELETE("/users/:id", handler.delete)
+// requireDeletePermissionForDeleted restricts listing soft-deleted users to those allowed to delete and restore users.
+func requireDeletePermissionForDeleted(checker auth.PermissionChecker) echo.MiddlewareFunc {
+	requireDelete := auth.RequirePermission(checker, PermissionDelete)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withDelete := requireDelete(next)
+		return func(c echo.Context) error {
+			if includeDeleted, _ := parseIncludeDeleted(c.QueryParams()); includeDeleted {
+				return withDelete(c)
+			}
+			return next(c)
+		}
+	}
 }
 
 type handler struct {
@@ -38,22 +77,52 @@ func (h handler) get(c echo.Context) error {
 		return err
 	}
 
-	return httpsuccess.ResponseWithJSON(c, "", http.StatusOK, user)
+	return responseWithETag(c, "", user)
 }
 
 func (h handler) query(c echo.Context) error {
 	ctx := c.Request().Context()
-	count, err := h.service.Count(ctx)
+	spec, err := ParseQuerySpec(c.QueryParams())
+	if err != nil {
+		return err
+	}
+
+	// clients sending a page number keep getting offset pagination, counted unless they opt out,
+	// cursor pagination is only counted on request
+	if c.QueryParam(pagination.PageVar) == "" {
+		count, err := h.count(c, spec, false)
+		if err != nil {
+			return err
+		}
+		page, err := pagination.NewCursorPageFromRequest(c.Request(), count)
+		if err != nil {
+			return httperror.BadRequest("Invalid cursor")
+		}
+		if err := h.service.QueryPage(ctx, spec, page); err != nil {
+			return err
+		}
+		return httpsuccess.ResponseWithPage(c, "", page)
+	}
+
+	count, err := h.count(c, spec, true)
 	if err != nil {
 		return err
 	}
 	pages := pagination.NewFromRequest(c.Request(), count)
-	users, err := h.service.Query(ctx, pages.Offset(), pages.Limit())
+	users, err := h.service.Query(ctx, spec, pages.Offset(), pages.Limit())
 	if err != nil {
 		return err
 	}
 	pages.Items = users
-	return httpsuccess.ResponseWithJSON(c, "", http.StatusOK, pages)
+	return httpsuccess.ResponseWithPage(c, "", pages)
+}
+
+// count returns the number of users matching the spec, or -1 if the client does not want it.
+func (h handler) count(c echo.Context, spec QuerySpec, byDefault bool) (int, error) {
+	if !pagination.CountRequested(c.Request(), byDefault) {
+		return -1, nil
+	}
+	return h.service.Count(c.Request().Context(), spec)
 }
 
 func (h handler) create(c echo.Context) error {
@@ -77,11 +146,42 @@ func (h handler) update(c echo.Context) error {
 		return httperror.BadRequest("")
 	}
 
-	user, err := h.service.Update(c.Request().Context(), c.Param("id"), input)
+	current, err := h.service.Get(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if err := checkIfMatch(c, current); err != nil {
+		return err
+	}
+	user, err := h.service.Update(c.Request().Context(), c.Param("id"), current.Version, input)
 	if err != nil {
 		return err
 	}
 
+	c.Response().Header().Set("ETag", etag(user))
+	return c.JSON(http.StatusOK, user)
+}
+
+func (h handler) setRoles(c echo.Context) error {
+	var input SetRolesRequest
+	if err := c.Bind(&input); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	current, err := h.service.Get(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if err := checkIfMatch(c, current); err != nil {
+		return err
+	}
+	user, err := h.service.SetRoles(c.Request().Context(), c.Param("id"), current.Version, input)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("ETag", etag(user))
 	return c.JSON(http.StatusOK, user)
 }
 
@@ -93,3 +193,58 @@ func (h handler) delete(c echo.Context) error {
 
 	return httpsuccess.ResponseWithJSON(c, "user deleted", http.StatusOK, user)
 }
+
+func (h handler) restore(c echo.Context) error {
+	user, err := h.service.Restore(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "user restored", http.StatusOK, user)
+}
+
+func (h handler) getProfile(c echo.Context) error {
+	user, err := h.service.GetProfile(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return responseWithETag(c, "", user)
+}
+
+func (h handler) updateProfile(c echo.Context) error {
+	var input UpdateProfileRequest
+	if err := c.Bind(&input); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	current, err := h.service.GetProfile(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	if err := checkIfMatch(c, current); err != nil {
+		return err
+	}
+	user, err := h.service.UpdateProfile(c.Request().Context(), current.Version, input)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("ETag", etag(user))
+	return httpsuccess.ResponseWithJSON(c, "profile updated", http.StatusOK, user)
+}
+
+func (h handler) changePassword(c echo.Context) error {
+	var input ChangePasswordRequest
+	if err := c.Bind(&input); err != nil {
+		h.logger.With(c.Request().Context()).Info(err)
+		return httperror.BadRequest("")
+	}
+
+	if err := h.service.ChangePassword(c.Request().Context(), input); err != nil {
+		return err
+	}
+
+	return httpsuccess.ResponseWithJSON(c, "password changed", http.StatusOK, nil)
+}
@@ -0,0 +1,61 @@
+package user
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/redhajuanda/gorengan/internal/httperror"
+	"github.com/redhajuanda/gorengan/internal/httpsuccess"
+)
+
+// etag returns the strong entity tag of the user, which changes on every update.
+func etag(user User) string {
+	return fmt.Sprintf(`"%d"`, user.Version)
+}
+
+// matchETag checks whether the value of an If-Match or If-None-Match header lists the entity tag or is "*".
+// Weak tags only match with the weak comparison used by If-None-Match, as required by RFC 7232.
+func matchETag(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch requires the request to carry an If-Match header matching the current entity tag of the user,
+// so that clients cannot overwrite changes they have not seen.
+func checkIfMatch(c echo.Context, user User) error {
+	header := c.Request().Header.Get("If-Match")
+	if header == "" {
+		return httperror.PreconditionRequired("The If-Match header must hold the ETag of the user")
+	}
+	if !matchETag(header, etag(user), false) {
+		return errModified
+	}
+	return nil
+}
+
+// responseWithETag writes the user retrieved by a GET request along with its entity tag,
+// or only the tag with 304 Not Modified if it matches the If-None-Match header of the request.
+func responseWithETag(c echo.Context, msg string, user User) error {
+	tag := etag(user)
+	c.Response().Header().Set("ETag", tag)
+	if header := c.Request().Header.Get("If-None-Match"); header != "" && matchETag(header, tag, true) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return httpsuccess.ResponseWithJSON(c, msg, http.StatusOK, user)
+}
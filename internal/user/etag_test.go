@@ -0,0 +1,30 @@
+package user
+
+import (
+	"testing"
+
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETag(t *testing.T) {
+	tag := etag(User{domain.User{Version: 3}})
+	assert.Equal(t, `"3"`, tag)
+
+	tests := []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{`"3"`, false, true},
+		{`"2", "3"`, false, true},
+		{`*`, false, true},
+		{`"2"`, false, false},
+		{`W/"3"`, false, false},
+		{`W/"3"`, true, true},
+		{`"30"`, true, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchETag(tt.header, tag, tt.weak), tt.header)
+	}
+}
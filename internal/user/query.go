@@ -0,0 +1,246 @@
+package user
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/pkg/pagination"
+	"github.com/redhajuanda/gorengan/pkg/validation"
+)
+
+// Operators supported by filters.
+const (
+	OpEq   = "eq"
+	OpLike = "like"
+	OpIn   = "in"
+	OpGt   = "gt"
+	OpGte  = "gte"
+	OpLt   = "lt"
+	OpLte  = "lte"
+)
+
+var (
+	// SearchVar specifies the query parameter name for the free-text search
+	SearchVar = "q"
+	// SortVar specifies the query parameter name for the comma separated list of sort fields,
+	// each prefixed with - for descending order
+	SortVar = "sort"
+	// IncludeDeletedVar specifies the query parameter name for listing soft-deleted users along with the others
+	IncludeDeletedVar = "include_deleted"
+	// MaxInValues specifies the maximum number of values of an in filter
+	MaxInValues = 100
+)
+
+// queryField describes a field users can be filtered or sorted by.
+type queryField struct {
+	column    string
+	operators []string
+	sortable  bool
+	// timestamp is set on fields holding a time, whose values are parsed as dates
+	timestamp bool
+}
+
+// queryFields whitelists the fields users can be filtered and sorted by along with their column.
+var queryFields = map[string]queryField{
+	"id":         {column: "users.id", operators: []string{OpEq, OpIn}},
+	"email":      {column: "users.email", operators: []string{OpEq, OpLike, OpIn}, sortable: true},
+	"first_name": {column: "users.first_name", operators: []string{OpEq, OpLike, OpIn}, sortable: true},
+	"last_name":  {column: "users.last_name", operators: []string{OpEq, OpLike, OpIn}, sortable: true},
+	"created_at": {column: "users.created_at", operators: []string{OpGt, OpGte, OpLt, OpLte}, sortable: true, timestamp: true},
+	"updated_at": {column: "users.updated_at", sortable: true},
+}
+
+// QuerySpec describes which users are listed and in which order.
+type QuerySpec struct {
+	Filters []Filter
+	// Search matches the users whose first name, last name, full name or email contains it
+	Search string
+	// Sort lists the fields users are sorted by, by default the creation time.
+	// Users are finally sorted by ID so that the order is stable across pages.
+	Sort []SortField
+	// IncludeDeleted lists soft-deleted users along with the others
+	IncludeDeleted bool
+}
+
+// Filter restricts the users to those whose field matches the values with the operator.
+// Every operator takes a single value, except in which takes one or more.
+type Filter struct {
+	Field    string
+	Operator string
+	Values   []interface{}
+}
+
+// SortField is a field users are sorted by.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// ParseQuerySpec creates a QuerySpec from the query parameters of a request.
+// Filters are written field=value, which is the same as field[eq]=value, or field[op]=value where op is one of
+// like, in (with comma separated values), gt, gte, lt and lte. Dates are either RFC 3339 timestamps or
+// YYYY-MM-DD dates. Parameters that do not name a whitelisted field, such as the pagination ones, are ignored.
+func ParseQuerySpec(values url.Values) (QuerySpec, error) {
+	spec := QuerySpec{Search: strings.TrimSpace(values.Get(SearchVar))}
+	includeDeleted, err := parseIncludeDeleted(values)
+	if err != nil {
+		return QuerySpec{}, err
+	}
+	spec.IncludeDeleted = includeDeleted
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, operator := key, OpEq
+		if i := strings.Index(key, "["); i > 0 && strings.HasSuffix(key, "]") {
+			name, operator = key[:i], key[i+1:len(key)-1]
+		}
+		field, ok := queryFields[name]
+		if !ok {
+			continue
+		}
+		if !containsString(field.operators, operator) {
+			return QuerySpec{}, validation.NewValidationError(fmt.Sprintf("%v cannot be filtered with %v", name, operator))
+		}
+		for _, value := range values[key] {
+			filter, err := parseFilter(name, field, operator, value)
+			if err != nil {
+				return QuerySpec{}, err
+			}
+			spec.Filters = append(spec.Filters, filter)
+		}
+	}
+
+	if sortVar := values.Get(SortVar); sortVar != "" {
+		for _, name := range strings.Split(sortVar, ",") {
+			name = strings.TrimSpace(name)
+			desc := strings.HasPrefix(name, "-")
+			name = strings.TrimPrefix(name, "-")
+			if field, ok := queryFields[name]; !ok || !field.sortable {
+				return QuerySpec{}, validation.NewValidationError(fmt.Sprintf("users cannot be sorted by %v", name))
+			}
+			for _, sorted := range spec.Sort {
+				if sorted.Field == name {
+					return QuerySpec{}, validation.NewValidationError(fmt.Sprintf("users are already sorted by %v", name))
+				}
+			}
+			spec.Sort = append(spec.Sort, SortField{Field: name, Desc: desc})
+		}
+	}
+	return spec, nil
+}
+
+// sortFields returns the fields users are sorted by, the creation time unless the spec says otherwise.
+func (spec QuerySpec) sortFields() []SortField {
+	if len(spec.Sort) == 0 {
+		return []SortField{{Field: "created_at"}}
+	}
+	return spec.Sort
+}
+
+// sortKey identifies the sort order of the spec in the format of the sort parameter, such as "-created_at,email".
+func (spec QuerySpec) sortKey() string {
+	fields := []string{}
+	for _, s := range spec.sortFields() {
+		if s.Desc {
+			fields = append(fields, "-"+s.Field)
+		} else {
+			fields = append(fields, s.Field)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// newCursor returns the cursor pointing at the user in the sort order of the spec.
+func newCursor(spec QuerySpec, user domain.User, backward bool) pagination.Cursor {
+	values := []string{}
+	for _, s := range spec.sortFields() {
+		values = append(values, sortValue(user, s.Field))
+	}
+	return pagination.Cursor{Sort: spec.sortKey(), Values: values, ID: user.ID, Backward: backward}
+}
+
+// sortValue returns the value of a sortable field of the user as stored in cursors.
+func sortValue(user domain.User, field string) string {
+	switch field {
+	case "email":
+		return user.Email
+	case "first_name":
+		return user.FirstName
+	case "last_name":
+		return user.LastName
+	case "created_at":
+		return user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "updated_at":
+		return user.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return ""
+}
+
+// parseFilter parses the value of a filter on a whitelisted field.
+func parseFilter(name string, field queryField, operator, value string) (Filter, error) {
+	raw := []string{value}
+	if operator == OpIn {
+		raw = []string{}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				raw = append(raw, v)
+			}
+		}
+		if len(raw) == 0 || len(raw) > MaxInValues {
+			return Filter{}, validation.NewValidationError(fmt.Sprintf("%v[in] takes between 1 and %d values", name, MaxInValues))
+		}
+	}
+	filter := Filter{Field: name, Operator: operator}
+	for _, v := range raw {
+		if !field.timestamp {
+			filter.Values = append(filter.Values, v)
+			continue
+		}
+		t, err := parseTime(v)
+		if err != nil {
+			return Filter{}, validation.NewValidationError(fmt.Sprintf("%v must be a date or an RFC 3339 timestamp", name))
+		}
+		filter.Values = append(filter.Values, t)
+	}
+	return filter, nil
+}
+
+// parseIncludeDeleted parses the parameter listing soft-deleted users, which defaults to false.
+func parseIncludeDeleted(values url.Values) (bool, error) {
+	value := values.Get(IncludeDeletedVar)
+	if value == "" {
+		return false, nil
+	}
+	includeDeleted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, validation.NewValidationError(fmt.Sprintf("%v must be true or false", IncludeDeletedVar))
+	}
+	return includeDeleted, nil
+}
+
+// parseTime parses an RFC 3339 timestamp or a YYYY-MM-DD date.
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// containsString checks whether the slice contains the given value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
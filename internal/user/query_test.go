@@ -0,0 +1,126 @@
+package user
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuerySpec(t *testing.T) {
+	values, _ := url.ParseQuery("q=+jane+&email[like]=doe&first_name=Jane&id[in]=a,+b,,c&created_at[gte]=2020-09-01&created_at[lt]=2020-09-30T12:00:00Z&sort=-created_at,email&page=2&per_page=10")
+	spec, err := ParseQuerySpec(values)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane", spec.Search)
+	assert.Equal(t, []Filter{
+		{Field: "created_at", Operator: OpGte, Values: []interface{}{time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)}},
+		{Field: "created_at", Operator: OpLt, Values: []interface{}{time.Date(2020, 9, 30, 12, 0, 0, 0, time.UTC)}},
+		{Field: "email", Operator: OpLike, Values: []interface{}{"doe"}},
+		{Field: "first_name", Operator: OpEq, Values: []interface{}{"Jane"}},
+		{Field: "id", Operator: OpIn, Values: []interface{}{"a", "b", "c"}},
+	}, spec.Filters)
+	assert.Equal(t, []SortField{{Field: "created_at", Desc: true}, {Field: "email"}}, spec.Sort)
+	assert.False(t, spec.IncludeDeleted)
+
+	values, _ = url.ParseQuery("include_deleted=true")
+	spec, err = ParseQuerySpec(values)
+	assert.NoError(t, err)
+	assert.True(t, spec.IncludeDeleted)
+
+	for _, query := range []string{
+		"password=secret",
+		"email[gte]=a",
+		"created_at=2020-09-01",
+		"created_at[gte]=yesterday",
+		"id[in]=,",
+		"sort=password",
+		"sort=id",
+		"sort=email,-email",
+		"include_deleted=sometimes",
+	} {
+		values, _ := url.ParseQuery(query)
+		_, err := ParseQuerySpec(values)
+		if query == "password=secret" {
+			// unknown parameters are ignored
+			assert.NoError(t, err, query)
+			continue
+		}
+		assert.Error(t, err, query)
+	}
+}
+
+func TestWhereClause(t *testing.T) {
+	where, args, err := whereClause(QuerySpec{})
+	assert.NoError(t, err)
+	assert.Equal(t, " WHERE users.deleted_at IS NULL", where)
+	assert.Empty(t, args)
+
+	// soft-deleted users are only listed on request
+	where, args, err = whereClause(QuerySpec{IncludeDeleted: true})
+	assert.NoError(t, err)
+	assert.Empty(t, where)
+	assert.Empty(t, args)
+
+	since := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	where, args, err = whereClause(QuerySpec{
+		Filters: []Filter{
+			{Field: "email", Operator: OpLike, Values: []interface{}{"50%_off"}},
+			{Field: "id", Operator: OpIn, Values: []interface{}{"a", "b"}},
+			{Field: "created_at", Operator: OpGte, Values: []interface{}{since}},
+		},
+		Search: "jane",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, " WHERE users.deleted_at IS NULL AND users.email LIKE ? AND users.id IN (?,?) AND users.created_at>=? AND "+
+		"(users.first_name LIKE ? OR users.last_name LIKE ? OR CONCAT(users.first_name, ' ', users.last_name) LIKE ? OR users.email LIKE ?)", where)
+	assert.Equal(t, []interface{}{`%50\%\_off%`, "a", "b", since, "%jane%", "%jane%", "%jane%", "%jane%"}, args)
+
+	// only whitelisted fields and operators are accepted
+	_, _, err = whereClause(QuerySpec{Filters: []Filter{{Field: "password", Operator: OpEq, Values: []interface{}{"secret"}}}})
+	assert.Error(t, err)
+	_, _, err = whereClause(QuerySpec{Filters: []Filter{{Field: "email", Operator: "= '' OR 1=1 --", Values: []interface{}{"a"}}}})
+	assert.Error(t, err)
+}
+
+func TestOrderByClause(t *testing.T) {
+	orderBy, err := orderByClause(QuerySpec{}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, " ORDER BY users.created_at ASC, users.id ASC", orderBy)
+
+	orderBy, err = orderByClause(QuerySpec{Sort: []SortField{{Field: "created_at", Desc: true}, {Field: "email"}}}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, " ORDER BY users.created_at DESC, users.email ASC, users.id ASC", orderBy)
+
+	orderBy, err = orderByClause(QuerySpec{Sort: []SortField{{Field: "created_at", Desc: true}, {Field: "email"}}}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, " ORDER BY users.created_at ASC, users.email DESC, users.id DESC", orderBy)
+
+	_, err = orderByClause(QuerySpec{Sort: []SortField{{Field: "password"}}}, false)
+	assert.Error(t, err)
+}
+
+func TestKeysetCondition(t *testing.T) {
+	created := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	spec := QuerySpec{Sort: []SortField{{Field: "created_at", Desc: true}, {Field: "email"}}}
+	cursor := newCursor(spec, domain.User{ID: "42", Email: "jane@doe.com", CreatedAt: created}, false)
+	assert.Equal(t, "-created_at,email", cursor.Sort)
+
+	condition, args, err := keysetCondition(spec, cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, "((users.created_at<?) OR (users.created_at=? AND users.email>?) OR (users.created_at=? AND users.email=? AND users.id>?))", condition)
+	assert.Equal(t, []interface{}{created, created, "jane@doe.com", created, "jane@doe.com", "42"}, args)
+
+	cursor.Backward = true
+	condition, _, err = keysetCondition(spec, cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, "((users.created_at>?) OR (users.created_at=? AND users.email<?) OR (users.created_at=? AND users.email=? AND users.id<?))", condition)
+
+	// cursors must hold a valid value for every sort field
+	_, _, err = keysetCondition(QuerySpec{}, cursor)
+	assert.Error(t, err)
+	cursor.Values[0] = "yesterday"
+	_, _, err = keysetCondition(spec, cursor)
+	assert.Error(t, err)
+}
@@ -3,25 +3,46 @@ package user
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/pkg/pagination"
+	"github.com/redhajuanda/gorengan/pkg/validation"
 )
 
+// ErrVersionConflict is returned when a user has been updated since it was read.
+var ErrVersionConflict = errors.New("user has been modified concurrently")
+
 // Repository encapsulates the logic to access users from the data source.
 type Repository interface {
-	// Get returns the user with the specified user ID.
+	// Get returns the user with the specified user ID, unless it has been soft-deleted.
 	Get(ctx context.Context, id string) (domain.User, error)
-	// Count returns the number of users.
-	Count(ctx context.Context) (int, error)
-	// Query returns the list of users with the given offset and limit.
-	Query(ctx context.Context, offset, limit int) ([]domain.User, error)
-	// Create saves a new user in the storage.
+	// Count returns the number of users matching the spec.
+	Count(ctx context.Context, spec QuerySpec) (int, error)
+	// Query returns the list of users matching the spec, sorted as requested, with the given offset and limit.
+	Query(ctx context.Context, spec QuerySpec, offset, limit int) ([]domain.User, error)
+	// QueryPage returns at most limit users matching the spec that follow the cursor in the sort order of the spec,
+	// or precede it for backward cursors. Users are returned in sort order either way.
+	QueryPage(ctx context.Context, spec QuerySpec, cursor pagination.Cursor, limit int) ([]domain.User, error)
+	// Create saves a new user in the storage along with its roles.
+	// A validation error is returned, and nothing is saved, if one of the roles does not exist.
 	Create(ctx context.Context, user domain.User) error
-	// Update updates the user with given ID in the storage.
+	// Update updates the user with given ID in the storage and increments its version.
+	// It returns ErrVersionConflict if the stored user is not at the version of the given one anymore.
 	Update(ctx context.Context, user domain.User) error
-	// Delete removes the user with given ID from the storage.
-	Delete(ctx context.Context, id string) error
+	// Delete soft-deletes the user with given ID, which is kept in the storage until it is purged.
+	Delete(ctx context.Context, id string, deletedAt time.Time) error
+	// Restore undoes the soft deletion of the user with given ID.
+	// It returns sql.ErrNoRows if no soft-deleted user has the ID.
+	Restore(ctx context.Context, id string, restoredAt time.Time) error
+	// Purge permanently removes the users soft-deleted before the given time and returns how many were removed.
+	Purge(ctx context.Context, before time.Time) (int, error)
+	// SetRoles replaces the roles assigned to the user with given ID and increments its version.
+	// It returns ErrVersionConflict if the stored user is not at the given version anymore.
+	SetRoles(ctx context.Context, id string, version int, roles []string, updatedAt time.Time) error
 }
 
 type repository struct {
@@ -33,86 +54,377 @@ func NewRepository(db *sql.DB) Repository {
 	return repository{db}
 }
 
-// Get returns the user with the specified user ID.
+// Get returns the user with the specified user ID, unless it has been soft-deleted.
 func (r repository) Get(ctx context.Context, id string) (domain.User, error) {
-	var user domain.User
-	stmt, err := r.db.PrepareContext(ctx, "SELECT id, first_name, last_name, email, password, address, created_at, updated_at FROM users WHERE id=?")
+	stmt, err := r.db.PrepareContext(ctx, selectUsers+" WHERE id=? AND deleted_at IS NULL")
 	if err != nil {
 		return domain.User{}, err
 	}
-	row := stmt.QueryRowContext(ctx, id)
-	if err := row.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.Address, &user.CreatedAt, &user.UpdatedAt); err != nil {
-		return domain.User{}, err
-	}
-	return user, nil
+	return scanUser(stmt.QueryRowContext(ctx, id))
 }
 
-// Count returns the number of users.
-func (r repository) Count(ctx context.Context) (int, error) {
+// Count returns the number of users matching the spec.
+func (r repository) Count(ctx context.Context, spec QuerySpec) (int, error) {
 	var count int
-	stmt, err := r.db.PrepareContext(ctx, "SELECT COUNT(*) as count FROM users")
+	where, args, err := whereClause(spec)
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := r.db.PrepareContext(ctx, "SELECT COUNT(*) as count FROM users"+where)
 	if err != nil {
 		return 0, err
 	}
-	rows := stmt.QueryRowContext(ctx)
-	rows.Scan(&count)
+	if err := stmt.QueryRowContext(ctx, args...).Scan(&count); err != nil {
+		return 0, err
+	}
 	return count, nil
 }
 
-// Query returns the list of users with the given offset and limit.
-func (r repository) Query(ctx context.Context, offset, limit int) ([]domain.User, error) {
+// Query returns the list of users matching the spec, sorted as requested, with the given offset and limit.
+func (r repository) Query(ctx context.Context, spec QuerySpec, offset, limit int) ([]domain.User, error) {
 	var users []domain.User
-	stmt, err := r.db.PrepareContext(ctx, "SELECT id, first_name, last_name, email, password, address, created_at, updated_at FROM users LIMIT ?, ?")
+	where, args, err := whereClause(spec)
+	if err != nil {
+		return nil, err
+	}
+	orderBy, err := orderByClause(spec, false)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := r.db.PrepareContext(ctx, selectUsers+where+orderBy+" LIMIT ?, ?")
 	if err != nil {
 		return nil, err
 	}
-	rows, err := stmt.QueryContext(ctx, offset, limit)
+	rows, err := stmt.QueryContext(ctx, append(args, offset, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var user domain.User
-		if err := rows.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.Address, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		user, err := scanUser(rows)
+		if err != nil {
 			return nil, err
 		}
 		users = append(users, user)
 	}
 
-	return users, nil
+	return users, rows.Err()
 }
 
-// Create saves a new user in the storage.
+// QueryPage returns at most limit users matching the spec that follow the cursor in the sort order of the spec,
+// or precede it for backward cursors. Users are returned in sort order either way.
+func (r repository) QueryPage(ctx context.Context, spec QuerySpec, cursor pagination.Cursor, limit int) ([]domain.User, error) {
+	users := []domain.User{}
+	where, args, err := whereClause(spec)
+	if err != nil {
+		return nil, err
+	}
+	if !cursor.IsZero() {
+		keyset, keysetArgs, err := keysetCondition(spec, cursor)
+		if err != nil {
+			return nil, err
+		}
+		if where == "" {
+			where = " WHERE " + keyset
+		} else {
+			where += " AND " + keyset
+		}
+		args = append(args, keysetArgs...)
+	}
+	// users before a backward cursor are the first ones in reverse order
+	orderBy, err := orderByClause(spec, cursor.Backward)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := r.db.PrepareContext(ctx, selectUsers+where+orderBy+" LIMIT ?")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	if cursor.Backward {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+
+	return users, rows.Err()
+}
+
+// Create saves a new user in the storage along with its roles.
+// A validation error is returned, and nothing is saved, if one of the roles does not exist.
 func (r repository) Create(ctx context.Context, user domain.User) error {
-	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO users (id, first_name, last_name, email, password, address, created_at, updated_at) VALUES (?,?,?,?,?,?,?,?)")
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO users (id, first_name, last_name, email, password, address, email_verified_at, created_at, updated_at) VALUES (?,?,?,?,?,?,?,?,?)")
 	if err != nil {
 		return fmt.Errorf("Error preparing statement: %v", err)
 	}
-	_, err = stmt.ExecContext(ctx, user.ID, user.FirstName, user.LastName, user.Email, user.Password, user.Address, user.CreatedAt, user.UpdatedAt)
+	_, err = stmt.ExecContext(ctx, user.ID, user.FirstName, user.LastName, user.Email, user.Password, user.Address, user.EmailVerifiedAt, user.CreatedAt, user.UpdatedAt)
 	if err != nil {
 		return fmt.Errorf("Error exec query: %v", err)
 	}
-	return nil
+	if err := insertRoles(ctx, tx, user.ID, user.Roles); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// Update updates the user with given ID in the storage.
+// Update updates the user with given ID in the storage and increments its version.
+// It returns ErrVersionConflict if the stored user is not at the version of the given one anymore.
 func (r repository) Update(ctx context.Context, user domain.User) error {
-	stmt, err := r.db.PrepareContext(ctx, "UPDATE users SET first_name=?, last_name=?, email=?, password=?, address=?, created_at=?, updated_at=? WHERE id=?")
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE users SET first_name=?, last_name=?, email=?, password=?, address=?, email_verified_at=?, created_at=?, updated_at=?, version=version+1 WHERE id=? AND version=?")
 	if err != nil {
 		return fmt.Errorf("Error preparing statement: %v", err)
 	}
-	_, err = stmt.ExecContext(ctx, user.FirstName, user.LastName, user.Email, user.Password, user.Address, user.CreatedAt, user.UpdatedAt, user.ID)
+	res, err := stmt.ExecContext(ctx, user.FirstName, user.LastName, user.Email, user.Password, user.Address, user.EmailVerifiedAt, user.CreatedAt, user.UpdatedAt, user.ID, user.Version)
 	if err != nil {
 		return fmt.Errorf("Error exec query: %v", err)
 	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrVersionConflict
+	}
 	return nil
 }
 
-// Delete removes the user with given ID from the storage.
-func (r repository) Delete(ctx context.Context, id string) error {
-	stmt, err := r.db.PrepareContext(ctx, "DELETE FROM users WHERE id=?")
+// Delete soft-deletes the user with given ID, which is kept in the storage until it is purged.
+func (r repository) Delete(ctx context.Context, id string, deletedAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE users SET deleted_at=?, version=version+1 WHERE id=? AND deleted_at IS NULL")
 	if err != nil {
 		return fmt.Errorf("Error preparing statement: %v", err)
 	}
-	_, err = stmt.ExecContext(ctx, id)
+	_, err = stmt.ExecContext(ctx, deletedAt, id)
 	if err != nil {
 		return fmt.Errorf("Error exec query: %v", err)
 	}
 	return nil
 }
+
+// Restore undoes the soft deletion of the user with given ID.
+// It returns sql.ErrNoRows if no soft-deleted user has the ID.
+func (r repository) Restore(ctx context.Context, id string, restoredAt time.Time) error {
+	stmt, err := r.db.PrepareContext(ctx, "UPDATE users SET deleted_at=NULL, updated_at=?, version=version+1 WHERE id=? AND deleted_at IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	res, err := stmt.ExecContext(ctx, restoredAt, id)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Purge permanently removes the users soft-deleted before the given time and returns how many were removed.
+// Their roles, tokens, sessions and other records are removed along with them by the foreign keys.
+func (r repository) Purge(ctx context.Context, before time.Time) (int, error) {
+	stmt, err := r.db.PrepareContext(ctx, "DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at<?")
+	if err != nil {
+		return 0, fmt.Errorf("Error preparing statement: %v", err)
+	}
+	res, err := stmt.ExecContext(ctx, before)
+	if err != nil {
+		return 0, fmt.Errorf("Error exec query: %v", err)
+	}
+	purged, _ := res.RowsAffected()
+	return int(purged), nil
+}
+
+// SetRoles replaces the roles assigned to the user with given ID and increments its version in one transaction.
+// It returns ErrVersionConflict if the stored user is not at the given version anymore,
+// and a validation error if one of the roles does not exist.
+func (r repository) SetRoles(ctx context.Context, id string, version int, roles []string, updatedAt time.Time) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET updated_at=?, version=version+1 WHERE id=? AND version=?", updatedAt, id, version)
+	if err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return ErrVersionConflict
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_roles WHERE user_id=?", id); err != nil {
+		return fmt.Errorf("Error exec query: %v", err)
+	}
+	if err := insertRoles(ctx, tx, id, roles); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertRoles assigns the roles to the user with given ID within the transaction.
+// A validation error is returned if one of the roles does not exist.
+func insertRoles(ctx context.Context, tx *sql.Tx, id string, roles []string) error {
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO user_roles (user_id, role_id) SELECT ?, id FROM roles WHERE name=?")
+	if err != nil {
+		return fmt.Errorf("Error preparing statement: %v", err)
+	}
+	for _, role := range roles {
+		res, err := stmt.ExecContext(ctx, id, role)
+		if err != nil {
+			return fmt.Errorf("Error exec query: %v", err)
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			return validation.NewValidationError(fmt.Sprintf("role %v does not exist", role))
+		}
+	}
+	return nil
+}
+
+// comparisons maps the comparison operators of filters to SQL.
+var comparisons = map[string]string{OpEq: "=", OpGt: ">", OpGte: ">=", OpLt: "<", OpLte: "<="}
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// whereClause builds the WHERE clause selecting the users matching the spec along with its arguments.
+// Soft-deleted users are excluded unless the spec includes them.
+// Columns only come from the whitelist of query fields and every value is passed as an argument.
+func whereClause(spec QuerySpec) (string, []interface{}, error) {
+	conditions := []string{}
+	args := []interface{}{}
+	if !spec.IncludeDeleted {
+		conditions = append(conditions, "users.deleted_at IS NULL")
+	}
+	for _, filter := range spec.Filters {
+		field, ok := queryFields[filter.Field]
+		if !ok || !containsString(field.operators, filter.Operator) || len(filter.Values) == 0 {
+			return "", nil, fmt.Errorf("invalid filter on %v with %v", filter.Field, filter.Operator)
+		}
+		switch filter.Operator {
+		case OpLike:
+			conditions = append(conditions, field.column+" LIKE ?")
+			args = append(args, "%"+likeEscaper.Replace(fmt.Sprint(filter.Values[0]))+"%")
+		case OpIn:
+			conditions = append(conditions, field.column+" IN (?"+strings.Repeat(",?", len(filter.Values)-1)+")")
+			args = append(args, filter.Values...)
+		default:
+			conditions = append(conditions, field.column+comparisons[filter.Operator]+"?")
+			args = append(args, filter.Values[0])
+		}
+	}
+	if spec.Search != "" {
+		pattern := "%" + likeEscaper.Replace(spec.Search) + "%"
+		conditions = append(conditions, "(users.first_name LIKE ? OR users.last_name LIKE ? OR CONCAT(users.first_name, ' ', users.last_name) LIKE ? OR users.email LIKE ?)")
+		args = append(args, pattern, pattern, pattern, pattern)
+	}
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// orderByClause builds the ORDER BY clause sorting the users as requested by the spec, by creation time by default,
+// or in the opposite order if reverse is set. Users are finally sorted by ID so that the order is stable.
+func orderByClause(spec QuerySpec, reverse bool) (string, error) {
+	direction := func(desc bool) string {
+		if desc != reverse {
+			return " DESC"
+		}
+		return " ASC"
+	}
+	order := []string{}
+	for _, s := range spec.sortFields() {
+		field, ok := queryFields[s.Field]
+		if !ok || !field.sortable {
+			return "", fmt.Errorf("invalid sort field %v", s.Field)
+		}
+		order = append(order, field.column+direction(s.Desc))
+	}
+	return " ORDER BY " + strings.Join(append(order, "users.id"+direction(false)), ", "), nil
+}
+
+// keysetCondition builds the condition selecting the users after the cursor in the sort order of the spec,
+// or before it for backward cursors, along with its arguments. Rows are compared field by field:
+// (a > ?) OR (a = ? AND b > ?) OR (a = ? AND b = ? AND id > ?), with < for descending fields.
+func keysetCondition(spec QuerySpec, cursor pagination.Cursor) (string, []interface{}, error) {
+	sort := spec.sortFields()
+	if len(cursor.Values) != len(sort) {
+		return "", nil, pagination.ErrInvalidCursor
+	}
+	columns := []string{}
+	operators := []string{}
+	values := []interface{}{}
+	operator := func(desc bool) string {
+		if desc != cursor.Backward {
+			return "<"
+		}
+		return ">"
+	}
+	for i, s := range sort {
+		field, ok := queryFields[s.Field]
+		if !ok || !field.sortable {
+			return "", nil, fmt.Errorf("invalid sort field %v", s.Field)
+		}
+		var value interface{} = cursor.Values[i]
+		if field.timestamp {
+			t, err := time.Parse(time.RFC3339Nano, cursor.Values[i])
+			if err != nil {
+				return "", nil, pagination.ErrInvalidCursor
+			}
+			value = t
+		}
+		columns = append(columns, field.column)
+		operators = append(operators, operator(s.Desc))
+		values = append(values, value)
+	}
+	columns = append(columns, "users.id")
+	operators = append(operators, operator(false))
+	values = append(values, cursor.ID)
+
+	disjuncts := []string{}
+	args := []interface{}{}
+	for i := range columns {
+		conjuncts := []string{}
+		for j := 0; j < i; j++ {
+			conjuncts = append(conjuncts, columns[j]+"=?")
+			args = append(args, values[j])
+		}
+		conjuncts = append(conjuncts, columns[i]+operators[i]+"?")
+		args = append(args, values[i])
+		disjuncts = append(disjuncts, "("+strings.Join(conjuncts, " AND ")+")")
+	}
+	return "(" + strings.Join(disjuncts, " OR ") + ")", args, nil
+}
+
+// selectUsers selects the columns of the users table read by scanUser, along with the names of their roles.
+const selectUsers = "SELECT id, first_name, last_name, email, password, address, version, email_verified_at, created_at, updated_at, deleted_at, (SELECT GROUP_CONCAT(roles.name) FROM user_roles JOIN roles ON roles.id=user_roles.role_id WHERE user_roles.user_id=users.id) FROM users"
+
+// scanUser scans a row selected with selectUsers.
+func scanUser(row interface{ Scan(...interface{}) error }) (domain.User, error) {
+	var user domain.User
+	var roles sql.NullString
+	if err := row.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.Address, &user.Version, &user.EmailVerifiedAt, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt, &roles); err != nil {
+		return domain.User{}, err
+	}
+	user.Roles = splitRoles(roles)
+	return user, nil
+}
+
+// splitRoles converts the comma separated role names returned by GROUP_CONCAT into a slice.
+func splitRoles(roles sql.NullString) []string {
+	if !roles.Valid || roles.String == "" {
+		return []string{}
+	}
+	return strings.Split(roles.String, ",")
+}
@@ -4,11 +4,13 @@ package user
 
 import (
 	"context"
+	"database/sql"
 	"testing"
 	"time"
 
 	"github.com/redhajuanda/gorengan/internal/domain"
 	"github.com/redhajuanda/gorengan/internal/test"
+	"github.com/redhajuanda/gorengan/pkg/pagination"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -43,6 +45,13 @@ func TestCreateUser(t *testing.T) {
 		err := repo.Create(context.Background(), user)
 		assert.NoError(t, err)
 	}
+
+	// users with unknown roles are not saved
+	invalid := domain.User{ID: domain.GenerateID(), Email: "invalid@gmail.com", Roles: []string{"unknown"}, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	err := repo.Create(context.Background(), invalid)
+	assert.Error(t, err)
+	_, err = repo.Get(context.Background(), invalid.ID)
+	assert.Equal(t, sql.ErrNoRows, err)
 }
 
 func TestGetOneUser(t *testing.T) {
@@ -60,9 +69,49 @@ func TestQueryUser(t *testing.T) {
 	db := test.GetTestDB(t)
 	repo := NewRepository(db)
 
-	usersGot, err := repo.Query(context.Background(), 0, 10)
+	usersGot, err := repo.Query(context.Background(), QuerySpec{}, 0, 10)
 	assert.NoError(t, err)
 	assert.Equal(t, len(userDataTests), len(usersGot))
+
+	spec := QuerySpec{
+		Filters: []Filter{{Field: "email", Operator: OpLike, Values: []interface{}{"gmail"}}},
+		Sort:    []SortField{{Field: "email", Desc: true}},
+	}
+	usersGot, err = repo.Query(context.Background(), spec, 0, 10)
+	assert.NoError(t, err)
+	if assert.Equal(t, len(userDataTests), len(usersGot)) {
+		assert.Equal(t, "redhajuanda@gmail.com", usersGot[0].Email)
+	}
+
+	usersGot, err = repo.Query(context.Background(), QuerySpec{Search: "john mick"}, 0, 10)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(usersGot)) {
+		assert.Equal(t, "johnmick@gmail.com", usersGot[0].Email)
+	}
+}
+
+func TestQueryPageUser(t *testing.T) {
+	db := test.GetTestDB(t)
+	repo := NewRepository(db)
+	spec := QuerySpec{Sort: []SortField{{Field: "email"}}}
+
+	usersGot, err := repo.QueryPage(context.Background(), spec, pagination.Cursor{}, 1)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(usersGot)) {
+		assert.Equal(t, "johnmick@gmail.com", usersGot[0].Email)
+	}
+
+	usersGot, err = repo.QueryPage(context.Background(), spec, newCursor(spec, usersGot[0], false), 10)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(usersGot)) {
+		assert.Equal(t, "redhajuanda@gmail.com", usersGot[0].Email)
+	}
+
+	usersGot, err = repo.QueryPage(context.Background(), spec, newCursor(spec, usersGot[0], true), 10)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(usersGot)) {
+		assert.Equal(t, "johnmick@gmail.com", usersGot[0].Email)
+	}
 }
 
 func TestUpdateUser(t *testing.T) {
@@ -70,6 +119,8 @@ func TestUpdateUser(t *testing.T) {
 	repo := NewRepository(db)
 
 	for _, user := range userDataTests {
+		// users are created at the first version
+		user.Version = 1
 		user.FirstName = "Update"
 		err := repo.Update(context.Background(), user)
 		assert.NoError(t, err)
@@ -77,29 +128,87 @@ func TestUpdateUser(t *testing.T) {
 		userGot, err := repo.Get(context.Background(), user.ID)
 		assert.NoError(t, err)
 		assert.Equal(t, user.FirstName, userGot.FirstName)
+		assert.Equal(t, 2, userGot.Version)
+
+		// the user is not at the first version anymore
+		err = repo.Update(context.Background(), user)
+		assert.Equal(t, ErrVersionConflict, err)
 	}
 }
 
+func TestSetRolesUser(t *testing.T) {
+	db := test.GetTestDB(t)
+	repo := NewRepository(db)
+	user := userDataTests[0]
+
+	// users are at the second version after TestUpdateUser
+	err := repo.SetRoles(context.Background(), user.ID, 1, []string{domain.RoleAdmin}, time.Now())
+	assert.Equal(t, ErrVersionConflict, err)
+	err = repo.SetRoles(context.Background(), user.ID, 2, []string{domain.RoleAdmin, "unknown"}, time.Now())
+	assert.Error(t, err)
+
+	// a failed role replacement leaves the user unchanged
+	userGot, err := repo.Get(context.Background(), user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, userGot.Version)
+	assert.NotContains(t, userGot.Roles, domain.RoleAdmin)
+
+	err = repo.SetRoles(context.Background(), user.ID, 2, []string{domain.RoleAdmin}, time.Now())
+	assert.NoError(t, err)
+	userGot, err = repo.Get(context.Background(), user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{domain.RoleAdmin}, userGot.Roles)
+	assert.Equal(t, 3, userGot.Version)
+}
+
 func TestCountUser(t *testing.T) {
 	db := test.GetTestDB(t)
 	repo := NewRepository(db)
 
-	count, err := repo.Count(context.Background())
+	count, err := repo.Count(context.Background(), QuerySpec{})
 	assert.NoError(t, err)
 	assert.Equal(t, len(userDataTests), count)
+
+	count, err = repo.Count(context.Background(), QuerySpec{Filters: []Filter{{Field: "email", Operator: OpIn, Values: []interface{}{"johnmick@gmail.com", "unknown@gmail.com"}}}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
 }
 
 func TestDeleteUser(t *testing.T) {
 	db := test.GetTestDB(t)
 	repo := NewRepository(db)
 
-	err := repo.Delete(context.Background(), userDataTests[0].ID)
+	err := repo.Delete(context.Background(), userDataTests[0].ID, time.Now())
 	assert.NoError(t, err)
 
 	_, err = repo.Get(context.Background(), userDataTests[0].ID)
 	assert.Error(t, err)
 
-	count, err := repo.Count(context.Background())
+	count, err := repo.Count(context.Background(), QuerySpec{})
+	assert.NoError(t, err)
+	assert.Equal(t, len(userDataTests)-1, count)
+	count, err = repo.Count(context.Background(), QuerySpec{IncludeDeleted: true})
+	assert.NoError(t, err)
+	assert.Equal(t, len(userDataTests), count)
+
+	// soft-deleted users can be restored, but only once
+	err = repo.Restore(context.Background(), userDataTests[0].ID, time.Now())
+	assert.NoError(t, err)
+	_, err = repo.Get(context.Background(), userDataTests[0].ID)
+	assert.NoError(t, err)
+	err = repo.Restore(context.Background(), userDataTests[0].ID, time.Now())
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// only the users deleted before the purge time are purged
+	err = repo.Delete(context.Background(), userDataTests[0].ID, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	purged, err := repo.Purge(context.Background(), time.Now().Add(-2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, purged)
+	purged, err = repo.Purge(context.Background(), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	count, err = repo.Count(context.Background(), QuerySpec{IncludeDeleted: true})
 	assert.NoError(t, err)
 	assert.Equal(t, len(userDataTests)-1, count)
 }
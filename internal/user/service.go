@@ -2,10 +2,14 @@ package user
 
 import (
 	"context"
+	"errors"
 	"time"
 
+	"github.com/redhajuanda/gorengan/internal/auth"
 	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
 	"github.com/redhajuanda/gorengan/pkg/log"
+	"github.com/redhajuanda/gorengan/pkg/pagination"
 	"github.com/redhajuanda/gorengan/pkg/password"
 	"github.com/redhajuanda/gorengan/pkg/validation"
 )
@@ -13,11 +17,53 @@ import (
 // Service encapsulates usecase logic for users.
 type Service interface {
 	Get(ctx context.Context, id string) (User, error)
-	Query(ctx context.Context, offset, limit int) ([]User, error)
-	Count(ctx context.Context) (int, error)
+	Query(ctx context.Context, spec QuerySpec, offset, limit int) ([]User, error)
+	Count(ctx context.Context, spec QuerySpec) (int, error)
+	// QueryPage fills the page with the users matching the spec that follow its cursor.
+	QueryPage(ctx context.Context, spec QuerySpec, page *pagination.CursorPage) error
 	Create(ctx context.Context, input CreateUserRequest) (User, error)
-	Update(ctx context.Context, id string, input UpdateUserRequest) (User, error)
+	// Update updates the user, provided it is still at the given version.
+	Update(ctx context.Context, id string, version int, input UpdateUserRequest) (User, error)
+	// SetRoles replaces the roles assigned to the user, provided it is still at the given version.
+	SetRoles(ctx context.Context, id string, version int, input SetRolesRequest) (User, error)
+	// Delete soft-deletes the user, who can be restored until purged, and revokes their sessions.
 	Delete(ctx context.Context, id string) (User, error)
+	// Restore undoes the soft deletion of the user.
+	Restore(ctx context.Context, id string) (User, error)
+	// Purge permanently removes the users soft-deleted for longer than the retention and returns how many were removed.
+	Purge(ctx context.Context, retention time.Duration) (int, error)
+	// GetProfile returns the logged in user.
+	GetProfile(ctx context.Context) (User, error)
+	// UpdateProfile updates the profile fields of the logged in user, provided it is still at the given version.
+	UpdateProfile(ctx context.Context, version int, input UpdateProfileRequest) (User, error)
+	// ChangePassword changes the password of the logged in user after verifying the current one
+	// and terminates their other sessions.
+	ChangePassword(ctx context.Context, input ChangePasswordRequest) error
+}
+
+// errModified is returned when a user has been updated since the client or the service read it.
+var errModified = httperror.PreconditionFailed("The user has been modified since it was retrieved")
+
+// Verifier sends email verification links to users.
+type Verifier interface {
+	// SendVerification sends an email verification link to the user.
+	SendVerification(ctx context.Context, user domain.User) error
+}
+
+// SessionRevoker revokes the sessions of users.
+type SessionRevoker interface {
+	// RevokeSessions revokes every access and refresh token issued to the user with the specified ID.
+	RevokeSessions(ctx context.Context, userID string) error
+	// RevokeOtherSessions terminates every session of the user with the specified ID except the given one.
+	RevokeOtherSessions(ctx context.Context, userID, sessionID string) error
+}
+
+// PasswordHistory checks new passwords against the password policy and records the previous ones.
+type PasswordHistory interface {
+	// CheckNewPassword checks the new password of a user against the password policy and the password history.
+	CheckNewPassword(ctx context.Context, user domain.User, pwd string) error
+	// AddPasswordHistory records the hash of a previous password of the user with the specified ID.
+	AddPasswordHistory(ctx context.Context, userID, hash string) error
 }
 
 // User represents the data about an user.
@@ -26,11 +72,12 @@ type User struct {
 }
 
 // CreateUserRequest represents an user creation request.
+// New users are assigned the default user role and start with an unverified email address.
 type CreateUserRequest struct {
 	FirstName string `json:"first_name" validate:"required"`
 	LastName  string `json:"last_name"`
 	Email     string `json:"email" validate:"required,email,unique=users:email"`
-	Password  string `json:"password" validate:"required"`
+	Password  string `json:"password" validate:"required,password"`
 	Address   string `json:"address"`
 }
 
@@ -42,15 +89,37 @@ type UpdateUserRequest struct {
 	Address   string `json:"address"`
 }
 
+// SetRolesRequest represents a request to replace the roles assigned to an user.
+type SetRolesRequest struct {
+	Roles []string `json:"roles" validate:"required,min=1"`
+}
+
+// UpdateProfileRequest represents a request of the logged in user to update their profile.
+// Only the supplied fields are changed.
+type UpdateProfileRequest struct {
+	FirstName *string `json:"first_name" validate:"omitempty,min=1,max=100"`
+	LastName  *string `json:"last_name" validate:"omitempty,max=100"`
+	Address   *string `json:"address" validate:"omitempty,max=255"`
+}
+
+// ChangePasswordRequest represents a request of the logged in user to change their password.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,password"`
+}
+
 type service struct {
 	repo       Repository
+	verifier   Verifier
+	sessions   SessionRevoker
+	passwords  PasswordHistory
 	logger     log.Logger
 	validation *validation.CustomValidator
 }
 
 // NewService creates a new user service.
-func NewService(repo Repository, logger log.Logger) Service {
-	return service{repo, logger, validation.New()}
+func NewService(repo Repository, verifier Verifier, sessions SessionRevoker, passwords PasswordHistory, logger log.Logger) Service {
+	return service{repo, verifier, sessions, passwords, logger, validation.New()}
 }
 
 // Get returns the user with the specified the user ID.
@@ -83,57 +152,220 @@ func (s service) Create(ctx context.Context, req CreateUserRequest) (User, error
 		LastName:  req.LastName,
 		Password:  hashedPwd,
 		Address:   req.Address,
+		Roles:     []string{domain.RoleUser},
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	})
 	if err != nil {
 		return User{}, err
 	}
-	return s.Get(ctx, id)
+
+	user, err := s.Get(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	s.logger.With(ctx, "user", id, "actor", actorID(ctx)).Infof("user created")
+	s.sendVerification(ctx, user.User)
+	return user, nil
 }
 
-// Update updates the user with the specified ID.
-func (s service) Update(ctx context.Context, id string, req UpdateUserRequest) (User, error) {
+// Update updates the user with the specified ID, provided it is still at the given version.
+func (s service) Update(ctx context.Context, id string, version int, req UpdateUserRequest) (User, error) {
 	// Validate input
 	err := s.validation.Validate(req)
 	if err != nil {
 		return User{}, err
 	}
 
-	user, err := s.Get(ctx, id)
+	user, err := s.getVersion(ctx, id, version)
 	if err != nil {
 		return user, err
 	}
+	emailChanged := user.Email != req.Email
+	if emailChanged {
+		user.EmailVerifiedAt = nil
+	}
 	user.Email = req.Email
 	user.Address = req.Address
 	user.UpdatedAt = time.Now()
 
-	if err := s.repo.Update(ctx, user.User); err != nil {
+	if err := s.update(ctx, &user); err != nil {
 		return user, err
 	}
+	s.logger.With(ctx, "user", id, "actor", actorID(ctx)).Infof("user updated")
+	if emailChanged {
+		s.sendVerification(ctx, user.User)
+	}
 	return user, nil
 }
 
-// Delete deletes the user with the specified ID.
+// SetRoles replaces the roles assigned to the user with the specified ID, provided it is still at the given version.
+func (s service) SetRoles(ctx context.Context, id string, version int, req SetRolesRequest) (User, error) {
+	if err := s.validation.Validate(req); err != nil {
+		return User{}, err
+	}
+	if _, err := s.getVersion(ctx, id, version); err != nil {
+		return User{}, err
+	}
+	err := s.repo.SetRoles(ctx, id, version, uniqueRoles(req.Roles), time.Now())
+	if errors.Is(err, ErrVersionConflict) {
+		return User{}, errModified
+	}
+	if err != nil {
+		return User{}, err
+	}
+	s.logger.With(ctx, "user", id, "actor", actorID(ctx), "roles", req.Roles).Infof("user roles set")
+	return s.Get(ctx, id)
+}
+
+// Delete deletes the user with the specified ID and revokes their sessions.
 func (s service) Delete(ctx context.Context, id string) (User, error) {
 	user, err := s.Get(ctx, id)
 	if err != nil {
 		return User{}, err
 	}
-	if err = s.repo.Delete(ctx, id); err != nil {
+	// sessions are revoked first as the tokens of soft-deleted users can no longer be looked up
+	if err = s.sessions.RevokeSessions(ctx, id); err != nil {
+		return User{}, err
+	}
+	if err = s.repo.Delete(ctx, id, time.Now()); err != nil {
+		return User{}, err
+	}
+	s.logger.With(ctx, "user", id, "actor", actorID(ctx)).Infof("user deleted")
+	return user, nil
+}
+
+// Restore undoes the soft deletion of the user.
+func (s service) Restore(ctx context.Context, id string) (User, error) {
+	if err := s.repo.Restore(ctx, id, time.Now()); err != nil {
+		return User{}, err
+	}
+	s.logger.With(ctx, "user", id, "actor", actorID(ctx)).Infof("user restored")
+	return s.Get(ctx, id)
+}
+
+// Purge permanently removes the users soft-deleted for longer than the retention and returns how many were removed.
+func (s service) Purge(ctx context.Context, retention time.Duration) (int, error) {
+	purged, err := s.repo.Purge(ctx, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	s.logger.With(ctx, "purged", purged, "retention", retention.String()).Infof("deleted users purged")
+	return purged, nil
+}
+
+// GetProfile returns the logged in user.
+func (s service) GetProfile(ctx context.Context) (User, error) {
+	id, err := currentUserID(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	return s.Get(ctx, id)
+}
+
+// UpdateProfile updates the profile fields of the logged in user, provided it is still at the given version.
+func (s service) UpdateProfile(ctx context.Context, version int, req UpdateProfileRequest) (User, error) {
+	if err := s.validation.Validate(req); err != nil {
+		return User{}, err
+	}
+	id, err := currentUserID(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	user, err := s.getVersion(ctx, id, version)
+	if err != nil {
+		return User{}, err
+	}
+
+	if req.FirstName != nil {
+		user.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		user.LastName = *req.LastName
+	}
+	if req.Address != nil {
+		user.Address = *req.Address
+	}
+	user.UpdatedAt = time.Now()
+	if err := s.update(ctx, &user); err != nil {
 		return User{}, err
 	}
+	s.logger.With(ctx, "user", id, "actor", actorID(ctx)).Infof("profile updated")
 	return user, nil
 }
 
-// Count returns the number of users.
-func (s service) Count(ctx context.Context) (int, error) {
-	return s.repo.Count(ctx)
+// ChangePassword changes the password of the logged in user after verifying the current one.
+// Every other session of the user is terminated.
+func (s service) ChangePassword(ctx context.Context, req ChangePasswordRequest) error {
+	if err := s.validation.Validate(req); err != nil {
+		return err
+	}
+	id, err := currentUserID(ctx)
+	if err != nil {
+		return err
+	}
+	user, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !password.ComparePasswords(user.Password, []byte(req.CurrentPassword)) {
+		return httperror.BadRequest("Current password is incorrect")
+	}
+	if err := s.passwords.CheckNewPassword(ctx, user.User, req.NewPassword); err != nil {
+		return err
+	}
+
+	hashedPwd, err := password.HashAndSalt([]byte(req.NewPassword))
+	if err != nil {
+		return err
+	}
+	previous := user.Password
+	user.Password = hashedPwd
+	user.UpdatedAt = time.Now()
+	if err := s.update(ctx, &user); err != nil {
+		return err
+	}
+	if err := s.passwords.AddPasswordHistory(ctx, user.ID, previous); err != nil {
+		return err
+	}
+	s.logger.With(ctx, "user", id).Infof("password changed")
+	// the other devices have to log in again with the new password
+	return s.sessions.RevokeOtherSessions(ctx, id, currentSessionID(ctx))
+}
+
+// getVersion returns the user with the specified ID, provided it is still at the given version.
+func (s service) getVersion(ctx context.Context, id string, version int) (User, error) {
+	user, err := s.Get(ctx, id)
+	if err != nil {
+		return User{}, err
+	}
+	if user.Version != version {
+		return User{}, errModified
+	}
+	return user, nil
 }
 
-// Query returns the users with the specified offset and limit.
-func (s service) Query(ctx context.Context, offset, limit int) ([]User, error) {
-	items, err := s.repo.Query(ctx, offset, limit)
+// update saves the user and increments its version, failing if it has been updated since it was read.
+func (s service) update(ctx context.Context, user *User) error {
+	err := s.repo.Update(ctx, user.User)
+	if errors.Is(err, ErrVersionConflict) {
+		return errModified
+	}
+	if err != nil {
+		return err
+	}
+	user.Version++
+	return nil
+}
+
+// Count returns the number of users matching the spec.
+func (s service) Count(ctx context.Context, spec QuerySpec) (int, error) {
+	return s.repo.Count(ctx, spec)
+}
+
+// Query returns the users matching the spec, sorted as requested, with the specified offset and limit.
+func (s service) Query(ctx context.Context, spec QuerySpec, offset, limit int) ([]User, error) {
+	items, err := s.repo.Query(ctx, spec, offset, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -143,3 +375,91 @@ func (s service) Query(ctx context.Context, offset, limit int) ([]User, error) {
 	}
 	return result, nil
 }
+
+// QueryPage fills the page with the users matching the spec that follow its cursor in the sort order of the spec,
+// along with the cursors of the next and previous pages if there are any.
+// Cursors are only valid for the sort order they have been issued for.
+func (s service) QueryPage(ctx context.Context, spec QuerySpec, page *pagination.CursorPage) error {
+	cursor := page.Cursor
+	if !cursor.IsZero() && cursor.Sort != spec.sortKey() {
+		return httperror.BadRequest("The cursor does not match the sort order")
+	}
+	items, err := s.repo.QueryPage(ctx, spec, cursor, page.Limit())
+	if err != nil {
+		if err == pagination.ErrInvalidCursor {
+			return httperror.BadRequest("Invalid cursor")
+		}
+		return err
+	}
+	// the extra item is the first one of the next page, or the last one of the previous page for backward cursors
+	more := len(items) > page.PerPage
+	if more && cursor.Backward {
+		items = items[len(items)-page.PerPage:]
+	} else if more {
+		items = items[:page.PerPage]
+	}
+
+	result := []User{}
+	for _, item := range items {
+		result = append(result, User{item})
+	}
+	page.Items = result
+	if len(items) == 0 {
+		return nil
+	}
+	if more || cursor.Backward {
+		page.NextCursor = newCursor(spec, items[len(items)-1], false).Encode()
+	}
+	if (more && cursor.Backward) || (!cursor.IsZero() && !cursor.Backward) {
+		page.PrevCursor = newCursor(spec, items[0], true).Encode()
+	}
+	return nil
+}
+
+// sendVerification sends an email verification link to the user.
+// Failures are only logged, since the user can request a new link later.
+func (s service) sendVerification(ctx context.Context, user domain.User) {
+	if err := s.verifier.SendVerification(ctx, user); err != nil {
+		s.logger.With(ctx, "user", user.ID).Errorf("failed to send email verification: %v", err)
+	}
+}
+
+// currentUserID returns the ID of the effective user of the request,
+// or an error if the request is not authenticated.
+func currentUserID(ctx context.Context) (string, error) {
+	identity := auth.CurrentIdentity(ctx)
+	if identity == nil {
+		return "", httperror.Unauthorized("")
+	}
+	return identity.GetID(), nil
+}
+
+// currentSessionID returns the ID of the session the request belongs to,
+// or an empty string if it is not authenticated with an access token.
+func currentSessionID(ctx context.Context) string {
+	principal, _ := auth.CurrentPrincipal(ctx)
+	return principal.SessionID
+}
+
+// actorID returns the ID of the user performing the request, which is the administrator
+// if a user is impersonated. It returns an empty string if the request is not authenticated.
+func actorID(ctx context.Context) string {
+	principal, ok := auth.CurrentPrincipal(ctx)
+	if !ok {
+		return ""
+	}
+	return principal.RealID()
+}
+
+// uniqueRoles returns the given role names without duplicates, keeping their order.
+func uniqueRoles(roles []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, role := range roles {
+		if !seen[role] {
+			seen[role] = true
+			result = append(result, role)
+		}
+	}
+	return result
+}
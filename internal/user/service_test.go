@@ -5,21 +5,34 @@ package user
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/labstack/echo"
+	"github.com/redhajuanda/gorengan/internal/auth"
 	"github.com/redhajuanda/gorengan/internal/domain"
+	"github.com/redhajuanda/gorengan/internal/httperror"
 	"github.com/redhajuanda/gorengan/pkg/log"
+	"github.com/redhajuanda/gorengan/pkg/pagination"
+	"github.com/redhajuanda/gorengan/pkg/password"
 	"github.com/stretchr/testify/assert"
 )
 
 var serviceTest Service
+var verifierTest = &mockVerifier{}
+var sessionsTest = &mockSessionRevoker{}
 
 func createNewServiceTest(t *testing.T) Service {
 	if serviceTest != nil {
 		return serviceTest
 	}
 	logger, _ := log.NewForTest()
-	serviceTest = NewService(&mockRepository{}, logger)
+	serviceTest = NewService(&mockRepository{}, verifierTest, sessionsTest, &mockPasswordHistory{}, logger)
 	return serviceTest
 }
 
@@ -31,21 +44,30 @@ func TestServiceCreateUser(t *testing.T) {
 			FirstName: "Redha",
 			LastName:  "Redha",
 			Email:     "Redha@sdfdsf.vo",
-			Password:  "Redha",
+			Password:  "kopi-tubruk-42",
 			Address:   "Redha",
 		},
 	}
 
+	// passwords must satisfy the password policy
+	_, err := service.Create(context.Background(), CreateUserRequest{FirstName: "Redha", Email: "redha@sdfdsf.vo", Password: "a"})
+	assert.Error(t, err)
+	_, err = service.Create(context.Background(), CreateUserRequest{FirstName: "Redha", Email: "redha@sdfdsf.vo", Password: "redha-1234"})
+	assert.Error(t, err)
+
 	for _, inputRequest := range inputRequests {
-		_, err := service.Create(context.Background(), inputRequest)
+		user, err := service.Create(context.Background(), inputRequest)
 		assert.NoError(t, err)
+		assert.Equal(t, []string{domain.RoleUser}, user.Roles)
+		assert.False(t, user.IsEmailVerified())
+		assert.Contains(t, verifierTest.sent, user.ID)
 	}
 }
 
 func TestServiceGetUser(t *testing.T) {
 	service := createNewServiceTest(t)
 
-	users, err := service.Query(context.Background(), 0, 0)
+	users, err := service.Query(context.Background(), QuerySpec{}, 0, 0)
 	assert.NoError(t, err)
 
 	user, err := service.Get(context.Background(), users[0].ID)
@@ -56,7 +78,7 @@ func TestServiceGetUser(t *testing.T) {
 func TestServiceQueryUser(t *testing.T) {
 	service := createNewServiceTest(t)
 
-	users, err := service.Query(context.Background(), 0, 0)
+	users, err := service.Query(context.Background(), QuerySpec{}, 0, 0)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(users))
 }
@@ -64,73 +86,487 @@ func TestServiceQueryUser(t *testing.T) {
 func TestServiceCountUser(t *testing.T) {
 	service := createNewServiceTest(t)
 
-	count, err := service.Count(context.Background())
+	count, err := service.Count(context.Background(), QuerySpec{})
 	assert.NoError(t, err)
 	assert.Equal(t, 1, count)
 }
 
+func TestServiceUpdateUser(t *testing.T) {
+	service := createNewServiceTest(t)
+	users, err := service.Query(context.Background(), QuerySpec{}, 0, 0)
+	assert.NoError(t, err)
+	user := users[0]
+
+	updated, err := service.Update(context.Background(), user.ID, user.Version, UpdateUserRequest{Email: user.Email, Address: "Jakarta"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Jakarta", updated.Address)
+	assert.Equal(t, user.Version+1, updated.Version)
+
+	// updates based on a previous version are refused
+	_, err = service.Update(context.Background(), user.ID, user.Version, UpdateUserRequest{Email: user.Email})
+	assert.Equal(t, errModified, err)
+}
+
+func TestServiceSetRoles(t *testing.T) {
+	logger, _ := log.NewForTest()
+	service := NewService(&mockRepository{users: []domain.User{{ID: "jane", Roles: []string{domain.RoleUser}, Version: 1}}}, &mockVerifier{}, &mockSessionRevoker{}, &mockPasswordHistory{}, logger)
+
+	_, err := service.SetRoles(context.Background(), "jane", 1, SetRolesRequest{})
+	assert.Error(t, err)
+	_, err = service.SetRoles(context.Background(), "jane", 2, SetRolesRequest{Roles: []string{domain.RoleAdmin}})
+	assert.Equal(t, errModified, err)
+
+	user, err := service.SetRoles(context.Background(), "jane", 1, SetRolesRequest{Roles: []string{domain.RoleAdmin, domain.RoleAdmin}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{domain.RoleAdmin}, user.Roles)
+	// changing the roles changes the version, and so the ETag
+	assert.Equal(t, 2, user.Version)
+	_, err = service.SetRoles(context.Background(), "jane", 1, SetRolesRequest{Roles: []string{domain.RoleUser}})
+	assert.Equal(t, errModified, err)
+}
+
+func TestAPIRoleAssignment(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{users: []domain.User{{ID: "jane", Email: "jane@gorengan.local", Roles: []string{domain.RoleUser}, Version: 1}}}
+	service := NewService(repo, &mockVerifier{}, &mockSessionRevoker{}, &mockPasswordHistory{}, logger)
+	apiKeys := &mockAPIKeys{}
+	checker := mockChecker{"support": {PermissionRead, PermissionWrite}}
+	e := echo.New()
+	e.HTTPErrorHandler = httperror.CustomHTTPErrorHandler
+	RegisterService(*e.Group(""), service, nil, apiKeys, checker, logger)
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("X-API-Key", "key")
+		req.Header.Set("If-Match", "*")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// users:write does not allow assigning roles
+	apiKeys.principal = auth.Principal{ID: "support", Roles: []string{"support"}}
+	rec := send(http.MethodPost, "/users", `{"first_name":"Joko","email":"joko@gorengan.local","password":"kopi-tubruk-42","roles":["admin"]}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, []string{domain.RoleUser}, repo.users[1].Roles)
+	rec = send(http.MethodPut, "/users/jane", `{"email":"jane@gorengan.local","roles":["admin"]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{domain.RoleUser}, repo.users[0].Roles)
+	rec = send(http.MethodPut, "/users/jane/roles", `{"roles":["admin"]}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, []string{domain.RoleUser}, repo.users[0].Roles)
+
+	apiKeys.principal = auth.Principal{ID: "admin", Roles: []string{domain.RoleAdmin}}
+	rec = send(http.MethodPut, "/users/jane/roles", `{"roles":["admin"]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{domain.RoleAdmin}, repo.users[0].Roles)
+}
+
+func TestServiceProfile(t *testing.T) {
+	service := createNewServiceTest(t)
+	users, err := service.Query(context.Background(), QuerySpec{}, 0, 0)
+	assert.NoError(t, err)
+	user := users[0]
+
+	_, err = service.GetProfile(context.Background())
+	assert.Error(t, err)
+
+	ctx := auth.WithPrincipal(context.Background(), auth.Principal{ID: user.ID, SessionID: "laptop"})
+	profile, err := service.GetProfile(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, profile.ID)
+
+	firstName := "Jane"
+	_, err = service.UpdateProfile(ctx, profile.Version-1, UpdateProfileRequest{FirstName: &firstName})
+	assert.Equal(t, errModified, err)
+	profile, err = service.UpdateProfile(ctx, profile.Version, UpdateProfileRequest{FirstName: &firstName})
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane", profile.FirstName)
+	assert.Equal(t, user.LastName, profile.LastName)
+	empty := ""
+	_, err = service.UpdateProfile(ctx, profile.Version, UpdateProfileRequest{FirstName: &empty})
+	assert.Error(t, err)
+
+	err = service.ChangePassword(ctx, ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "secret"})
+	assert.Error(t, err)
+	err = service.ChangePassword(ctx, ChangePasswordRequest{CurrentPassword: "kopi-tubruk-42", NewPassword: "short"})
+	assert.Error(t, err)
+	err = service.ChangePassword(ctx, ChangePasswordRequest{CurrentPassword: "kopi-tubruk-42", NewPassword: "es-teh-manis"})
+	assert.NoError(t, err)
+	profile, err = service.GetProfile(ctx)
+	assert.NoError(t, err)
+	assert.True(t, password.ComparePasswords(profile.Password, []byte("es-teh-manis")))
+	// the other sessions are terminated
+	assert.Equal(t, "laptop", sessionsTest.kept[user.ID])
+
+	// previous passwords cannot be reused while the history is enabled
+	password.SetPolicy(password.Policy{MinLength: 8, History: 2})
+	defer password.SetPolicy(password.DefaultPolicy())
+	err = service.ChangePassword(ctx, ChangePasswordRequest{CurrentPassword: "es-teh-manis", NewPassword: "kopi-tubruk-42"})
+	assert.Error(t, err)
+	err = service.ChangePassword(ctx, ChangePasswordRequest{CurrentPassword: "es-teh-manis", NewPassword: "es-teh-manis"})
+	assert.Error(t, err)
+}
+
 func TestServiceDeleteUser(t *testing.T) {
 	service := createNewServiceTest(t)
-	users, err := service.Query(context.Background(), 0, 0)
+	users, err := service.Query(context.Background(), QuerySpec{}, 0, 0)
 	assert.NoError(t, err)
 
 	_, err = service.Delete(context.Background(), users[0].ID)
 	assert.NoError(t, err)
+	assert.Contains(t, sessionsTest.revoked, users[0].ID)
 
-	count, err := service.Count(context.Background())
+	count, err := service.Count(context.Background(), QuerySpec{})
 	assert.NoError(t, err)
 	assert.Equal(t, 0, count)
+	_, err = service.Get(context.Background(), users[0].ID)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// soft-deleted users are still listed on request
+	count, err = service.Count(context.Background(), QuerySpec{IncludeDeleted: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestServiceRestoreUser(t *testing.T) {
+	logger, _ := log.NewForTest()
+	service := NewService(&mockRepository{users: []domain.User{{ID: "jane"}}}, &mockVerifier{}, &mockSessionRevoker{}, &mockPasswordHistory{}, logger)
+
+	// only soft-deleted users can be restored
+	_, err := service.Restore(context.Background(), "jane")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	_, err = service.Delete(context.Background(), "jane")
+	assert.NoError(t, err)
+	user, err := service.Restore(context.Background(), "jane")
+	assert.NoError(t, err)
+	assert.Equal(t, "jane", user.ID)
+	assert.False(t, user.IsDeleted())
+}
+
+func TestServicePurgeUsers(t *testing.T) {
+	logger, _ := log.NewForTest()
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+	repo := &mockRepository{users: []domain.User{
+		{ID: "active"},
+		{ID: "old", DeletedAt: &old},
+		{ID: "recent", DeletedAt: &recent},
+	}}
+	service := NewService(repo, &mockVerifier{}, &mockSessionRevoker{}, &mockPasswordHistory{}, logger)
+
+	purged, err := service.Purge(context.Background(), 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	count, err := service.Count(context.Background(), QuerySpec{IncludeDeleted: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestServiceQueryPage(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{}
+	created := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		repo.users = append(repo.users, domain.User{
+			ID:        domain.GenerateID(),
+			Email:     fmt.Sprintf("user%d@gorengan.local", i),
+			CreatedAt: created.Add(time.Duration(i%3) * time.Hour),
+		})
+	}
+	service := NewService(repo, verifierTest, sessionsTest, &mockPasswordHistory{}, logger)
+	spec := QuerySpec{Sort: []SortField{{Field: "created_at", Desc: true}}}
+	emails := func(page *pagination.CursorPage) []string {
+		result := []string{}
+		for _, user := range page.Items.([]User) {
+			result = append(result, user.Email)
+		}
+		return result
+	}
+	next := func(cursor string) *pagination.CursorPage {
+		decoded, err := pagination.DecodeCursor(cursor)
+		assert.NoError(t, err)
+		page := pagination.NewCursorPage(decoded, 2, -1)
+		assert.NoError(t, service.QueryPage(context.Background(), spec, page))
+		return page
+	}
+
+	first := pagination.NewCursorPage(pagination.Cursor{}, 2, -1)
+	assert.NoError(t, service.QueryPage(context.Background(), spec, first))
+	users := []string{}
+	users = append(users, emails(first)...)
+	assert.Empty(t, first.PrevCursor)
+	assert.NotEmpty(t, first.NextCursor)
+
+	second := next(first.NextCursor)
+	users = append(users, emails(second)...)
+	assert.NotEmpty(t, second.PrevCursor)
+	assert.NotEmpty(t, second.NextCursor)
+
+	last := next(second.NextCursor)
+	users = append(users, emails(last)...)
+	assert.Len(t, emails(last), 1)
+	assert.Empty(t, last.NextCursor)
+
+	// every user is listed once, newest first and by ID among users created at the same time
+	assert.Len(t, users, 5)
+	sorted := append([]domain.User{}, repo.users...)
+	sort.SliceStable(sorted, func(i, j int) bool { return repo.less(spec, sorted[i], sorted[j]) })
+	for i, user := range sorted {
+		assert.Equal(t, user.Email, users[i])
+	}
+
+	// previous cursors go back to the same pages
+	assert.Equal(t, emails(second), emails(next(last.PrevCursor)))
+	back := next(second.PrevCursor)
+	assert.Equal(t, emails(first), emails(back))
+	assert.Empty(t, back.PrevCursor)
+	assert.Equal(t, second.NextCursor != "", back.NextCursor != "")
+
+	// cursors are only valid for the sort order they have been issued for
+	cursor, _ := pagination.DecodeCursor(first.NextCursor)
+	err := service.QueryPage(context.Background(), QuerySpec{}, pagination.NewCursorPage(cursor, 2, -1))
+	assert.Error(t, err)
+}
+
+type mockAPIKeys struct {
+	principal auth.Principal
+}
+
+// VerifyAPIKey accepts any key as the key of the principal.
+func (m *mockAPIKeys) VerifyAPIKey(ctx context.Context, key string) (auth.Principal, error) {
+	return m.principal, nil
+}
+
+// mockChecker maps role names to their permissions.
+type mockChecker map[string][]string
+
+// GetPermissions returns the names of the permissions mapped to any of the given roles.
+func (m mockChecker) GetPermissions(ctx context.Context, roles []string) ([]string, error) {
+	permissions := []string{}
+	for _, role := range roles {
+		permissions = append(permissions, m[role]...)
+	}
+	return permissions, nil
+}
+
+type mockVerifier struct {
+	sent []string
+}
+
+// SendVerification records the ID of the user.
+func (m *mockVerifier) SendVerification(ctx context.Context, user domain.User) error {
+	m.sent = append(m.sent, user.ID)
+	return nil
+}
+
+type mockSessionRevoker struct {
+	// revoked holds the IDs of the users whose sessions have all been revoked
+	revoked []string
+	// kept holds the ID of the session kept by the last revocation by user ID
+	kept map[string]string
+}
+
+// RevokeSessions records the ID of the user.
+func (m *mockSessionRevoker) RevokeSessions(ctx context.Context, userID string) error {
+	m.revoked = append(m.revoked, userID)
+	return nil
+}
+
+// RevokeOtherSessions records the ID of the session kept.
+func (m *mockSessionRevoker) RevokeOtherSessions(ctx context.Context, userID, sessionID string) error {
+	if m.kept == nil {
+		m.kept = map[string]string{}
+	}
+	m.kept[userID] = sessionID
+	return nil
+}
+
+type mockPasswordHistory struct {
+	// hashes holds the hashes of previous passwords by user ID, most recent first
+	hashes map[string][]string
+}
+
+// CheckNewPassword checks the new password against the current policy and the recorded hashes.
+func (m *mockPasswordHistory) CheckNewPassword(ctx context.Context, user domain.User, pwd string) error {
+	policy := password.CurrentPolicy()
+	previous := []string{}
+	for _, hash := range m.hashes[user.ID] {
+		if len(previous) >= policy.History-1 {
+			break
+		}
+		previous = append(previous, hash)
+	}
+	return policy.CheckChange(pwd, user.Password, previous, user.Email, user.FirstName, user.LastName)
+}
+
+// AddPasswordHistory records the hash of a previous password of the user with given ID.
+func (m *mockPasswordHistory) AddPasswordHistory(ctx context.Context, userID, hash string) error {
+	if m.hashes == nil {
+		m.hashes = map[string][]string{}
+	}
+	m.hashes[userID] = append([]string{hash}, m.hashes[userID]...)
+	return nil
 }
 
 type mockRepository struct {
 	users []domain.User
 }
 
-// Get returns the user with the specified user ID.
+// Get returns the user with the specified user ID, unless it has been soft-deleted.
 func (m mockRepository) Get(ctx context.Context, id string) (domain.User, error) {
 	for _, user := range m.users {
-		if user.ID == id {
+		if user.ID == id && !user.IsDeleted() {
 			return user, nil
 		}
 	}
 	return domain.User{}, sql.ErrNoRows
 }
 
-// Count returns the number of users.
-func (m mockRepository) Count(ctx context.Context) (int, error) {
-	return len(m.users), nil
+// Count returns the number of users matching the spec.
+func (m mockRepository) Count(ctx context.Context, spec QuerySpec) (int, error) {
+	return len(m.matching(spec)), nil
 }
 
-// Query returns the list of users with the given offset and limit.
-func (m mockRepository) Query(ctx context.Context, offset, limit int) ([]domain.User, error) {
-	return m.users, nil
+// Query returns the list of users matching the spec with the given offset and limit.
+func (m mockRepository) Query(ctx context.Context, spec QuerySpec, offset, limit int) ([]domain.User, error) {
+	return m.matching(spec), nil
+}
+
+// matching returns the users listed by the spec. Only soft deletion is taken into account, filters are ignored.
+func (m mockRepository) matching(spec QuerySpec) []domain.User {
+	users := []domain.User{}
+	for _, user := range m.users {
+		if spec.IncludeDeleted || !user.IsDeleted() {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// QueryPage returns at most limit users matching the spec that follow the cursor in the sort order of the spec,
+// or precede it for backward cursors. Filters are ignored.
+func (m mockRepository) QueryPage(ctx context.Context, spec QuerySpec, cursor pagination.Cursor, limit int) ([]domain.User, error) {
+	sorted := m.matching(spec)
+	sort.SliceStable(sorted, func(i, j int) bool { return m.less(spec, sorted[i], sorted[j]) })
+	start, end := 0, len(sorted)
+	if !cursor.IsZero() {
+		for i, user := range sorted {
+			if user.ID == cursor.ID && cursor.Backward {
+				end = i
+			} else if user.ID == cursor.ID {
+				start = i + 1
+			}
+		}
+	}
+	users := sorted[start:end]
+	if len(users) > limit && cursor.Backward {
+		users = users[len(users)-limit:]
+	} else if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// less checks whether a user comes before another in the sort order of the spec.
+func (m mockRepository) less(spec QuerySpec, a, b domain.User) bool {
+	for _, s := range spec.sortFields() {
+		var cmp int
+		if queryFields[s.Field].timestamp {
+			ta, _ := time.Parse(time.RFC3339Nano, sortValue(a, s.Field))
+			tb, _ := time.Parse(time.RFC3339Nano, sortValue(b, s.Field))
+			if ta.Before(tb) {
+				cmp = -1
+			} else if ta.After(tb) {
+				cmp = 1
+			}
+		} else if va, vb := sortValue(a, s.Field), sortValue(b, s.Field); va != vb {
+			cmp = 1
+			if va < vb {
+				cmp = -1
+			}
+		}
+		if s.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return a.ID < b.ID
 }
 
 // Create saves a new user in the storage.
 func (m *mockRepository) Create(ctx context.Context, user domain.User) error {
+	user.Version = 1
 	m.users = append(m.users, user)
 	return nil
 }
 
-// Update updates the user with given ID in the storage.
+// Update updates the user with given ID in the storage and increments its version.
 func (m *mockRepository) Update(ctx context.Context, user domain.User) error {
 	for i, item := range m.users {
 		if item.ID == user.ID {
+			if item.Version != user.Version {
+				return ErrVersionConflict
+			}
+			user.Version++
 			m.users[i] = user
+			return nil
+		}
+	}
+	return ErrVersionConflict
+}
+
+// Delete soft-deletes the user with given ID.
+func (m *mockRepository) Delete(ctx context.Context, id string, deletedAt time.Time) error {
+	for i, user := range m.users {
+		if user.ID == id && !user.IsDeleted() {
+			m.users[i].DeletedAt = &deletedAt
 			break
 		}
 	}
 	return nil
 }
 
-// Delete removes the user with given ID from the storage.
-func (m *mockRepository) Delete(ctx context.Context, id string) error {
+// Restore undoes the soft deletion of the user with given ID.
+func (m *mockRepository) Restore(ctx context.Context, id string, restoredAt time.Time) error {
+	for i, user := range m.users {
+		if user.ID == id && user.IsDeleted() {
+			m.users[i].DeletedAt = nil
+			m.users[i].UpdatedAt = restoredAt
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// Purge permanently removes the users soft-deleted before the given time.
+func (m *mockRepository) Purge(ctx context.Context, before time.Time) (int, error) {
+	users := []domain.User{}
+	for _, user := range m.users {
+		if !user.IsDeleted() || !user.DeletedAt.Before(before) {
+			users = append(users, user)
+		}
+	}
+	purged := len(m.users) - len(users)
+	m.users = users
+	return purged, nil
+}
+
+// SetRoles replaces the roles assigned to the user with given ID and increments its version.
+func (m *mockRepository) SetRoles(ctx context.Context, id string, version int, roles []string, updatedAt time.Time) error {
 	for i, user := range m.users {
 		if user.ID == id {
-			m.users[i] = m.users[len(m.users)-1]
-			m.users = m.users[:len(m.users)-1]
-			break
+			if user.Version != version {
+				return ErrVersionConflict
+			}
+			m.users[i].Roles = roles
+			m.users[i].Version++
+			m.users[i].UpdatedAt = updatedAt
+			return nil
 		}
 	}
-	return nil
+	return ErrVersionConflict
 }
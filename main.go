@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo"
@@ -15,6 +16,10 @@ import (
 	"github.com/redhajuanda/gorengan/internal/httperror"
 	"github.com/redhajuanda/gorengan/internal/user"
 	"github.com/redhajuanda/gorengan/pkg/log"
+	"github.com/redhajuanda/gorengan/pkg/mailer"
+	"github.com/redhajuanda/gorengan/pkg/pagination"
+	"github.com/redhajuanda/gorengan/pkg/password"
+	"github.com/redhajuanda/gorengan/pkg/realip"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -28,6 +33,9 @@ func main() {
 
 	// Load config
 	cfg := config.LoadDefault()
+	if cfg.JWT.AccessTokenExpiration == 0 && cfg.JWT.TokenExpiration > 0 {
+		logger.Infof("JWT_TOKEN_EXPIRATION is deprecated, set the access token lifetime in minutes with JWT_ACCESS_TOKEN_EXPIRATION_MINUTES")
+	}
 
 	// Connect DB
 	connString := fmt.Sprintf("%v:%v@/%v?charset=utf8&parseTime=True&loc=Local&", cfg.Database.Username, cfg.Database.Password, cfg.Database.DBName)
@@ -44,10 +52,64 @@ func main() {
 		fmt.Println(err)
 	}
 
+	// the purge-users command removes the users soft-deleted for longer than the retention instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "purge-users" {
+		if err := purgeUsers(db, cfg, logger); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	hasher, err := password.New(password.Config{
+		Algorithm:     cfg.Password.Algorithm,
+		BcryptCost:    cfg.Password.BcryptCost,
+		Argon2Time:    cfg.Password.Argon2Time,
+		Argon2Memory:  cfg.Password.Argon2Memory,
+		Argon2Threads: cfg.Password.Argon2Threads,
+		ScryptN:       cfg.Password.ScryptN,
+		ScryptR:       cfg.Password.ScryptR,
+		ScryptP:       cfg.Password.ScryptP,
+		Pepper:        cfg.Password.Pepper,
+	})
+	if err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+	password.SetDefault(hasher)
+
+	policy, err := loadPasswordPolicy(cfg)
+	if err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+	password.SetPolicy(policy)
+
+	if err := realip.SetTrustedProxies(strings.Split(cfg.Server.TrustedProxies, ",")); err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	if cfg.Pagination.CursorKey != "" {
+		pagination.SetCursorKey([]byte(cfg.Pagination.CursorKey))
+	}
+
+	keys, err := loadKeys(cfg)
+	if err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+
+	mail, err := mailer.New(cfg.Mail.Driver, cfg.Mail.From, cfg.Mail.Dir, logger)
+	if err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+
 	address := fmt.Sprintf(":%v", cfg.Server.PORT)
 	server := http.Server{
 		Addr:    address,
-		Handler: buildHandlers(db, cfg, logger),
+		Handler: buildHandlers(db, cfg, keys, mail, logger),
 	}
 	logger.Infof("server %v is running at %v", Version, address)
 
@@ -56,25 +118,74 @@ func main() {
 	}
 }
 
-func buildHandlers(db *sql.DB, cfg config.Config, logger log.Logger) http.Handler {
+// purgeUsers permanently removes the users soft-deleted for longer than the configured retention.
+func purgeUsers(db *sql.DB, cfg config.Config, logger log.Logger) error {
+	if cfg.Users.PurgeRetention <= 0 {
+		return fmt.Errorf("invalid purge retention of %v days", cfg.Users.PurgeRetention)
+	}
+	// purging sends no email verification and handles no password, so the service needs no auth dependency
+	service := user.NewService(user.NewRepository(db), nil, nil, nil, logger)
+	_, err := service.Purge(context.Background(), time.Duration(cfg.Users.PurgeRetention)*24*time.Hour)
+	return err
+}
+
+// loadKeys loads the keys used to sign access tokens.
+// Keys are loaded from the keys directory if one is configured, otherwise the shared signing key is used.
+func loadKeys(cfg config.Config) (*auth.KeySet, error) {
+	if cfg.JWT.KeysDir == "" {
+		return auth.NewHMACKeySet(cfg.JWT.SigningKey), nil
+	}
+	return auth.LoadKeySet(cfg.JWT.KeysDir, cfg.JWT.ActiveKeyID)
+}
+
+// loadPasswordPolicy builds the password policy, opening the breached password list if one is configured.
+func loadPasswordPolicy(cfg config.Config) (password.Policy, error) {
+	policy := password.Policy{
+		MinLength:   cfg.Password.MinLength,
+		MinClasses:  cfg.Password.MinClasses,
+		MinStrength: cfg.Password.MinStrength,
+		History:     cfg.Password.History,
+	}
+	if cfg.Password.BreachedList != "" {
+		breached, err := password.OpenBreachedList(cfg.Password.BreachedList)
+		if err != nil {
+			return password.Policy{}, err
+		}
+		policy.Breached = breached
+	}
+	return policy, nil
+}
+
+func buildHandlers(db *sql.DB, cfg config.Config, keys *auth.KeySet, mail mailer.Mailer, logger log.Logger) http.Handler {
 	r := echo.New()
 	r.Pre(middleware.RemoveTrailingSlash())
 
 	// Set custom HTTP error handler
 	r.HTTPErrorHandler = httperror.CustomHTTPErrorHandler
 
+	authRepo := auth.NewRepository(db)
+	revocations := auth.NewSQLRevocationStore(db)
+	verifier := auth.NewVerifier(keys, revocations)
+
+	authService := auth.NewService(cfg, keys, revocations, auth.NewSQLLockoutStore(db), mail, logger, authRepo)
+
 	// Register user service
 	user.RegisterService(
 		*r.Group(""),
-		user.NewService(user.NewRepository(db), logger),
-		cfg,
+		user.NewService(user.NewRepository(db), authService, authService, authService, logger),
+		verifier,
+		authService,
+		authRepo,
 		logger,
 	)
 
 	// Register auth service
 	auth.RegisterService(
 		*r.Group(""),
-		auth.NewService(cfg.JWT.SigningKey, cfg.JWT.TokenExpiration, logger, auth.NewRepository(db)),
+		authService,
+		keys,
+		verifier,
+		authRepo,
 		logger,
 	)
 
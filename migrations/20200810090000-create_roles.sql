@@ -0,0 +1,28 @@
+-- +migrate Up
+CREATE TABLE roles (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    name VARCHAR(32) NOT NULL UNIQUE,
+    description VARCHAR(255),
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE user_roles (
+    user_id VARCHAR(36) NOT NULL,
+    role_id VARCHAR(36) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, role_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+INSERT INTO `roles` (`id`, `name`, `description`, `created_at`, `updated_at`) VALUES
+('0b7c4a3e-5b0c-4d36-9a43-1f3e2b8f6a01',	'admin',	'Full access to every resource',	'2020-08-10 09:00:00',	'2020-08-10 09:00:00'),
+('5d2e9f6a-8c1b-4e7d-b0a4-7c9e3d1f2b02',	'user',	'Regular authenticated user',	'2020-08-10 09:00:00',	'2020-08-10 09:00:00');
+
+INSERT INTO `user_roles` (`user_id`, `role_id`) VALUES
+('c7a2df29-047c-4674-a553-0416d4325e6c',	'0b7c4a3e-5b0c-4d36-9a43-1f3e2b8f6a01');
+
+-- +migrate Down
+DROP TABLE user_roles;
+DROP TABLE roles;
@@ -0,0 +1,18 @@
+-- +migrate Up
+CREATE TABLE role_permissions (
+    role_id VARCHAR(36) NOT NULL,
+    permission VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (role_id, permission),
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+);
+
+INSERT INTO `roles` (`id`, `name`, `description`, `created_at`, `updated_at`) VALUES
+('9a4f1c7e-2d6b-4f83-8e15-3b7d9c0a4e03',	'support',	'Read-only access for support staff',	'2020-08-12 09:00:00',	'2020-08-12 09:00:00');
+
+INSERT INTO `role_permissions` (`role_id`, `permission`) VALUES
+('9a4f1c7e-2d6b-4f83-8e15-3b7d9c0a4e03',	'users:read');
+
+-- +migrate Down
+DELETE FROM roles WHERE id='9a4f1c7e-2d6b-4f83-8e15-3b7d9c0a4e03';
+DROP TABLE role_permissions;
@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE revoked_tokens (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    expires_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (expires_at)
+);
+
+CREATE TABLE user_revocations (
+    user_id VARCHAR(36) NOT NULL PRIMARY KEY,
+    revoked_before TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- +migrate Down
+DROP TABLE user_revocations;
+DROP TABLE revoked_tokens;
@@ -0,0 +1,8 @@
+-- +migrate Up
+ALTER TABLE users ADD email_verified_at TIMESTAMP NULL AFTER address;
+
+-- users created before email verification existed are considered verified
+UPDATE users SET email_verified_at = created_at;
+
+-- +migrate Down
+ALTER TABLE users DROP COLUMN email_verified_at;
@@ -0,0 +1,23 @@
+-- +migrate Up
+CREATE TABLE user_mfa (
+    user_id VARCHAR(36) NOT NULL PRIMARY KEY,
+    secret VARCHAR(64) NOT NULL,
+    enabled_at TIMESTAMP NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE mfa_recovery_codes (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- +migrate Down
+DROP TABLE mfa_recovery_codes;
+DROP TABLE user_mfa;
@@ -0,0 +1,10 @@
+-- +migrate Up
+CREATE TABLE login_attempts (
+    attempt_key VARCHAR(255) NOT NULL PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP NULL,
+    locked_until TIMESTAMP NULL
+);
+
+-- +migrate Down
+DROP TABLE login_attempts;
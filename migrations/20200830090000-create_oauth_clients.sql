@@ -0,0 +1,12 @@
+-- +migrate Up
+CREATE TABLE oauth_clients (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    secret_hash CHAR(64) NOT NULL,
+    scopes TEXT,
+    grant_types TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +migrate Down
+DROP TABLE oauth_clients;
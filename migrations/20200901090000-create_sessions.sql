@@ -0,0 +1,22 @@
+-- +migrate Up
+CREATE TABLE sessions (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    user_id VARCHAR(36) NOT NULL,
+    user_agent VARCHAR(255),
+    ip VARCHAR(45),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP NULL,
+    terminated_at TIMESTAMP NULL,
+    INDEX (user_id, last_seen_at),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE revoked_sessions (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    expires_at TIMESTAMP NULL,
+    INDEX (expires_at)
+);
+
+-- +migrate Down
+DROP TABLE revoked_sessions;
+DROP TABLE sessions;
@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE audit_logs (
+    id VARCHAR(36) NOT NULL PRIMARY KEY,
+    actor_id VARCHAR(36) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    target_id VARCHAR(36),
+    details TEXT,
+    ip VARCHAR(45),
+    user_agent VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX (actor_id),
+    INDEX (target_id)
+);
+
+-- +migrate Down
+DROP TABLE audit_logs;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE sessions ADD scopes VARCHAR(1000) AFTER ip;
+
+-- +migrate Down
+ALTER TABLE sessions DROP COLUMN scopes;
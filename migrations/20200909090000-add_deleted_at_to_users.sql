@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE users ADD deleted_at TIMESTAMP NULL AFTER updated_at;
+CREATE INDEX users_deleted_at ON users (deleted_at);
+
+-- +migrate Down
+DROP INDEX users_deleted_at ON users;
+ALTER TABLE users DROP COLUMN deleted_at;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE users ADD version INT UNSIGNED NOT NULL DEFAULT 1 AFTER address;
+
+-- +migrate Down
+ALTER TABLE users DROP COLUMN version;
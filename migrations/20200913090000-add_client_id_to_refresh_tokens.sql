@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE refresh_tokens ADD client_id VARCHAR(36) NULL AFTER family_id;
+
+-- +migrate Down
+ALTER TABLE refresh_tokens DROP COLUMN client_id;
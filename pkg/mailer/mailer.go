@@ -0,0 +1,91 @@
+// Package mailer provides a pluggable abstraction to deliver emails.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/redhajuanda/gorengan/pkg/log"
+)
+
+// Message represents an email message.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// String returns the message formatted as a plain text email.
+func (m Message) String() string {
+	return fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\n\r\n%v", m.From, m.To, m.Subject, m.Body)
+}
+
+// Mailer delivers email messages.
+type Mailer interface {
+	// Send delivers the message. The sender is set to the mailer's address if it is empty.
+	Send(ctx context.Context, msg Message) error
+}
+
+type logMailer struct {
+	from   string
+	logger log.Logger
+}
+
+// NewLogMailer creates a mailer that writes messages to the logger instead of delivering them.
+// It is meant to be used in development.
+func NewLogMailer(from string, logger log.Logger) Mailer {
+	return logMailer{from, logger}
+}
+
+// Send writes the message to the logger.
+func (m logMailer) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.from
+	}
+	m.logger.With(ctx, "to", msg.To, "subject", msg.Subject).Infof("mail sent:\n%v", msg.Body)
+	return nil
+}
+
+type fileMailer struct {
+	from string
+	dir  string
+}
+
+// NewFileMailer creates a mailer that writes every message to a new file in dir.
+// It is meant to be used in development and tests.
+func NewFileMailer(from, dir string) Mailer {
+	return fileMailer{from, dir}
+}
+
+// Send writes the message to a new .eml file in the mailer's directory.
+func (m fileMailer) Send(ctx context.Context, msg Message) error {
+	if msg.From == "" {
+		msg.From = m.from
+	}
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(m.dir, time.Now().Format("20060102150405")+"-*.eml")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(msg.String())
+	return err
+}
+
+// New creates a mailer for the given driver, which is either "log" or "file".
+func New(driver, from, dir string, logger log.Logger) (Mailer, error) {
+	switch driver {
+	case "", "log":
+		return NewLogMailer(from, logger), nil
+	case "file":
+		return NewFileMailer(from, filepath.Clean(dir)), nil
+	}
+	return nil, fmt.Errorf("Error creating mailer: unknown driver %v", driver)
+}
@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhajuanda/gorengan/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	logger, _ := log.NewForTest()
+	m, err := New("log", "noreply@example.com", "", logger)
+	assert.NoError(t, err)
+	assert.IsType(t, logMailer{}, m)
+
+	m, err = New("file", "noreply@example.com", "mails", logger)
+	assert.NoError(t, err)
+	assert.IsType(t, fileMailer{}, m)
+
+	_, err = New("smtp", "noreply@example.com", "", logger)
+	assert.Error(t, err)
+}
+
+func TestLogMailer(t *testing.T) {
+	logger, entries := log.NewForTest()
+	m := NewLogMailer("noreply@example.com", logger)
+
+	err := m.Send(context.Background(), Message{To: "john@example.com", Subject: "Hello", Body: "World"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, entries.Len())
+	assert.Contains(t, entries.All()[0].Message, "World")
+}
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mails")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	m := NewFileMailer("noreply@example.com", dir)
+
+	err = m.Send(context.Background(), Message{To: "john@example.com", Subject: "Hello", Body: "World"})
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	content, err := ioutil.ReadFile(files[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "From: noreply@example.com\r\nTo: john@example.com\r\nSubject: Hello\r\n\r\nWorld", string(content))
+}
@@ -0,0 +1,372 @@
+// Package oidc implements the relying party side of the OpenID Connect authorization code flow
+// with PKCE (RFC 7636). Provider metadata is discovered from the issuer and ID tokens are validated
+// against the keys published by the provider, which are fetched again when an unknown key ID shows up,
+// at most once per KeysRefreshInterval.
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// KeysRefreshInterval is the minimum time between two fetches of the provider keys, so that tokens
+// with made up key IDs cannot flood the provider and hold up logins while the keys are fetched.
+var KeysRefreshInterval = time.Minute
+
+// Config holds the settings of a client registered at an OpenID Connect provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Metadata holds the provider metadata needed for the authorization code flow.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Token holds the tokens returned by the token endpoint.
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Claims holds the claims of a validated ID token.
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	GivenName     string
+	FamilyName    string
+}
+
+// Provider is an OpenID Connect provider. Its metadata is discovered on first use.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *Metadata
+	keys     map[string]interface{}
+	// keysFetchedAt is the time the keys were last fetched
+	keysFetchedAt time.Time
+}
+
+// New creates a new provider for the given client settings.
+// If client is nil, http.DefaultClient is used.
+func New(cfg Config, client *http.Client) *Provider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Provider{cfg: cfg, client: client}
+}
+
+// AuthCodeURL returns the URL of the authorization endpoint the user has to be redirected to.
+// The state and nonce must be random and kept along with the verifier until the callback.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.scopes(), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", Challenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange exchanges an authorization code for tokens at the token endpoint.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (Token, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	var token Token
+	if err := p.do(req.WithContext(ctx), &token); err != nil {
+		return Token{}, fmt.Errorf("token request failed: %v", err)
+	}
+	if token.IDToken == "" {
+		return Token{}, errors.New("token response has no id_token")
+	}
+	return token, nil
+}
+
+// VerifyIDToken validates the signature, issuer, audience, expiry and nonce of an ID token
+// and returns its claims.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (Claims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, metadata.JWKSURI, kid)
+	})
+	if err != nil {
+		return Claims{}, err
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if iss, _ := claims["iss"].(string); iss != metadata.Issuer {
+		return Claims{}, fmt.Errorf("unexpected issuer: %v", iss)
+	}
+	if !hasAudience(claims["aud"], p.cfg.ClientID) {
+		return Claims{}, errors.New("token is not intended for this client")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return Claims{}, errors.New("token has no exp claim")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return Claims{}, errors.New("nonce mismatch")
+	}
+
+	result := Claims{}
+	result.Subject, _ = claims["sub"].(string)
+	result.Email, _ = claims["email"].(string)
+	result.EmailVerified, _ = claims["email_verified"].(bool)
+	result.Name, _ = claims["name"].(string)
+	result.GivenName, _ = claims["given_name"].(string)
+	result.FamilyName, _ = claims["family_name"].(string)
+	if result.Subject == "" {
+		return Claims{}, errors.New("token has no sub claim")
+	}
+	return result, nil
+}
+
+// GenerateVerifier returns a random PKCE code verifier.
+func GenerateVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge returns the S256 PKCE code challenge of a verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// scopes returns the requested scopes, which always include openid.
+func (p *Provider) scopes() []string {
+	scopes := []string{"openid"}
+	for _, scope := range p.cfg.Scopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// discover fetches the provider metadata, unless it has already been fetched.
+func (p *Provider) discover(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata Metadata
+	if err := p.do(req.WithContext(ctx), &metadata); err != nil {
+		return nil, fmt.Errorf("discovery failed: %v", err)
+	}
+	if metadata.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery failed: issuer %v does not match %v", metadata.Issuer, p.cfg.Issuer)
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// key returns the public key with the given ID, fetching the provider keys again if it is unknown
+// and they have not been fetched within KeysRefreshInterval.
+func (p *Provider) key(ctx context.Context, jwksURI, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < KeysRefreshInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	p.keysFetchedAt = time.Now()
+	if err := p.do(req.WithContext(ctx), &jwks); err != nil {
+		return nil, fmt.Errorf("fetching keys failed: %v", err)
+	}
+	keys := map[string]interface{}{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	p.keys = keys
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// do sends the request and decodes the JSON response into v.
+func (p *Provider) do(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v: %s", res.StatusCode, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// hasAudience checks whether the aud claim, either a string or an array of strings, contains the client ID.
+func hasAudience(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwk represents a public JSON Web Key as published by providers.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes an RSA or EC public key.
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,89 @@
+package oidc_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhajuanda/gorengan/pkg/oidc"
+	"github.com/redhajuanda/gorengan/pkg/oidc/oidctest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	stub := oidctest.NewProvider("client", "secret")
+	defer stub.Close()
+	provider := oidc.New(stub.Config("http://localhost:3000/login/oidc/callback"), nil)
+	ctx := context.Background()
+
+	verifier, err := oidc.GenerateVerifier()
+	assert.NoError(t, err)
+	authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+	assert.NoError(t, err)
+	assert.Contains(t, authURL, "code_challenge="+oidc.Challenge(verifier))
+	assert.Contains(t, authURL, "scope=openid+email+profile")
+
+	code, state, err := stub.Authorize(authURL, map[string]interface{}{
+		"sub":            "1234",
+		"email":          "jane@example.com",
+		"email_verified": true,
+		"given_name":     "Jane",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "state", state)
+
+	// the code cannot be exchanged without the verifier
+	_, err = provider.Exchange(ctx, code, "wrong")
+	assert.Error(t, err)
+
+	code, _, _ = stub.Authorize(authURL, map[string]interface{}{"sub": "1234", "email": "jane@example.com", "email_verified": true})
+	token, err := provider.Exchange(ctx, code, verifier)
+	assert.NoError(t, err)
+
+	_, err = provider.VerifyIDToken(ctx, token.IDToken, "other nonce")
+	assert.Error(t, err)
+	claims, err := provider.VerifyIDToken(ctx, token.IDToken, "nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", claims.Subject)
+	assert.Equal(t, "jane@example.com", claims.Email)
+	assert.True(t, claims.EmailVerified)
+
+	// tokens issued to another client are refused
+	other := oidc.New(oidc.Config{Issuer: stub.URL, ClientID: "other"}, nil)
+	_, err = other.VerifyIDToken(ctx, token.IDToken, "nonce")
+	assert.Error(t, err)
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	stub := oidctest.NewProvider("client", "secret")
+	defer stub.Close()
+	provider := oidc.New(oidc.Config{Issuer: stub.URL + "/", ClientID: "client"}, nil)
+	_, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	assert.Error(t, err)
+}
+
+func TestKeysRefreshInterval(t *testing.T) {
+	stub := oidctest.NewProvider("client", "secret")
+	defer stub.Close()
+	provider := oidc.New(stub.Config("http://localhost:3000/login/oidc/callback"), nil)
+	ctx := context.Background()
+
+	// tokens with unknown key IDs only fetch the keys again once per interval
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "1234"})
+	forged.Header["alg"] = "RS256"
+	forged.Header["kid"] = "unknown"
+	raw, _ := forged.SigningString()
+	for i := 0; i < 5; i++ {
+		_, err := provider.VerifyIDToken(ctx, raw+".c2lnbmF0dXJl", "nonce")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&stub.KeyFetches))
+
+	oidc.KeysRefreshInterval = 0
+	defer func() { oidc.KeysRefreshInterval = time.Minute }()
+	_, err := provider.VerifyIDToken(ctx, raw+".c2lnbmF0dXJl", "nonce")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&stub.KeyFetches))
+}
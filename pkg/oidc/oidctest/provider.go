@@ -0,0 +1,163 @@
+// Package oidctest provides a stub OpenID Connect provider for tests.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redhajuanda/gorengan/pkg/oidc"
+)
+
+// Provider is a stub OpenID Connect provider listening on a local HTTP server.
+// Instead of rendering a login page, it lets tests sign users in with Authorize.
+type Provider struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	// KeyFetches counts the requests for the provider keys
+	KeyFetches int32
+
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]authorization
+}
+
+type authorization struct {
+	redirectURI string
+	challenge   string
+	claims      jwt.MapClaims
+}
+
+// NewProvider starts a stub provider accepting the given client credentials.
+// The caller must call Close when done.
+func NewProvider(clientID, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p := &Provider{ClientID: clientID, ClientSecret: clientSecret, key: key, codes: map[string]authorization{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// Config returns the client settings of the stub provider.
+func (p *Provider) Config(redirectURL string) oidc.Config {
+	return oidc.Config{
+		Issuer:       p.URL,
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+	}
+}
+
+// Authorize simulates a user signing in at the authorization URL with the given claims, which must include sub.
+// It returns the code and state the provider would send to the redirect URL.
+func (p *Provider) Authorize(authURL string, claims map[string]interface{}) (code, state string, err error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	if q.Get("client_id") != p.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		return "", "", fmt.Errorf("invalid authorization request: %v", authURL)
+	}
+
+	idClaims := jwt.MapClaims{
+		"iss":   p.URL,
+		"aud":   p.ClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": q.Get("nonce"),
+	}
+	for k, v := range claims {
+		idClaims[k] = v
+	}
+	code = randomString()
+	p.mu.Lock()
+	p.codes[code] = authorization{q.Get("redirect_uri"), q.Get("code_challenge"), idClaims}
+	p.mu.Unlock()
+	return code, q.Get("state"), nil
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, oidc.Metadata{
+		Issuer:                p.URL,
+		AuthorizationEndpoint: p.URL + "/authorize",
+		TokenEndpoint:         p.URL + "/token",
+		JWKSURI:               p.URL + "/jwks",
+	})
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&p.KeyFetches, 1)
+	pub := p.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != p.ClientID || secret != p.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	code := r.PostFormValue("code")
+	p.mu.Lock()
+	auth, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if r.PostFormValue("grant_type") != "authorization_code" || !ok ||
+		auth.redirectURI != r.PostFormValue("redirect_uri") ||
+		auth.challenge != oidc.Challenge(r.PostFormValue("code_verifier")) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, auth.claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, oidc.Token{AccessToken: randomString(), TokenType: "Bearer", IDToken: idToken, ExpiresIn: 60})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,191 @@
+package pagination
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// CursorVar specifies the query parameter name for the cursor
+var CursorVar = "cursor"
+
+// ErrInvalidCursor is returned when a cursor cannot be decoded or has not been signed with the current key.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor points at an item of a list sorted by one or more keys, the ID of the items breaking ties.
+// It is handed to clients as an opaque signed string, so that they cannot forge positions.
+type Cursor struct {
+	// Sort identifies the sort order the cursor is valid for
+	Sort string `json:"s,omitempty"`
+	// Values holds the values of the sort keys of the item, in sort order
+	Values []string `json:"v,omitempty"`
+	// ID is the ID of the item, it is empty for the first page
+	ID string `json:"id,omitempty"`
+	// Backward is set on cursors of previous pages, which list the items before the item instead of after it
+	Backward bool `json:"b,omitempty"`
+}
+
+// IsZero checks whether the cursor points at no item, meaning the list starts at its first item.
+func (c Cursor) IsZero() bool {
+	return c.ID == ""
+}
+
+// Encode returns the cursor as an opaque string signed with the key set by SetCursorKey.
+func (c Cursor) Encode() string {
+	payload, _ := json.Marshal(c)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signCursor(encoded))
+}
+
+// DecodeCursor decodes a cursor returned by Encode. It returns ErrInvalidCursor if the cursor is malformed
+// or its signature does not match.
+func DecodeCursor(s string) (Cursor, error) {
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(s[i+1:])
+	if err != nil || !hmac.Equal(signature, signCursor(s[:i])) {
+		return Cursor{}, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(s[:i])
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(payload, &cursor); err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+var (
+	cursorKeyMu sync.RWMutex
+	cursorKey   = randomKey()
+)
+
+// SetCursorKey replaces the key cursors are signed with. Until it is called, a random key is used,
+// so cursors do not survive a restart and are not shared between instances.
+func SetCursorKey(key []byte) {
+	cursorKeyMu.Lock()
+	defer cursorKeyMu.Unlock()
+	cursorKey = key
+}
+
+// signCursor returns the HMAC-SHA256 signature of an encoded cursor.
+func signCursor(encoded string) []byte {
+	cursorKeyMu.RLock()
+	defer cursorKeyMu.RUnlock()
+	mac := hmac.New(sha256.New, cursorKey)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// randomKey returns a random 32 bytes key.
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// CursorPage represents a page of a list paginated with cursors. Unlike Pages, it does not need
+// the total number of items and stays stable when items are added or removed.
+type CursorPage struct {
+	PerPage int `json:"per_page"`
+	// TotalCount is the total number of items, -1 if it is unknown
+	TotalCount int         `json:"total_count"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	PrevCursor string      `json:"prev_cursor,omitempty"`
+	Items      interface{} `json:"items"`
+	// Cursor is the cursor of the requested page, the zero value for the first page
+	Cursor Cursor `json:"-"`
+}
+
+// NewCursorPage creates a new CursorPage instance for the page starting at the given cursor.
+// The perPage parameter refers to the number of items on each page.
+// And the total parameter specifies the total number of data items, -1 if it is unknown.
+func NewCursorPage(cursor Cursor, perPage, total int) *CursorPage {
+	if perPage <= 0 {
+		perPage = DefaultPageSize
+	}
+	if perPage > MaxPageSize {
+		perPage = MaxPageSize
+	}
+	return &CursorPage{PerPage: perPage, TotalCount: total, Cursor: cursor}
+}
+
+// NewCursorPageFromRequest creates a CursorPage object using the query parameters found in the given HTTP request.
+// count stands for the total number of items. Use -1 if this is unknown.
+// It returns ErrInvalidCursor if the cursor parameter is invalid.
+func NewCursorPageFromRequest(req *http.Request, count int) (*CursorPage, error) {
+	var cursor Cursor
+	if value := req.URL.Query().Get(CursorVar); value != "" {
+		var err error
+		if cursor, err = DecodeCursor(value); err != nil {
+			return nil, err
+		}
+	}
+	perPage := parseInt(req.URL.Query().Get(PageSizeVar), DefaultPageSize)
+	return NewCursorPage(cursor, perPage, count), nil
+}
+
+// Limit returns the LIMIT value that can be used in a SQL statement. It is one more than the page size,
+// the extra item telling whether there are more items beyond the page.
+func (p *CursorPage) Limit() int {
+	return p.PerPage + 1
+}
+
+// Total returns the total number of items, or -1 if it is unknown.
+func (p *CursorPage) Total() int {
+	return p.TotalCount
+}
+
+// LinkHeader returns the Link header pointing at the first, previous and next pages,
+// given the URL of the current page whose other query parameters are kept.
+func (p *CursorPage) LinkHeader(u *url.URL) string {
+	return p.BuildLinkHeader(baseURL(u, CursorVar, PageSizeVar), DefaultPageSize)
+}
+
+// BuildLinkHeader returns an HTTP header containing the links to the first, previous and next pages.
+// The first and previous links are only present if there is a previous page, the next link if there is a next page.
+func (p *CursorPage) BuildLinkHeader(baseURL string, defaultPerPage int) string {
+	separator := "?"
+	if strings.Contains(baseURL, "?") {
+		separator = "&"
+	}
+	perPage := ""
+	if p.PerPage != defaultPerPage {
+		perPage = fmt.Sprintf("%v=%v", PageSizeVar, p.PerPage)
+	}
+	link := func(cursor, rel string) string {
+		params := []string{}
+		if cursor != "" {
+			params = append(params, CursorVar+"="+url.QueryEscape(cursor))
+		}
+		if perPage != "" {
+			params = append(params, perPage)
+		}
+		if len(params) == 0 {
+			return fmt.Sprintf("<%v>; rel=\"%v\"", baseURL, rel)
+		}
+		return fmt.Sprintf("<%v%v%v>; rel=\"%v\"", baseURL, separator, strings.Join(params, "&"), rel)
+	}
+	links := []string{}
+	if p.PrevCursor != "" {
+		links = append(links, link("", "first"), link(p.PrevCursor, "prev"))
+	}
+	if p.NextCursor != "" {
+		links = append(links, link(p.NextCursor, "next"))
+	}
+	return strings.Join(links, ", ")
+}
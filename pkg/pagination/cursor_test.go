@@ -0,0 +1,62 @@
+package pagination
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	SetCursorKey([]byte("secret"))
+	cursor := Cursor{Sort: "-created_at,email", Values: []string{"2020-09-01T00:00:00Z", "jane@doe.com"}, ID: "42", Backward: true}
+	encoded := cursor.Encode()
+	decoded, err := DecodeCursor(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, cursor, decoded)
+	assert.False(t, decoded.IsZero())
+	assert.True(t, Cursor{}.IsZero())
+
+	// cursors cannot be forged or tampered with
+	for _, invalid := range []string{"", "garbage", encoded[1:], strings.Replace(encoded, ".", "x.", 1), encoded + "x"} {
+		_, err := DecodeCursor(invalid)
+		assert.Equal(t, ErrInvalidCursor, err, invalid)
+	}
+	SetCursorKey([]byte("other"))
+	_, err = DecodeCursor(encoded)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestNewCursorPageFromRequest(t *testing.T) {
+	SetCursorKey([]byte("secret"))
+	page, err := NewCursorPageFromRequest(httptest.NewRequest("GET", "/users", nil), -1)
+	assert.NoError(t, err)
+	assert.True(t, page.Cursor.IsZero())
+	assert.Equal(t, DefaultPageSize, page.PerPage)
+	assert.Equal(t, DefaultPageSize+1, page.Limit())
+
+	cursor := Cursor{Values: []string{"a"}, ID: "42"}
+	page, err = NewCursorPageFromRequest(httptest.NewRequest("GET", "/users?per_page=5000&cursor="+cursor.Encode(), nil), -1)
+	assert.NoError(t, err)
+	assert.Equal(t, cursor, page.Cursor)
+	assert.Equal(t, MaxPageSize, page.PerPage)
+
+	_, err = NewCursorPageFromRequest(httptest.NewRequest("GET", "/users?cursor=forged", nil), -1)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestCursorPageLinkHeader(t *testing.T) {
+	page := NewCursorPage(Cursor{}, 10, -1)
+	assert.Equal(t, "", page.LinkHeader(mustParseURL(t, "/users")))
+
+	page.NextCursor = "next.sig"
+	assert.Equal(t, `</users?q=doe&cursor=next.sig&per_page=10>; rel="next"`,
+		page.LinkHeader(mustParseURL(t, "/users?q=doe&per_page=10")))
+
+	page = NewCursorPage(Cursor{ID: "42"}, DefaultPageSize, 3)
+	page.PrevCursor = "prev.sig"
+	assert.Equal(t, `</users>; rel="first", </users?cursor=prev.sig>; rel="prev"`,
+		page.LinkHeader(mustParseURL(t, "/users?cursor=current.sig")))
+	assert.Equal(t, 3, page.Total())
+}
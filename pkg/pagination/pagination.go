@@ -4,6 +4,7 @@ package pagination
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -17,8 +18,18 @@ var (
 	PageVar = "page"
 	// PageSizeVar specifies the query parameter name for page size
 	PageSizeVar = "per_page"
+	// CountVar specifies the query parameter name for requesting or skipping the total count
+	CountVar = "count"
 )
 
+// Page is a page of a paginated list, either a Pages or a CursorPage.
+type Page interface {
+	// LinkHeader returns the Link header (RFC 8288) pointing at the other pages, given the URL of the current page.
+	LinkHeader(u *url.URL) string
+	// Total returns the total number of items, or -1 if it is unknown.
+	Total() int
+}
+
 // Pages represents a paginated list of data items.
 type Pages struct {
 	Page       int         `json:"page"`
@@ -67,6 +78,15 @@ func NewFromRequest(req *http.Request, count int) *Pages {
 	return New(page, perPage, count)
 }
 
+// CountRequested checks whether the client wants the total number of items, which it can ask for
+// or opt out of with the count query parameter. byDefault applies when the parameter is missing or invalid.
+func CountRequested(req *http.Request, byDefault bool) bool {
+	if count, err := strconv.ParseBool(req.URL.Query().Get(CountVar)); err == nil {
+		return count
+	}
+	return byDefault
+}
+
 // parseInt parses a string into an integer. If parsing is failed, defaultValue will be returned.
 func parseInt(value string, defaultValue int) int {
 	if value == "" {
@@ -88,6 +108,17 @@ func (p *Pages) Limit() int {
 	return p.PerPage
 }
 
+// Total returns the total number of items, or -1 if it is unknown.
+func (p *Pages) Total() int {
+	return p.TotalCount
+}
+
+// LinkHeader returns the Link header pointing at the first, previous, next and last pages,
+// given the URL of the current page whose other query parameters are kept.
+func (p *Pages) LinkHeader(u *url.URL) string {
+	return p.BuildLinkHeader(baseURL(u, PageVar, PageSizeVar), DefaultPageSize)
+}
+
 // BuildLinkHeader returns an HTTP header containing the links about the pagination.
 func (p *Pages) BuildLinkHeader(baseURL string, defaultPerPage int) string {
 	links := p.BuildLinks(baseURL, defaultPerPage)
@@ -144,3 +175,15 @@ func (p *Pages) BuildLinks(baseURL string, defaultPerPage int) [4]string {
 
 	return links
 }
+
+// baseURL returns the path and the query of the URL without the given parameters.
+func baseURL(u *url.URL, params ...string) string {
+	query := u.Query()
+	for _, param := range params {
+		query.Del(param)
+	}
+	if encoded := query.Encode(); encoded != "" {
+		return u.Path + "?" + encoded
+	}
+	return u.Path
+}
@@ -0,0 +1,46 @@
+package pagination
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountRequested(t *testing.T) {
+	tests := []struct {
+		query     string
+		byDefault bool
+		want      bool
+	}{
+		{"", true, true},
+		{"", false, false},
+		{"?count=false", true, false},
+		{"?count=0", true, false},
+		{"?count=true", false, true},
+		{"?count=maybe", true, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/users"+tt.query, nil)
+		assert.Equal(t, tt.want, CountRequested(req, tt.byDefault), tt.query)
+	}
+}
+
+func TestPagesLinkHeader(t *testing.T) {
+	pages := New(2, 10, 50)
+	assert.Equal(t, `</users?sort=email&page=1&per_page=10>; rel="first", </users?sort=email&page=1&per_page=10>; rel="prev", </users?sort=email&page=3&per_page=10>; rel="next", </users?sort=email&page=5&per_page=10>; rel="last"`,
+		pages.LinkHeader(mustParseURL(t, "/users?page=2&per_page=10&sort=email")))
+	assert.Equal(t, 50, pages.Total())
+
+	// without the total count the last page is unknown
+	pages = New(1, DefaultPageSize, -1)
+	assert.Equal(t, `</users?count=false&page=2>; rel="next"`, pages.LinkHeader(mustParseURL(t, "/users?count=false")))
+	assert.Equal(t, -1, pages.Total())
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	return u
+}
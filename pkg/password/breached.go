@@ -0,0 +1,125 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+// maxLineLength is the maximum length of a line of a breached password list.
+// Lines hold a 40 character hash, optionally followed by a colon and a count.
+const maxLineLength = 64
+
+// BreachedList is a list of breached passwords searched offline. The list is a text file with one uppercase
+// hex encoded SHA-1 hash per line, sorted in ascending order. Every hash may be followed by a colon and the
+// number of times the password has been seen, as in the files published by Have I Been Pwned.
+// The file is searched with a binary search, so it is never loaded into memory.
+type BreachedList struct {
+	file *os.File
+	size int64
+}
+
+// OpenBreachedList opens the breached password list at the given path.
+func OpenBreachedList(path string) (*BreachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &BreachedList{file, info.Size()}, nil
+}
+
+// Close closes the underlying file.
+func (l *BreachedList) Close() error {
+	return l.file.Close()
+}
+
+// Contains checks whether the password is in the list.
+func (l *BreachedList) Contains(pwd string) (bool, error) {
+	sum := sha1.Sum([]byte(pwd))
+	hash := []byte(hex.EncodeToString(sum[:]))
+	hash = bytes.ToUpper(hash)
+
+	// find the first line whose hash is not lower than the searched one:
+	// lo is always the start of a line, lines starting before lo are lower and lines starting at hi or later are not
+	lo, hi := int64(0), l.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := l.lineAfter(mid)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case start >= hi:
+			hi = mid
+		case bytes.Compare(lineHash(line), hash) < 0:
+			lo = start + int64(len(line)) + 1
+		default:
+			hi = start
+		}
+	}
+	if lo >= l.size {
+		return false, nil
+	}
+	_, line, err := l.lineAt(lo)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(lineHash(line), hash), nil
+}
+
+// lineAfter returns the first line starting at or after the given offset, along with its offset.
+// The offset of a line is the position following a newline, or 0.
+func (l *BreachedList) lineAfter(offset int64) (int64, []byte, error) {
+	if offset == 0 {
+		return l.lineAt(0)
+	}
+	buf := make([]byte, maxLineLength+1)
+	n, err := l.file.ReadAt(buf, offset-1)
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	i := bytes.IndexByte(buf[:n], '\n')
+	if i < 0 {
+		if n < len(buf) {
+			return l.size, nil, nil
+		}
+		return 0, nil, errors.New("breached password list has a line that is too long")
+	}
+	start := offset + int64(i)
+	if start >= l.size {
+		return l.size, nil, nil
+	}
+	return l.lineAt(start)
+}
+
+// lineAt returns the line starting at the given offset without its line ending.
+func (l *BreachedList) lineAt(offset int64) (int64, []byte, error) {
+	buf := make([]byte, maxLineLength)
+	n, err := l.file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	line := buf[:n]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	} else if n == len(buf) {
+		return 0, nil, errors.New("breached password list has a line that is too long")
+	}
+	return offset, line, nil
+}
+
+// lineHash returns the hash of a line, dropping the count and the carriage return of CRLF line endings.
+func lineHash(line []byte) []byte {
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return bytes.ToUpper(bytes.TrimRight(line, "\r"))
+}
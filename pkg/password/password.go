@@ -1,33 +1,352 @@
+// Package password hashes and verifies passwords with bcrypt, argon2id or scrypt.
+// Hashes are self-describing: bcrypt hashes use the usual $2a$ format, argon2id and scrypt hashes use the
+// PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>. Hashes of peppered passwords
+// are prefixed with $pepper$, so that hashes created before a pepper was configured can still be verified.
 package password
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 )
 
-// HashAndSalt return hashed password
-func HashAndSalt(pwd []byte) (string, error) {
+const (
+	// Bcrypt is the name of the bcrypt algorithm.
+	Bcrypt = "bcrypt"
+	// Argon2id is the name of the argon2id algorithm.
+	Argon2id = "argon2id"
+	// Scrypt is the name of the scrypt algorithm.
+	Scrypt = "scrypt"
+)
+
+const (
+	// pepperPrefix marks the hashes of peppered passwords.
+	pepperPrefix = "$pepper"
+	// saltLength is the length in bytes of the salts generated for argon2id and scrypt.
+	saltLength = 16
+	// keyLength is the length in bytes of the keys derived by argon2id and scrypt.
+	keyLength = 32
+)
+
+// encoding is the unpadded base64 encoding used by the PHC string format.
+var encoding = base64.RawStdEncoding
+
+// Config holds the algorithm and the parameters used to hash new passwords.
+type Config struct {
+	// Algorithm is either bcrypt, argon2id or scrypt
+	Algorithm  string
+	BcryptCost int
+	// Argon2Time is the number of passes over the memory
+	Argon2Time uint32
+	// Argon2Memory is the amount of memory used in KiB
+	Argon2Memory uint32
+	// Argon2Threads is the degree of parallelism
+	Argon2Threads uint8
+	// ScryptN is the CPU/memory cost parameter, it must be a power of two
+	ScryptN int
+	ScryptR int
+	ScryptP int
+	// Pepper is a secret mixed into every password before hashing, an empty pepper disables it
+	Pepper string
+}
+
+// DefaultConfig returns the configuration used unless another one is set with SetDefault.
+func DefaultConfig() Config {
+	return Config{
+		Algorithm:     Bcrypt,
+		BcryptCost:    bcrypt.DefaultCost,
+		Argon2Time:    3,
+		Argon2Memory:  64 * 1024,
+		Argon2Threads: 2,
+		ScryptN:       1 << 15,
+		ScryptR:       8,
+		ScryptP:       1,
+	}
+}
+
+// Hasher hashes passwords with the configured algorithm and verifies hashes of every supported algorithm.
+type Hasher struct {
+	cfg Config
+}
+
+// New creates a new hasher. Parameters left empty are taken from DefaultConfig.
+func New(cfg Config) (*Hasher, error) {
+	defaults := DefaultConfig()
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = defaults.Algorithm
+	}
+	if cfg.BcryptCost == 0 {
+		cfg.BcryptCost = defaults.BcryptCost
+	}
+	if cfg.Argon2Time == 0 {
+		cfg.Argon2Time = defaults.Argon2Time
+	}
+	if cfg.Argon2Memory == 0 {
+		cfg.Argon2Memory = defaults.Argon2Memory
+	}
+	if cfg.Argon2Threads == 0 {
+		cfg.Argon2Threads = defaults.Argon2Threads
+	}
+	if cfg.ScryptN == 0 {
+		cfg.ScryptN = defaults.ScryptN
+	}
+	if cfg.ScryptR == 0 {
+		cfg.ScryptR = defaults.ScryptR
+	}
+	if cfg.ScryptP == 0 {
+		cfg.ScryptP = defaults.ScryptP
+	}
 
-	// Use GenerateFromPassword to hash & salt pwd.
-	// MinCost is just an integer constant provided by the bcrypt
-	// package along with DefaultCost & MaxCost.
-	// The cost can be any value you want provided it isn't lower
-	// than the MinCost (4)
-	hash, err := bcrypt.GenerateFromPassword(pwd, bcrypt.MinCost)
+	switch cfg.Algorithm {
+	case Bcrypt:
+		if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id:
+	case Scrypt:
+		if cfg.ScryptN < 2 || cfg.ScryptN&(cfg.ScryptN-1) != 0 {
+			return nil, errors.New("scrypt N must be a power of two greater than 1")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported password hashing algorithm %v", cfg.Algorithm)
+	}
+	return &Hasher{cfg}, nil
+}
+
+// Hash returns the self-describing hash of the password.
+func (h *Hasher) Hash(pwd []byte) (string, error) {
+	var hash string
+	var err error
+	pwd = h.pepper(pwd)
+	switch h.cfg.Algorithm {
+	case Argon2id:
+		hash, err = h.hashArgon2id(pwd)
+	case Scrypt:
+		hash, err = h.hashScrypt(pwd)
+	default:
+		var b []byte
+		b, err = bcrypt.GenerateFromPassword(pwd, h.cfg.BcryptCost)
+		hash = string(b)
+	}
 	if err != nil {
 		return "", err
 	}
-	return string(hash), nil
+	if h.cfg.Pepper != "" {
+		hash = pepperPrefix + hash
+	}
+	return hash, nil
 }
 
-// ComparePasswords compares between hashed password and plain password
-func ComparePasswords(hashedPwd string, plainPwd []byte) bool {
-	// Since we'll be getting the hashed password from the DB it
-	// will be a string so we'll need to convert it to a byte slice
-	byteHash := []byte(hashedPwd)
-	err := bcrypt.CompareHashAndPassword(byteHash, plainPwd)
+// Compare checks whether the password matches the hash.
+func (h *Hasher) Compare(hash string, pwd []byte) bool {
+	if strings.HasPrefix(hash, pepperPrefix+"$") {
+		if h.cfg.Pepper == "" {
+			return false
+		}
+		hash = hash[len(pepperPrefix):]
+		pwd = h.pepper(pwd)
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$"+Argon2id+"$"):
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false
+		}
+		derived := argon2.IDKey(pwd, salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, derived) == 1
+	case strings.HasPrefix(hash, "$"+Scrypt+"$"):
+		params, salt, key, err := parseScrypt(hash)
+		if err != nil {
+			return false
+		}
+		derived, err := scrypt.Key(pwd, salt, params.n, params.r, params.p, len(key))
+		return err == nil && subtle.ConstantTimeCompare(key, derived) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), pwd) == nil
+	}
+}
+
+// NeedsRehash checks whether the hash was created with another algorithm, other parameters or another
+// pepper setting than the configured ones. Such a hash should be replaced once the password is known.
+func (h *Hasher) NeedsRehash(hash string) bool {
+	peppered := strings.HasPrefix(hash, pepperPrefix+"$")
+	if peppered != (h.cfg.Pepper != "") {
+		return true
+	}
+	hash = strings.TrimPrefix(hash, pepperPrefix)
+
+	switch h.cfg.Algorithm {
+	case Argon2id:
+		params, _, key, err := parseArgon2id(hash)
+		return err != nil || len(key) != keyLength || params != (argon2Params{h.cfg.Argon2Time, h.cfg.Argon2Memory, h.cfg.Argon2Threads})
+	case Scrypt:
+		params, _, key, err := parseScrypt(hash)
+		return err != nil || len(key) != keyLength || params != (scryptParams{h.cfg.ScryptN, h.cfg.ScryptR, h.cfg.ScryptP})
+	default:
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.cfg.BcryptCost
+	}
+}
+
+// pepper mixes the configured pepper into the password with HMAC-SHA256.
+// The MAC is base64 encoded, as bcrypt stops at the first zero byte of the password.
+func (h *Hasher) pepper(pwd []byte) []byte {
+	if h.cfg.Pepper == "" {
+		return pwd
+	}
+	mac := hmac.New(sha256.New, []byte(h.cfg.Pepper))
+	mac.Write(pwd)
+	sum := mac.Sum(nil)
+	return []byte(base64.StdEncoding.EncodeToString(sum))
+}
+
+// argon2Params holds the parameters encoded in an argon2id hash.
+type argon2Params struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// hashArgon2id hashes the password with argon2id in the PHC string format.
+func (h *Hasher) hashArgon2id(pwd []byte) (string, error) {
+	salt, err := generateSalt()
 	if err != nil {
-		return false
+		return "", err
 	}
+	key := argon2.IDKey(pwd, salt, h.cfg.Argon2Time, h.cfg.Argon2Memory, h.cfg.Argon2Threads, keyLength)
+	return fmt.Sprintf("$%v$v=%d$m=%d,t=%d,p=%d$%v$%v", Argon2id, argon2.Version,
+		h.cfg.Argon2Memory, h.cfg.Argon2Time, h.cfg.Argon2Threads,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// parseArgon2id decodes an argon2id hash in the PHC string format.
+func parseArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return params, nil, nil, errors.New("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id parameters: %v", err)
+	}
+	salt, key, err := decodeSaltAndKey(parts[4], parts[5])
+	return params, salt, key, err
+}
+
+// scryptParams holds the parameters encoded in a scrypt hash.
+type scryptParams struct {
+	n int
+	r int
+	p int
+}
+
+// hashScrypt hashes the password with scrypt in the PHC string format, where ln is the base 2 logarithm of N.
+func (h *Hasher) hashScrypt(pwd []byte) (string, error) {
+	salt, err := generateSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key(pwd, salt, h.cfg.ScryptN, h.cfg.ScryptR, h.cfg.ScryptP, keyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$%v$ln=%d,r=%d,p=%d$%v$%v", Scrypt, log2(h.cfg.ScryptN), h.cfg.ScryptR, h.cfg.ScryptP,
+		encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// parseScrypt decodes a scrypt hash in the PHC string format.
+func parseScrypt(hash string) (scryptParams, []byte, []byte, error) {
+	var params scryptParams
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != Scrypt {
+		return params, nil, nil, errors.New("malformed scrypt hash")
+	}
+	var ln uint
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &ln, &params.r, &params.p); err != nil || ln < 1 || ln > 30 {
+		return params, nil, nil, errors.New("malformed scrypt parameters")
+	}
+	params.n = 1 << ln
+	salt, key, err := decodeSaltAndKey(parts[3], parts[4])
+	return params, salt, key, err
+}
+
+// decodeSaltAndKey decodes the base64 encoded salt and key of a PHC string.
+func decodeSaltAndKey(encodedSalt, encodedKey string) ([]byte, []byte, error) {
+	salt, err := encoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed salt: %v", err)
+	}
+	key, err := encoding.DecodeString(encodedKey)
+	if err != nil || len(key) == 0 {
+		return nil, nil, errors.New("malformed key")
+	}
+	return salt, key, nil
+}
+
+// generateSalt returns a random salt.
+func generateSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// log2 returns the base 2 logarithm of a power of two.
+func log2(n int) int {
+	ln := 0
+	for n > 1 {
+		n >>= 1
+		ln++
+	}
+	return ln
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultHasher = &Hasher{DefaultConfig()}
+)
+
+// SetDefault replaces the hasher used by HashAndSalt, ComparePasswords and NeedsRehash.
+func SetDefault(h *Hasher) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultHasher = h
+}
+
+// getDefault returns the hasher used by the package level functions.
+func getDefault() *Hasher {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultHasher
+}
+
+// HashAndSalt return hashed password
+func HashAndSalt(pwd []byte) (string, error) {
+	return getDefault().Hash(pwd)
+}
+
+// ComparePasswords compares between hashed password and plain password
+func ComparePasswords(hashedPwd string, plainPwd []byte) bool {
+	return getDefault().Compare(hashedPwd, plainPwd)
+}
 
-	return true
+// NeedsRehash checks whether the hashed password should be rehashed with the current parameters.
+func NeedsRehash(hashedPwd string) bool {
+	return getDefault().NeedsRehash(hashedPwd)
 }
@@ -0,0 +1,93 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasher(t *testing.T) {
+	configs := map[string]Config{
+		"bcrypt":   {Algorithm: Bcrypt, BcryptCost: 4},
+		"argon2id": {Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1},
+		"scrypt":   {Algorithm: Scrypt, ScryptN: 1024, ScryptR: 8, ScryptP: 1},
+		"peppered": {Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1, Pepper: "pepper"},
+	}
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			h, err := New(cfg)
+			assert.NoError(t, err)
+			hash, err := h.Hash([]byte("secret"))
+			assert.NoError(t, err)
+			assert.True(t, h.Compare(hash, []byte("secret")))
+			assert.False(t, h.Compare(hash, []byte("Secret")))
+			assert.False(t, h.NeedsRehash(hash))
+
+			other, err := h.Hash([]byte("secret"))
+			assert.NoError(t, err)
+			assert.NotEqual(t, hash, other, "salt must be random")
+		})
+	}
+}
+
+func TestHasherFormat(t *testing.T) {
+	h, err := New(Config{Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1})
+	assert.NoError(t, err)
+	hash, err := h.Hash([]byte("secret"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	h, err = New(Config{Algorithm: Scrypt, ScryptN: 1024, ScryptR: 8, ScryptP: 1, Pepper: "pepper"})
+	assert.NoError(t, err)
+	hash, err = h.Hash([]byte("secret"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$pepper$scrypt$ln=10,r=8,p=1$"))
+}
+
+func TestHasherNeedsRehash(t *testing.T) {
+	weak, _ := New(Config{Algorithm: Bcrypt, BcryptCost: 4})
+	weakHash, err := weak.Hash([]byte("secret"))
+	assert.NoError(t, err)
+
+	// hashes of every algorithm can be verified whatever the configured one
+	strong, _ := New(Config{Algorithm: Bcrypt, BcryptCost: 5})
+	assert.True(t, strong.Compare(weakHash, []byte("secret")))
+	assert.True(t, strong.NeedsRehash(weakHash))
+	argon, _ := New(Config{Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1})
+	assert.True(t, argon.Compare(weakHash, []byte("secret")))
+	assert.True(t, argon.NeedsRehash(weakHash))
+	argonHash, _ := argon.Hash([]byte("secret"))
+	moreMemory, _ := New(Config{Algorithm: Argon2id, Argon2Time: 1, Argon2Memory: 2048, Argon2Threads: 1})
+	assert.True(t, moreMemory.Compare(argonHash, []byte("secret")))
+	assert.True(t, moreMemory.NeedsRehash(argonHash))
+
+	// configuring a pepper keeps existing hashes valid until they are rehashed
+	peppered, _ := New(Config{Algorithm: Bcrypt, BcryptCost: 4, Pepper: "pepper"})
+	assert.True(t, peppered.Compare(weakHash, []byte("secret")))
+	assert.True(t, peppered.NeedsRehash(weakHash))
+	pepperedHash, _ := peppered.Hash([]byte("secret"))
+	assert.False(t, weak.Compare(pepperedHash, []byte("secret")))
+	otherPepper, _ := New(Config{Algorithm: Bcrypt, BcryptCost: 4, Pepper: "other"})
+	assert.False(t, otherPepper.Compare(pepperedHash, []byte("secret")))
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	_, err := New(Config{Algorithm: "md5"})
+	assert.Error(t, err)
+	_, err = New(Config{Algorithm: Bcrypt, BcryptCost: 50})
+	assert.Error(t, err)
+	_, err = New(Config{Algorithm: Scrypt, ScryptN: 1000})
+	assert.Error(t, err)
+	h, err := New(Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), h.cfg)
+}
+
+func TestMalformedHashes(t *testing.T) {
+	h, _ := New(Config{Algorithm: Argon2id})
+	for _, hash := range []string{"", "plain", "$argon2id$v=19$m=1024", "$scrypt$ln=99,r=8,p=1$c2FsdA$a2V5", "$pepper$argon2id$"} {
+		assert.False(t, h.Compare(hash, []byte("secret")), hash)
+		assert.True(t, h.NeedsRehash(hash), hash)
+	}
+}
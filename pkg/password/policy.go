@@ -0,0 +1,138 @@
+package password
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Policy describes the requirements passwords must satisfy.
+type Policy struct {
+	MinLength int
+	// MinClasses is the number of character classes among lowercase letters, uppercase letters,
+	// digits and symbols a password must contain
+	MinClasses int
+	// MinStrength is the minimum score from 0 to 4 computed by Strength
+	MinStrength int
+	// History is the number of most recent passwords, including the current one, that cannot be reused
+	History int
+	// Breached is the list of breached passwords that are refused, nil disables the check
+	Breached *BreachedList
+}
+
+// PolicyError describes why a password does not satisfy the policy.
+type PolicyError struct {
+	msg string
+}
+
+// Error is required by the error interface.
+func (e PolicyError) Error() string {
+	return e.msg
+}
+
+// DefaultPolicy returns the policy used unless another one is set with SetPolicy.
+func DefaultPolicy() Policy {
+	return Policy{MinLength: 8}
+}
+
+// Check checks whether the password satisfies the policy. The user inputs, such as the email address
+// and the name of the user, cannot be part of the password and weaken its strength score.
+// It returns a PolicyError if the password is refused.
+func (p Policy) Check(pwd string, userInputs ...string) error {
+	if len([]rune(pwd)) < p.MinLength {
+		return PolicyError{fmt.Sprintf("password must be at least %d characters long", p.MinLength)}
+	}
+	if classes := characterClasses(pwd); classes < p.MinClasses {
+		return PolicyError{fmt.Sprintf("password must contain at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses)}
+	}
+	lower := strings.ToLower(pwd)
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		if at := strings.Index(input, "@"); at > 0 && len(input[:at]) >= 3 && strings.Contains(lower, input[:at]) {
+			return PolicyError{"password must not contain your email address"}
+		}
+		if len(input) >= 3 && strings.Contains(lower, input) {
+			return PolicyError{"password must not contain your name or email address"}
+		}
+	}
+	if p.MinStrength > 0 && Strength(pwd, userInputs...) < p.MinStrength {
+		return PolicyError{"password is too easy to guess"}
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(pwd)
+		if err != nil {
+			return err
+		}
+		if breached {
+			return PolicyError{"password has appeared in a data breach, please choose another one"}
+		}
+	}
+	return nil
+}
+
+// CheckHistory checks that the password does not match any of the given hashes of previous passwords,
+// most recent first. Only the number of passwords configured by History are compared.
+func (p Policy) CheckHistory(pwd string, hashes []string) error {
+	for i, hash := range hashes {
+		if i >= p.History {
+			break
+		}
+		if ComparePasswords(hash, []byte(pwd)) {
+			return PolicyError{fmt.Sprintf("password must differ from your last %d passwords", p.History)}
+		}
+	}
+	return nil
+}
+
+// CheckChange checks whether a user may change their password to the given one: it must satisfy the policy
+// and differ from the current password, whose hash is given, and from the previous ones, most recent first.
+func (p Policy) CheckChange(pwd, currentHash string, previous []string, userInputs ...string) error {
+	if err := p.Check(pwd, userInputs...); err != nil {
+		return err
+	}
+	return p.CheckHistory(pwd, append([]string{currentHash}, previous...))
+}
+
+// characterClasses returns the number of character classes among lowercase letters, uppercase letters,
+// digits and symbols used by the password.
+func characterClasses(pwd string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range pwd {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+var (
+	policyMu      sync.RWMutex
+	currentPolicy = DefaultPolicy()
+)
+
+// SetPolicy replaces the policy used by CheckPolicy and the password validation tag.
+func SetPolicy(p Policy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	currentPolicy = p
+}
+
+// CurrentPolicy returns the policy set with SetPolicy.
+func CurrentPolicy() Policy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return currentPolicy
+}
+
+// CheckPolicy checks whether the password satisfies the current policy.
+func CheckPolicy(pwd string, userInputs ...string) error {
+	return CurrentPolicy().Check(pwd, userInputs...)
+}
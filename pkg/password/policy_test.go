@@ -0,0 +1,133 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	policy := Policy{MinLength: 10, MinClasses: 3, MinStrength: 3}
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"a", false},
+		{"abcdefghij", false},
+		{"Abcdefghi1", false},
+		{"Password123!", false},
+		{"Jane.Doe-2020!", false},
+		{"Kopi tubruk 42", true},
+		{"v8#Lq2!mZr", true},
+	}
+	for _, test := range tests {
+		err := policy.Check(test.password, "jane@doe.com", "Jane", "Doe")
+		if test.valid {
+			assert.NoError(t, err, test.password)
+		} else {
+			assert.IsType(t, PolicyError{}, err, test.password)
+		}
+	}
+}
+
+func TestPolicyCheckHistory(t *testing.T) {
+	h, _ := New(Config{Algorithm: Bcrypt, BcryptCost: 4})
+	SetDefault(h)
+	defer SetDefault(&Hasher{DefaultConfig()})
+	first, _ := h.Hash([]byte("first password"))
+	second, _ := h.Hash([]byte("second password"))
+	current, _ := h.Hash([]byte("current password"))
+
+	policy := Policy{MinLength: 8, History: 2}
+	assert.Error(t, policy.CheckChange("current password", current, []string{second, first}))
+	assert.Error(t, policy.CheckChange("second password", current, []string{second, first}))
+	assert.NoError(t, policy.CheckChange("first password", current, []string{second, first}))
+	assert.NoError(t, policy.CheckChange("new password", current, []string{second, first}))
+
+	policy.History = 0
+	assert.NoError(t, policy.CheckChange("current password", current, nil))
+}
+
+func TestStrength(t *testing.T) {
+	tests := []struct {
+		password string
+		max      int
+		min      int
+	}{
+		{"", 0, 0},
+		{"password", 0, 0},
+		{"P@ssw0rd", 0, 0},
+		{"aaaaaaaaaaaa", 1, 0},
+		{"abcdefgh", 1, 0},
+		{"qwertyuiop", 1, 0},
+		{"Summer2020", 2, 0},
+		{"jane.doe", 1, 0},
+		{"kopi tubruk 42", 4, 3},
+		{"correct horse battery staple", 4, 4},
+		{"v8#Lq2!mZr", 4, 4},
+	}
+	for _, test := range tests {
+		score := Strength(test.password, "jane@doe.com", "Jane", "Doe")
+		assert.True(t, score <= test.max && score >= test.min, "%v scored %v", test.password, score)
+	}
+}
+
+func TestBreachedList(t *testing.T) {
+	breached := []string{"123456", "password", "qwerty", "letmein", "monkey", "dragon", "iloveyou", "trustno1"}
+	lines := []string{}
+	for i, pwd := range breached {
+		sum := sha1.Sum([]byte(pwd))
+		lines = append(lines, fmt.Sprintf("%v:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i*1000+1))
+	}
+	// padding lines make the binary search go through several iterations
+	for i := 0; i < 200; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprintf("padding %d", i)))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:])))
+	}
+	sort.Strings(lines)
+
+	dir, err := ioutil.TempDir("", "breached")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"lf.txt":   strings.Join(lines, "\n") + "\n",
+		"crlf.txt": strings.Join(lines, "\r\n"),
+	} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		list, err := OpenBreachedList(path)
+		assert.NoError(t, err)
+
+		for _, pwd := range append(breached, "padding 0", "padding 199") {
+			found, err := list.Contains(pwd)
+			assert.NoError(t, err)
+			assert.True(t, found, "%v in %v", pwd, name)
+		}
+		for _, pwd := range []string{"", "kopi tubruk 42", "Password", "padding 200"} {
+			found, err := list.Contains(pwd)
+			assert.NoError(t, err)
+			assert.False(t, found, "%v in %v", pwd, name)
+		}
+
+		err = Policy{Breached: list}.Check("password")
+		assert.IsType(t, PolicyError{}, err)
+		assert.NoError(t, Policy{Breached: list}.Check("kopi tubruk 42"))
+		assert.NoError(t, list.Close())
+	}
+
+	empty := filepath.Join(dir, "empty.txt")
+	assert.NoError(t, ioutil.WriteFile(empty, nil, 0600))
+	list, err := OpenBreachedList(empty)
+	assert.NoError(t, err)
+	found, err := list.Contains("password")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
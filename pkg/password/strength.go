@@ -0,0 +1,195 @@
+package password
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// commonWords are frequent passwords and password fragments, matched case-insensitively and after undoing
+// common character substitutions. A whole password equal to one of them is scored 0.
+var commonWords = []string{
+	"password", "passw0rd", "qwerty", "qwertz", "azerty", "asdf", "zxcv", "letmein", "welcome", "admin",
+	"administrator", "login", "master", "secret", "dragon", "monkey", "football", "baseball", "soccer",
+	"iloveyou", "love", "princess", "sunshine", "shadow", "superman", "batman", "trustno1", "whatever",
+	"hello", "freedom", "summer", "winter", "spring", "autumn", "starwars", "pokemon", "computer",
+	"internet", "abc123", "123456", "654321", "111111", "000000", "changeme", "default", "test",
+}
+
+// substitutions undoes the character substitutions commonly used to disguise words.
+var substitutions = strings.NewReplacer("@", "a", "4", "a", "8", "b", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z")
+
+// keyboardRows are the rows of a qwerty keyboard, used to detect keyboard walks such as "asdf".
+var keyboardRows = []string{"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./"}
+
+const (
+	// wordBits is the entropy assigned to a match of a common word, roughly log2 of a small dictionary size.
+	wordBits = 10
+	// userInputBits is the entropy assigned to a match of a user input such as the name or email of the user.
+	userInputBits = 2
+	// yearBits is the entropy assigned to a recent year, which is a frequent password suffix.
+	yearBits = 7
+	// patternBits is the entropy assigned to a character continuing a repeat, a sequence or a keyboard walk.
+	patternBits = 1
+)
+
+// Strength estimates how hard the password is to guess, in the spirit of zxcvbn. The score ranges from
+// 0, too guessable, to 4, very unguessable, and is derived from an estimate of the number of guesses an attacker
+// needs: common words, user inputs, recent years, repeats, sequences and keyboard walks are assumed to be
+// tried first, every other character costs a brute force over the character classes used by the password.
+func Strength(pwd string, userInputs ...string) int {
+	if pwd == "" {
+		return 0
+	}
+	runes := []rune(pwd)
+	normalized := []rune(strings.ToLower(pwd))
+	if len(normalized) != len(runes) {
+		normalized = runes
+	}
+	unleeted := []rune(substitutions.Replace(string(normalized)))
+	if len(unleeted) != len(runes) {
+		unleeted = normalized
+	}
+	for _, word := range commonWords {
+		if string(normalized) == word || string(unleeted) == word {
+			return 0
+		}
+	}
+
+	bits := 0.0
+	covered := make([]bool, len(runes))
+	match := func(needle string, text []rune, cost float64) {
+		needleRunes := []rune(needle)
+		if len(needleRunes) < 3 {
+			return
+		}
+		for i := 0; i+len(needleRunes) <= len(text); i++ {
+			if string(text[i:i+len(needleRunes)]) != needle || anyCovered(covered[i:i+len(needleRunes)]) {
+				continue
+			}
+			for j := i; j < i+len(needleRunes); j++ {
+				covered[j] = true
+			}
+			bits += cost
+		}
+	}
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+		match(input, normalized, userInputBits)
+		// email addresses are matched by their local part as well
+		if at := strings.Index(input, "@"); at > 0 {
+			match(input[:at], normalized, userInputBits)
+		}
+	}
+	for _, word := range commonWords {
+		match(word, normalized, wordBits)
+		match(word, unleeted, wordBits)
+	}
+	for i := 0; i+4 <= len(runes); i++ {
+		if isRecentYear(runes[i:i+4]) && !anyCovered(covered[i:i+4]) {
+			covered[i], covered[i+1], covered[i+2], covered[i+3] = true, true, true, true
+			bits += yearBits
+		}
+	}
+
+	charBits := math.Log2(float64(charsetSize(runes)))
+	for i, r := range runes {
+		switch {
+		case covered[i]:
+		case i > 0 && !covered[i-1] && continuesPattern(normalized[i-1], normalized[i]):
+			bits += patternBits
+		default:
+			bits += charBits
+		}
+		// capitalizing a single letter only adds a bit
+		if covered[i] && unicode.IsUpper(r) {
+			bits++
+		}
+	}
+
+	switch {
+	case bits < 10:
+		return 0
+	case bits < 20:
+		return 1
+	case bits < 27:
+		return 2
+	case bits < 33:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// charsetSize returns the number of characters an attacker has to try per position
+// given the character classes used by the password.
+func charsetSize(runes []rune) int {
+	size := 0
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+	return size
+}
+
+// continuesPattern checks whether the character repeats the previous one, follows it in a sequence
+// such as "abc" or "321", or is next to it on the keyboard.
+func continuesPattern(prev, r rune) bool {
+	if r == prev || r == prev+1 || r == prev-1 {
+		return true
+	}
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, prev)
+		if i >= 0 && ((i+1 < len(row) && rune(row[i+1]) == r) || (i > 0 && rune(row[i-1]) == r)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRecentYear checks whether the four characters form a year between 1900 and 2099.
+func isRecentYear(runes []rune) bool {
+	for _, r := range runes {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return (runes[0] == '1' && runes[1] == '9') || (runes[0] == '2' && runes[1] == '0')
+}
+
+// anyCovered checks whether any of the positions is already part of a match.
+func anyCovered(covered []bool) bool {
+	for _, c := range covered {
+		if c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+// Package realip resolves the IP address of the client sending a request. The X-Forwarded-For and X-Real-IP
+// headers can be set by anyone, so they are only trusted when the request comes from a trusted proxy.
+package realip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	trustedMu sync.RWMutex
+	trusted   []*net.IPNet
+)
+
+// SetTrustedProxies sets the IP addresses or CIDR ranges of the proxies whose forwarding headers are trusted.
+// Until it is called, no proxy is trusted and the address of the connection is used.
+func SetTrustedProxies(proxies []string) error {
+	networks := []*net.IPNet{}
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return fmt.Errorf("invalid trusted proxy %v", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %v: %v", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+	trustedMu.Lock()
+	defer trustedMu.Unlock()
+	trusted = networks
+	return nil
+}
+
+// FromRequest returns the IP address of the client sending the request. When the connection comes from
+// a trusted proxy, X-Forwarded-For is read from right to left and the first address which is not a trusted
+// proxy is returned, falling back to X-Real-IP.
+func FromRequest(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if !isTrusted(remote) {
+		return remote
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !isTrusted(hop) {
+				return hop
+			}
+		}
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return remote
+}
+
+// isTrusted checks whether the IP address belongs to a trusted proxy.
+func isTrusted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	trustedMu.RLock()
+	defer trustedMu.RUnlock()
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package realip
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromRequest(t *testing.T) {
+	assert.NoError(t, SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"}))
+	defer SetTrustedProxies(nil)
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		// forwarding headers of untrusted clients are ignored
+		{"203.0.113.7:5000", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"10.0.0.1:5000", "", "", "10.0.0.1"},
+		{"10.0.0.1:5000", "198.51.100.1", "", "198.51.100.1"},
+		// addresses prepended by the client are skipped
+		{"10.0.0.1:5000", "198.51.100.9, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"192.168.1.1:5000", "", "198.51.100.2", "198.51.100.2"},
+		{"192.168.1.1:5000", "garbage", "", "192.168.1.1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		assert.Equal(t, tt.want, FromRequest(req), tt.remote+" "+tt.forwarded)
+	}
+
+	assert.Error(t, SetTrustedProxies([]string{"not-an-ip"}))
+}
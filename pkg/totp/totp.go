@@ -0,0 +1,104 @@
+// Package totp implements time-based one-time passwords as specified by RFC 6238.
+// Codes are computed with HMAC-SHA1, have 6 digits and change every 30 seconds,
+// which is what common authenticator apps expect.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// Digits specifies the number of digits of a code
+	Digits = 6
+	// Period specifies the number of seconds a code is valid for
+	Period = 30
+	// Skew specifies the number of periods before and after the current one whose codes are accepted
+	Skew = 1
+)
+
+// encoding is the base32 encoding used for secrets, without padding as expected by authenticator apps.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160 bit secret encoded in base32.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// Step returns the time step, i.e. the number of periods since the Unix epoch, at time t.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period)
+}
+
+// Code returns the code for the secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return generateCode(key, Step(t), Digits), nil
+}
+
+// Validate checks the code against the secret at time t, accepting codes of the adjacent time steps
+// to tolerate clock drift. If the code is valid, the time step it belongs to is returned so that
+// callers can refuse codes of that step or earlier ones to prevent replays.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+	current := Step(t)
+	for step := current - int64(Skew); step <= current+int64(Skew); step++ {
+		if subtle.ConstantTimeCompare([]byte(generateCode(key, step, Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// provisioning URI of the secret, which authenticator apps can import from a QR code.
+func URI(secret, issuer, account string) string {
+	label := url.PathEscape(issuer + ":" + account)
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(Digits))
+	values.Set("period", fmt.Sprint(Period))
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// decodeSecret decodes a base32 secret, ignoring case, spaces and padding.
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return encoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// generateCode computes the HOTP value (RFC 4226) of the key for the given counter.
+func generateCode(key []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
@@ -0,0 +1,78 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfcSecret is the SHA1 seed used by the test vectors of RFC 6238.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestGenerateCode(t *testing.T) {
+	// test vectors from RFC 6238, appendix B
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	key, err := decodeSecret(rfcSecret)
+	assert.NoError(t, err)
+	for unix, expected := range vectors {
+		assert.Equal(t, expected, generateCode(key, Step(time.Unix(unix, 0)), 8))
+	}
+}
+
+func TestCode(t *testing.T) {
+	code, err := Code(rfcSecret, time.Unix(59, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, "287082", code)
+
+	_, err = Code("not base32!", time.Unix(59, 0))
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code, err := Code(rfcSecret, now)
+	assert.NoError(t, err)
+
+	step, ok := Validate(rfcSecret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	// codes of adjacent steps are accepted to tolerate clock drift
+	step, ok = Validate(rfcSecret, code, now.Add(30*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	_, ok = Validate(rfcSecret, code, now.Add(90*time.Second))
+	assert.False(t, ok)
+	_, ok = Validate(rfcSecret, "000000", now)
+	assert.False(t, ok)
+	_, ok = Validate(rfcSecret, "12345", now)
+	assert.False(t, ok)
+	_, ok = Validate(strings.ToLower(rfcSecret), code, now)
+	assert.True(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	other, err := GenerateSecret()
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret, other)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("JBSWY3DPEHPK3PXP", "gorengan", "john@example.com")
+	assert.Equal(t, "otpauth://totp/gorengan:john@example.com?algorithm=SHA1&digits=6&issuer=gorengan&period=30&secret=JBSWY3DPEHPK3PXP", uri)
+}
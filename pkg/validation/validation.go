@@ -1,12 +1,30 @@
 package validation
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"reflect"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/redhajuanda/gorengan/pkg/password"
 )
 
+// userInputFields are the fields of a struct holding personal information that cannot be part of a password
+// validated with the password tag.
+var userInputFields = []string{"Email", "FirstName", "LastName", "Name", "Username"}
+
+// checkResultsKey is the context key under which Validate collects what the custom checks found.
+type checkResultsKey struct{}
+
+// checkResults holds what the custom checks of a single Validate call found.
+type checkResults struct {
+	// err is the error of a check that could not be performed
+	err error
+	// policyErrs are the password policy violations, by struct field name
+	policyErrs map[string]password.PolicyError
+}
+
 // CustomValidator contains validator
 type CustomValidator struct {
 	validator *validator.Validate
@@ -20,13 +38,18 @@ func New() *CustomValidator {
 	return ctm
 }
 
-// Validate validates given struct
+// Validate validates given struct. An error that prevented a check from being performed, such as
+// failing to read the breached password list, is returned as is rather than as a validation error.
 func (cv *CustomValidator) Validate(i interface{}) error {
-	err := cv.validator.Struct(i)
-	return customError(err)
+	results := &checkResults{policyErrs: map[string]password.PolicyError{}}
+	err := cv.validator.StructCtx(context.WithValue(context.Background(), checkResultsKey{}, results), i)
+	if results.err != nil {
+		return results.err
+	}
+	return customError(err, results)
 }
 
-func customError(err error) error {
+func customError(err error, results *checkResults) error {
 	if castedObject, ok := err.(validator.ValidationErrors); ok {
 		for _, err := range castedObject {
 			switch err.Tag() {
@@ -45,6 +68,12 @@ func customError(err error) error {
 			case "unique":
 				return NewValidationError(fmt.Sprintf("%s is already taken",
 					err.Field()))
+			case "password":
+				if policyErr, ok := results.policyErrs[err.StructField()]; ok {
+					return NewValidationError(policyErr.Error())
+				}
+				return NewValidationError(fmt.Sprintf("%s does not satisfy the password policy",
+					err.Field()))
 			default:
 				return NewValidationError(fmt.Sprintf("%s validation error on %s tag", err.Field(), err.ActualTag()))
 			}
@@ -58,6 +87,42 @@ func (cv *CustomValidator) registerCustomValidation() {
 		// TODO: validate unique field
 		return true
 	})
+	_ = cv.validator.RegisterValidationCtx("password", func(ctx context.Context, fl validator.FieldLevel) bool {
+		err := password.CheckPolicy(fl.Field().String(), userInputs(fl.Parent())...)
+		if err == nil {
+			return true
+		}
+		if results, ok := ctx.Value(checkResultsKey{}).(*checkResults); ok {
+			var policyErr password.PolicyError
+			if errors.As(err, &policyErr) {
+				results.policyErrs[fl.StructFieldName()] = policyErr
+			} else {
+				results.err = err
+			}
+		}
+		return false
+	})
+}
+
+// userInputs returns the personal information held by the struct a password belongs to.
+func userInputs(parent reflect.Value) []string {
+	for parent.Kind() == reflect.Ptr {
+		parent = parent.Elem()
+	}
+	if parent.Kind() != reflect.Struct {
+		return nil
+	}
+	inputs := []string{}
+	for _, name := range userInputFields {
+		field := parent.FieldByName(name)
+		if field.Kind() == reflect.Ptr && !field.IsNil() {
+			field = field.Elem()
+		}
+		if field.Kind() == reflect.String && field.String() != "" {
+			inputs = append(inputs, field.String())
+		}
+	}
+	return inputs
 }
 
 type ValidationErrors struct {
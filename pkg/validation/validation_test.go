@@ -0,0 +1,44 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/redhajuanda/gorengan/pkg/password"
+	"github.com/stretchr/testify/assert"
+)
+
+type passwordRequest struct {
+	Email    string
+	Password string `validate:"password"`
+}
+
+func TestValidatePassword(t *testing.T) {
+	v := New()
+
+	err := v.Validate(passwordRequest{Email: "jane@gorengan.local", Password: "short"})
+	assert.IsType(t, ValidationErrors{}, err)
+	assert.EqualError(t, err, "password must be at least 8 characters long")
+	err = v.Validate(passwordRequest{Email: "jane@gorengan.local", Password: "jane-kopi-tubruk"})
+	assert.IsType(t, ValidationErrors{}, err)
+	assert.EqualError(t, err, "password must not contain your email address")
+	assert.NoError(t, v.Validate(passwordRequest{Email: "jane@gorengan.local", Password: "kopi-tubruk-42"}))
+
+	// failing to read the breached password list is not a validation error
+	file, err := ioutil.TempFile("", "breached")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\n")
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+	list, err := password.OpenBreachedList(file.Name())
+	assert.NoError(t, err)
+	assert.NoError(t, list.Close())
+	password.SetPolicy(password.Policy{MinLength: 8, Breached: list})
+	defer password.SetPolicy(password.DefaultPolicy())
+
+	err = v.Validate(passwordRequest{Email: "jane@gorengan.local", Password: "kopi-tubruk-42"})
+	assert.Error(t, err)
+	assert.IsType(t, &os.PathError{}, err)
+}